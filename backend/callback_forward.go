@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EcpayCallbackForward is one ECPay logistics callback body queued for
+// re-posting to the WordPress plugin. Rows are kept after delivery so a
+// failed forward can be inspected.
+type EcpayCallbackForward struct {
+	ID            uint   `gorm:"primaryKey"`
+	BodyHash      string `gorm:"uniqueIndex"` // ECPay retries resend the same body
+	Body          string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time  `gorm:"index"`
+	ForwardedAt   *time.Time `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+// CallbackForwarder re-posts queued ECPay callbacks to the plugin, retrying
+// with exponential backoff until the plugin answers 1|OK.
+type CallbackForwarder struct {
+	db          *gorm.DB
+	url         string
+	client      *http.Client
+	interval    time.Duration
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func newCallbackForwarder(db *gorm.DB, forwardURL string) *CallbackForwarder {
+	return &CallbackForwarder{
+		db:          db,
+		url:         forwardURL,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		interval:    time.Minute,
+		baseDelay:   30 * time.Second,
+		maxDelay:    time.Hour,
+		maxAttempts: 12,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores body for forwarding and wakes Run. A body already queued is
+// not queued again.
+func (f *CallbackForwarder) Enqueue(body []byte) error {
+	sum := sha256.Sum256(body)
+	row := EcpayCallbackForward{
+		BodyHash:      hex.EncodeToString(sum[:]),
+		Body:          string(body),
+		NextAttemptAt: time.Now(),
+	}
+	if err := f.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		return err
+	}
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run forwards queued callbacks until ctx is done.
+func (f *CallbackForwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := f.ForwardDue(ctx); err != nil {
+			log.Printf("[ecpay-callback] 讀取轉送佇列失敗：%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-f.wake:
+		}
+	}
+}
+
+// ForwardDue posts every queued callback whose next attempt is due and
+// returns how many were delivered.
+func (f *CallbackForwarder) ForwardDue(ctx context.Context) (int, error) {
+	var rows []EcpayCallbackForward
+	err := f.db.Where("forwarded_at IS NULL AND attempts < ? AND next_attempt_at <= ?", f.maxAttempts, time.Now()).
+		Order("id").Limit(100).Find(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+		row.Attempts++
+		if err := f.post(ctx, row.Body); err != nil {
+			row.LastError = err.Error()
+			row.NextAttemptAt = time.Now().Add(f.backoff(row.Attempts))
+			if row.Attempts >= f.maxAttempts {
+				log.Printf("[ecpay-callback] 轉送 #%d 失敗 %d 次，放棄：%v", row.ID, row.Attempts, err)
+			} else {
+				log.Printf("[ecpay-callback] 轉送 #%d 失敗（第 %d 次），稍後重試：%v", row.ID, row.Attempts, err)
+			}
+		} else {
+			now := time.Now()
+			row.ForwardedAt = &now
+			row.LastError = ""
+			delivered++
+		}
+		if err := f.db.Save(&row).Error; err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// backoff is the wait before the attempt following the given one.
+func (f *CallbackForwarder) backoff(attempt int) time.Duration {
+	d := f.baseDelay
+	for i := 1; i < attempt && d < f.maxDelay; i++ {
+		d *= 2
+	}
+	if d > f.maxDelay {
+		d = f.maxDelay
+	}
+	return d
+}
+
+// post re-posts an ECPay callback body to the plugin.
+func (f *CallbackForwarder) post(ctx context.Context, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(reply), "1|") {
+		return fmt.Errorf("外掛回應 HTTP=%d body=%q", resp.StatusCode, string(reply))
+	}
+	return nil
+}
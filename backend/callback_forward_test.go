@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fakePlugin stands in for the RY-Tools callback endpoint. It fails the
+// first failures posts and then answers 1|OK.
+type fakePlugin struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func (p *fakePlugin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	r.ParseForm()
+	p.bodies = append(p.bodies, r.PostForm.Encode())
+	rw.Write([]byte("1|OK"))
+}
+
+func (p *fakePlugin) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.bodies...)
+}
+
+type ecpayCallbackTest struct {
+	db        *gorm.DB
+	ecpay     *EcpayClient
+	plugin    *fakePlugin
+	forwarder *CallbackForwarder
+	srv       *httptest.Server
+}
+
+func newEcpayCallbackTest(t *testing.T, pluginFailures int) *ecpayCallbackTest {
+	t.Helper()
+	db := newTestDB(t, &LogisticsStatusEvent{}, &ShipmentStatus{}, &EcpayCallbackForward{})
+	if err := migrateLogisticsEventIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	plugin := &fakePlugin{failures: pluginFailures}
+	pluginSrv := httptest.NewServer(plugin)
+	t.Cleanup(pluginSrv.Close)
+
+	forwarder := newCallbackForwarder(db, pluginSrv.URL)
+	forwarder.baseDelay = 0
+	ecpay := &EcpayClient{MerchantID: "2000933", HashKey: "XBERn1YOvpM9nfZc", HashIV: "h1ONHk4P4yqbl5LK"}
+
+	r := gin.New()
+	r.POST("/webhooks/ecpay/logistics", ecpayLogisticsCallbackHandler(db, ecpay, forwarder))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return &ecpayCallbackTest{db: db, ecpay: ecpay, plugin: plugin, forwarder: forwarder, srv: srv}
+}
+
+// post sends fields as ECPay would, signed unless sign is false, and returns
+// the reply body.
+func (e *ecpayCallbackTest) post(t *testing.T, fields map[string]string, sign bool) string {
+	t.Helper()
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	if sign {
+		form.Set("CheckMacValue", e.ecpay.checkMacValue(fields))
+	} else {
+		form.Set("CheckMacValue", "BOGUS")
+	}
+	resp, err := e.srv.Client().Post(e.srv.URL+"/webhooks/ecpay/logistics", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func (e *ecpayCallbackTest) events(t *testing.T) []LogisticsStatusEvent {
+	t.Helper()
+	var events []LogisticsStatusEvent
+	if err := e.db.Order("id").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestEcpayCallbackDedupesEventsWithoutStatusTime(t *testing.T) {
+	e := newEcpayCallbackTest(t, 0)
+	fields := map[string]string{
+		"MerchantID":        "2000933",
+		"MerchantTradeNo":   "RY1201TS1",
+		"AllPayLogisticsID": "1900001",
+		"LogisticsSubType":  "FAMIC2C",
+		"RtnCode":           "3024",
+		"RtnMsg":            "貨到門市",
+	}
+	if reply := e.post(t, fields, true); reply != "1|OK" {
+		t.Fatalf("first callback: %q", reply)
+	}
+	// ECPay sends the same status again, without UpdateStatusDate both times.
+	fields["RtnMsg"] = "貨到門市（重送）"
+	if reply := e.post(t, fields, true); reply != "1|OK" {
+		t.Fatalf("repeat callback: %q", reply)
+	}
+	if events := e.events(t); len(events) != 1 || events[0].StatusAt != nil {
+		t.Fatalf("stored %d events (%+v), want one without a status time", len(events), events)
+	}
+
+	// A timed event with the same code is still its own row.
+	fields["UpdateStatusDate"] = "2026/10/01 10:00:00"
+	e.post(t, fields, true)
+	if events := e.events(t); len(events) != 2 {
+		t.Errorf("stored %d events, want 2", len(events))
+	}
+}
+
+func TestMigrateLogisticsEventIndexRemovesNullDuplicates(t *testing.T) {
+	db := newTestDB(t, &LogisticsStatusEvent{})
+	for _, msg := range []string{"a", "b"} {
+		if err := db.Create(&LogisticsStatusEvent{AllPayLogisticsID: "1900001", StatusCode: "3024", StatusMsg: msg}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := migrateLogisticsEventIndex(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var count int64
+	db.Model(&LogisticsStatusEvent{}).Count(&count)
+	if count != 1 {
+		t.Errorf("%d rows left, want 1", count)
+	}
+	if err := migrateLogisticsEventIndex(db); err != nil {
+		t.Errorf("second migrate: %v", err)
+	}
+}
+
+func TestEcpayCallbackForwardsWithRetry(t *testing.T) {
+	e := newEcpayCallbackTest(t, 2)
+	fields := map[string]string{
+		"MerchantID":        "2000933",
+		"MerchantTradeNo":   "RY1201TS1",
+		"AllPayLogisticsID": "1900001",
+		"RtnCode":           "300",
+		"RtnMsg":            "訂單處理中",
+	}
+	if reply := e.post(t, fields, true); reply != "1|OK" {
+		t.Fatalf("callback: %q", reply)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := e.forwarder.ForwardDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := e.plugin.received(); len(got) != 1 || !strings.Contains(got[0], "AllPayLogisticsID=1900001") {
+		t.Fatalf("plugin received %v, want the callback once", got)
+	}
+	var row EcpayCallbackForward
+	e.db.First(&row)
+	if row.ForwardedAt == nil || row.Attempts != 3 {
+		t.Errorf("queue row = %+v, want forwarded on the third attempt", row)
+	}
+
+	// Nothing is sent again once delivered, even if ECPay repeats itself.
+	e.post(t, fields, true)
+	if n, _ := e.forwarder.ForwardDue(ctx); n != 0 || len(e.plugin.received()) != 1 {
+		t.Errorf("forwarded %d more, plugin received %d", n, len(e.plugin.received()))
+	}
+}
+
+func TestEcpayCallbackForwardsUnverifiedPayload(t *testing.T) {
+	e := newEcpayCallbackTest(t, 0)
+	reply := e.post(t, map[string]string{"AllPayLogisticsID": "1900002", "RtnCode": "300"}, false)
+	if reply != "0|CheckMacValue Error" {
+		t.Fatalf("reply = %q", reply)
+	}
+	if events := e.events(t); len(events) != 0 {
+		t.Errorf("stored unverified events: %+v", events)
+	}
+	if n, err := e.forwarder.ForwardDue(context.Background()); err != nil || n != 1 {
+		t.Fatalf("ForwardDue = %d, %v; the plugin verifies the payload itself", n, err)
+	}
+}
+
+func TestCallbackForwarderGivesUp(t *testing.T) {
+	e := newEcpayCallbackTest(t, 100)
+	e.forwarder.maxAttempts = 3
+	if err := e.forwarder.Enqueue([]byte("AllPayLogisticsID=1900003")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		e.forwarder.ForwardDue(context.Background())
+	}
+	var row EcpayCallbackForward
+	e.db.First(&row)
+	if row.Attempts != 3 || row.ForwardedAt != nil || row.LastError == "" {
+		t.Errorf("queue row = %+v, want 3 failed attempts", row)
+	}
+}
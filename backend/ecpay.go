@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EcpayClient carries the ECPay logistics merchant credentials and the HTTP
+// client used for server-to-server calls. It is built once in main.
+type EcpayClient struct {
+	BaseURL    string // logistics API root, overridable to point at a fake
+	MerchantID string
+	HashKey    string
+	HashIV     string
+	HTTP       *http.Client
+
+	// Sender shown on shipments we create. Zip code and address are only
+	// needed for HOME shipments.
+	SenderName      string
+	SenderPhone     string
+	SenderCellPhone string
+	SenderZipCode   string
+	SenderAddress   string
+
+	HomeDefaults EcpayHomeOptions
+}
+
+// newEcpayClientFromEnv builds an EcpayClient from ECPAY_LOGISTICS_URL, ECPAY_MERCHANT_ID,
+// ECPAY_HASH_KEY, ECPAY_HASH_IV, the ECPAY_SENDER_* variables and the
+// ECPAY_HOME_* shipment defaults.
+func newEcpayClientFromEnv() *EcpayClient {
+	return &EcpayClient{
+		BaseURL:         strings.TrimRight(envOr("ECPAY_LOGISTICS_URL", "https://logistics.ecpay.com.tw"), "/"),
+		MerchantID:      os.Getenv("ECPAY_MERCHANT_ID"),
+		HashKey:         os.Getenv("ECPAY_HASH_KEY"),
+		HashIV:          os.Getenv("ECPAY_HASH_IV"),
+		HTTP:            &http.Client{Timeout: 30 * time.Second},
+		SenderName:      os.Getenv("ECPAY_SENDER_NAME"),
+		SenderPhone:     os.Getenv("ECPAY_SENDER_PHONE"),
+		SenderCellPhone: os.Getenv("ECPAY_SENDER_CELLPHONE"),
+		SenderZipCode:   os.Getenv("ECPAY_SENDER_ZIPCODE"),
+		SenderAddress:   os.Getenv("ECPAY_SENDER_ADDRESS"),
+		HomeDefaults: EcpayHomeOptions{
+			Temperature:           envOr("ECPAY_HOME_TEMPERATURE", "0001"),
+			Specification:         envOr("ECPAY_HOME_SPECIFICATION", "0001"),
+			ScheduledPickupTime:   envOr("ECPAY_HOME_SCHEDULED_PICKUP_TIME", "4"),
+			ScheduledDeliveryTime: envOr("ECPAY_HOME_SCHEDULED_DELIVERY_TIME", "4"),
+			GoodsWeight:           envOr("ECPAY_HOME_GOODS_WEIGHT", "1"),
+		},
+	}
+}
+
+// url returns the absolute URL of an ECPay logistics API path.
+func (e *EcpayClient) url(path string) string {
+	return e.BaseURL + path
+}
+
+// printURL returns the label print endpoint for a LogisticsSubType.
+func (e *EcpayClient) printURL(logisticsSubType string) string {
+	switch logisticsSubType {
+	case "UNIMARTC2C":
+		return e.url("/Express/PrintUniMartC2COrderInfo")
+	case "FAMIC2C":
+		return e.url("/Express/PrintFAMIC2COrderInfo")
+	case "HILIFEC2C":
+		return e.url("/Express/PrintHILIFEC2COrderInfo")
+	case "OKMARTC2C":
+		return e.url("/Express/PrintOKMARTC2COrderInfo")
+	default:
+		// B2C and HOME (TCAT / POST) shipments.
+		return e.url("/helper/printTradeDocument")
+	}
+}
+
+// configured reports whether all credentials are present.
+func (e *EcpayClient) configured() bool {
+	return e.MerchantID != "" && e.HashKey != "" && e.HashIV != ""
+}
+
+// checkMacValue signs params with the merchant's HashKey/HashIV.
+func (e *EcpayClient) checkMacValue(params map[string]string) string {
+	return generateCheckMacValue(params, e.HashKey, e.HashIV)
+}
+
+// verifyCheckMacValue checks the CheckMacValue of a form posted by ECPay
+// against every other field in it.
+func (e *EcpayClient) verifyCheckMacValue(form url.Values) bool {
+	received := form.Get("CheckMacValue")
+	if received == "" {
+		return false
+	}
+	params := make(map[string]string, len(form))
+	for k := range form {
+		if k == "CheckMacValue" {
+			continue
+		}
+		params[k] = form.Get(k)
+	}
+	return strings.EqualFold(e.checkMacValue(params), received)
+}
+
+// post signs params, form-posts them to an ECPay logistics URL and returns
+// the trimmed reply body. A non-200 reply is an error.
+func (e *EcpayClient) post(ctx context.Context, endpoint string, params map[string]string) (string, error) {
+	params["CheckMacValue"] = e.checkMacValue(params)
+
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ECPay HTTP %d: %s", resp.StatusCode, bodyStr)
+	}
+	return bodyStr, nil
+}
+
+// queryLogisticsTradeInfo asks ECPay for the current state of one shipment
+// (QueryLogisticsTradeInfo/V4). The reply's CheckMacValue is verified.
+func (e *EcpayClient) queryLogisticsTradeInfo(ctx context.Context, logisticsID string) (url.Values, error) {
+	bodyStr, err := e.post(ctx, e.url("/Helper/QueryLogisticsTradeInfo/V4"), map[string]string{
+		"MerchantID":        e.MerchantID,
+		"AllPayLogisticsID": logisticsID,
+		"TimeStamp":         strconv.FormatInt(time.Now().Unix(), 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(bodyStr, "0|") {
+		return nil, fmt.Errorf("ECPay: %s", strings.TrimPrefix(bodyStr, "0|"))
+	}
+
+	values, err := url.ParseQuery(bodyStr)
+	if err != nil {
+		return nil, fmt.Errorf("parse ECPay reply: %w", err)
+	}
+	if !e.verifyCheckMacValue(values) {
+		return nil, fmt.Errorf("ECPay reply CheckMacValue mismatch: %s", bodyStr)
+	}
+	return values, nil
+}
+
+// cancelC2COrder voids a 7-11 C2C shipment that has not been dropped off
+// (Express/CancelC2COrder). ECPay only offers this for UNIMARTC2C.
+func (e *EcpayClient) cancelC2COrder(ctx context.Context, logisticsID, paymentNo, validationNo string) error {
+	bodyStr, err := e.post(ctx, e.url("/Express/CancelC2COrder"), map[string]string{
+		"MerchantID":        e.MerchantID,
+		"AllPayLogisticsID": logisticsID,
+		"CVSPaymentNo":      paymentNo,
+		"CVSValidationNo":   validationNo,
+	})
+	if err != nil {
+		return err
+	}
+	if bodyStr != "1|OK" {
+		return fmt.Errorf("ECPay: %s", strings.TrimPrefix(bodyStr, "0|"))
+	}
+	return nil
+}
+
+// EcpayHomeOptions are the per-shipment settings of a HOME (宅配) logistics
+// order. Empty fields fall back to the ECPAY_HOME_* defaults.
+type EcpayHomeOptions struct {
+	Temperature           string `json:"temperature"`             // 0001 常溫 / 0002 冷藏 / 0003 冷凍
+	Specification         string `json:"specification"`           // 0001 60cm / 0002 90cm / 0003 120cm / 0004 150cm
+	ScheduledPickupTime   string `json:"scheduled_pickup_time"`   // 1 9-12 點 / 2 12-17 點 / 3 17-20 點 / 4 不限時
+	ScheduledDeliveryTime string `json:"scheduled_delivery_time"` // 1 13 點前 / 2 14-18 點 / 4 不限時
+	GoodsWeight           string `json:"goods_weight"`            // kg, required by POST
+}
+
+// withDefaults fills empty fields from d.
+func (o EcpayHomeOptions) withDefaults(d EcpayHomeOptions) EcpayHomeOptions {
+	if o.Temperature == "" {
+		o.Temperature = d.Temperature
+	}
+	if o.Specification == "" {
+		o.Specification = d.Specification
+	}
+	if o.ScheduledPickupTime == "" {
+		o.ScheduledPickupTime = d.ScheduledPickupTime
+	}
+	if o.ScheduledDeliveryTime == "" {
+		o.ScheduledDeliveryTime = d.ScheduledDeliveryTime
+	}
+	if o.GoodsWeight == "" {
+		o.GoodsWeight = d.GoodsWeight
+	}
+	return o
+}
+
+// validate checks the options against what ECPay accepts for subType.
+func (o EcpayHomeOptions) validate(subType string) error {
+	switch o.Temperature {
+	case "0001":
+	case "0002", "0003":
+		if subType == "POST" {
+			return fmt.Errorf("郵局宅配僅支援常溫（temperature=%s）", o.Temperature)
+		}
+	default:
+		return fmt.Errorf("invalid temperature %q", o.Temperature)
+	}
+	switch o.Specification {
+	case "0001", "0002", "0003", "0004":
+	default:
+		return fmt.Errorf("invalid specification %q", o.Specification)
+	}
+	switch o.ScheduledPickupTime {
+	case "1", "2", "3", "4":
+	default:
+		return fmt.Errorf("invalid scheduled_pickup_time %q", o.ScheduledPickupTime)
+	}
+	switch o.ScheduledDeliveryTime {
+	case "1", "2", "4":
+	default:
+		return fmt.Errorf("invalid scheduled_delivery_time %q", o.ScheduledDeliveryTime)
+	}
+	if subType == "POST" {
+		if w, err := strconv.ParseFloat(o.GoodsWeight, 64); err != nil || w <= 0 {
+			return fmt.Errorf("invalid goods_weight %q", o.GoodsWeight)
+		}
+	}
+	return nil
+}
+
+// ecpayLogisticsType returns the LogisticsType ECPay expects for subType.
+func ecpayLogisticsType(subType string) string {
+	switch subType {
+	case "TCAT", "POST":
+		return "HOME"
+	}
+	return "CVS"
+}
+
+// envOr returns the environment variable key, or def when it is unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
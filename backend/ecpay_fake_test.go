@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEcpay stands in for logistics.ecpay.com.tw (and the 7-11 print pages
+// behind it) so the create/reissue, cancel, polling, callback and print flows
+// can be tested end to end. It checks CheckMacValue on every request and
+// keeps shipments in memory.
+type fakeShipment struct {
+	ID               string
+	MerchantTradeNo  string
+	LogisticsType    string
+	LogisticsSubType string
+	GoodsAmount      string
+	IsCollection     string
+	CollectionAmount string
+	ReceiverName     string
+	PaymentNo        string
+	ValidationNo     string
+	BookingNote      string
+	Status           string
+	ServerReplyURL   string
+	TradeDate        time.Time
+	UpdatedAt        time.Time
+}
+
+type fakeEcpay struct {
+	ecpay *EcpayClient
+
+	mu        sync.Mutex
+	nextID    int64
+	shipments map[string]*fakeShipment
+}
+
+// newFakeEcpay serves a fake ECPay for the test and returns it with a client
+// pointed at it, signing with ECPay's published logistics test merchant.
+func newFakeEcpay(t *testing.T) (*fakeEcpay, *EcpayClient) {
+	t.Helper()
+	ecpay := &EcpayClient{
+		MerchantID:      "2000132",
+		HashKey:         "5294y06JbISpM5x9",
+		HashIV:          "v77hoKGq4kWxNNIS",
+		SenderName:      "測試商店",
+		SenderPhone:     "0223456789",
+		SenderCellPhone: "0912345678",
+		SenderZipCode:   "100",
+		SenderAddress:   "台北市中正區測試路1號",
+		HomeDefaults:    EcpayHomeOptions{Temperature: "0001", Specification: "0001", ScheduledPickupTime: "4", ScheduledDeliveryTime: "4", GoodsWeight: "1"},
+	}
+	f := &fakeEcpay{
+		ecpay:     ecpay,
+		nextID:    1900000,
+		shipments: make(map[string]*fakeShipment),
+	}
+	srv := httptest.NewServer(f.routes())
+	t.Cleanup(srv.Close)
+	ecpay.BaseURL = srv.URL
+	ecpay.HTTP = srv.Client()
+	return f, ecpay
+}
+
+func (f *fakeEcpay) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /Express/Create", f.create)
+	mux.HandleFunc("POST /Express/CancelC2COrder", f.cancel)
+	mux.HandleFunc("POST /Helper/QueryLogisticsTradeInfo/V4", f.query)
+	mux.HandleFunc("POST /Express/PrintUniMartC2COrderInfo", f.printUnimart)
+	mux.HandleFunc("POST /Express/PrintFAMIC2COrderInfo", f.printImages)
+	mux.HandleFunc("POST /Express/PrintHILIFEC2COrderInfo", f.printImages)
+	mux.HandleFunc("POST /Express/PrintOKMARTC2COrderInfo", f.printImages)
+	mux.HandleFunc("POST /helper/printTradeDocument", f.printImages)
+	mux.HandleFunc("POST /fake/711/print", f.unimartPage)
+	mux.HandleFunc("GET /fake/label/{id}", f.labelImage)
+	return mux
+}
+
+// readSigned parses the form and checks MerchantID and CheckMacValue. On
+// failure it writes ECPay's "0|..." reply and returns nil.
+func (f *fakeEcpay) readSigned(w http.ResponseWriter, r *http.Request) url.Values {
+	if err := r.ParseForm(); err != nil {
+		fmt.Fprint(w, "0|表單格式錯誤")
+		return nil
+	}
+	if r.PostForm.Get("MerchantID") != f.ecpay.MerchantID {
+		fmt.Fprint(w, "0|廠商編號錯誤")
+		return nil
+	}
+	if !f.ecpay.verifyCheckMacValue(r.PostForm) {
+		fmt.Fprint(w, "0|CheckMacValue Error")
+		return nil
+	}
+	return r.PostForm
+}
+
+// signed encodes params with a CheckMacValue, as ECPay replies do.
+func (f *fakeEcpay) signed(params map[string]string) string {
+	params["CheckMacValue"] = f.ecpay.checkMacValue(params)
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	return form.Encode()
+}
+
+func (f *fakeEcpay) create(w http.ResponseWriter, r *http.Request) {
+	form := f.readSigned(w, r)
+	if form == nil {
+		return
+	}
+
+	required := []string{"MerchantTradeNo", "MerchantTradeDate", "LogisticsType", "LogisticsSubType",
+		"GoodsAmount", "SenderName", "ReceiverName", "ReceiverCellPhone", "ServerReplyURL"}
+	logisticsType := form.Get("LogisticsType")
+	switch logisticsType {
+	case "CVS":
+		required = append(required, "ReceiverStoreID")
+	case "HOME":
+		required = append(required, "SenderZipCode", "SenderAddress", "ReceiverZipCode", "ReceiverAddress", "Temperature", "Specification")
+	default:
+		fmt.Fprintf(w, "0|LogisticsType 錯誤：%s", logisticsType)
+		return
+	}
+	for _, k := range required {
+		if form.Get(k) == "" {
+			fmt.Fprintf(w, "0|%s 為必填", k)
+			return
+		}
+	}
+	if form.Get("IsCollection") == "Y" {
+		if logisticsType == "HOME" {
+			fmt.Fprint(w, "0|宅配不支援代收貨款")
+			return
+		}
+		if amount, err := strconv.Atoi(form.Get("CollectionAmount")); err != nil || amount <= 0 {
+			fmt.Fprint(w, "0|CollectionAmount 錯誤")
+			return
+		}
+	}
+
+	f.mu.Lock()
+	f.nextID++
+	s := &fakeShipment{
+		ID:               strconv.FormatInt(f.nextID, 10),
+		MerchantTradeNo:  form.Get("MerchantTradeNo"),
+		LogisticsType:    logisticsType,
+		LogisticsSubType: form.Get("LogisticsSubType"),
+		GoodsAmount:      form.Get("GoodsAmount"),
+		IsCollection:     form.Get("IsCollection"),
+		CollectionAmount: form.Get("CollectionAmount"),
+		ReceiverName:     form.Get("ReceiverName"),
+		Status:           "300",
+		ServerReplyURL:   form.Get("ServerReplyURL"),
+		TradeDate:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if logisticsType == "HOME" {
+		s.BookingNote = fmt.Sprintf("9%011d", f.nextID)
+	} else {
+		s.PaymentNo = fmt.Sprintf("F%08d", f.nextID%100000000)
+		s.ValidationNo = fmt.Sprintf("%04d", f.nextID%10000)
+	}
+	f.shipments[s.ID] = s
+	f.mu.Unlock()
+
+	fmt.Fprint(w, "1|"+f.signed(map[string]string{
+		"MerchantID":        f.ecpay.MerchantID,
+		"MerchantTradeNo":   s.MerchantTradeNo,
+		"RtnCode":           s.Status,
+		"RtnMsg":            ecpayLogisticsStatusMessages[s.Status],
+		"AllPayLogisticsID": s.ID,
+		"LogisticsType":     s.LogisticsType,
+		"LogisticsSubType":  s.LogisticsSubType,
+		"GoodsAmount":       s.GoodsAmount,
+		"UpdateStatusDate":  s.UpdatedAt.In(taipeiLocation()).Format("2006/01/02 15:04:05"),
+		"ReceiverName":      s.ReceiverName,
+		"CVSPaymentNo":      s.PaymentNo,
+		"CVSValidationNo":   s.ValidationNo,
+		"BookingNote":       s.BookingNote,
+	}))
+}
+
+func (f *fakeEcpay) lookup(id string) *fakeShipment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.shipments[id]
+}
+
+func (f *fakeEcpay) cancel(w http.ResponseWriter, r *http.Request) {
+	form := f.readSigned(w, r)
+	if form == nil {
+		return
+	}
+	s := f.lookup(form.Get("AllPayLogisticsID"))
+	if s == nil {
+		fmt.Fprint(w, "0|查無物流訂單")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case s.LogisticsSubType != "UNIMARTC2C":
+		fmt.Fprint(w, "0|僅支援統一超商交貨便")
+	case s.PaymentNo != form.Get("CVSPaymentNo") || s.ValidationNo != form.Get("CVSValidationNo"):
+		fmt.Fprint(w, "0|寄貨編號或驗證碼錯誤")
+	case s.Status == "cancelled":
+		fmt.Fprint(w, "0|物流訂單已取消")
+	case !shipmentAwaitingDropOff(s.Status):
+		fmt.Fprint(w, "0|物流訂單已寄件，無法取消")
+	default:
+		s.Status = "cancelled"
+		s.UpdatedAt = time.Now()
+		fmt.Fprint(w, "1|OK")
+	}
+}
+
+func (f *fakeEcpay) query(w http.ResponseWriter, r *http.Request) {
+	form := f.readSigned(w, r)
+	if form == nil {
+		return
+	}
+	s := f.lookup(form.Get("AllPayLogisticsID"))
+	if s == nil {
+		fmt.Fprint(w, "0|查無物流訂單")
+		return
+	}
+
+	f.mu.Lock()
+	params := map[string]string{
+		"MerchantID":        f.ecpay.MerchantID,
+		"MerchantTradeNo":   s.MerchantTradeNo,
+		"AllPayLogisticsID": s.ID,
+		"GoodsAmount":       s.GoodsAmount,
+		"CollectionAmount":  s.CollectionAmount,
+		"LogisticsStatus":   s.Status,
+		"LogisticsType":     s.LogisticsType + "_" + s.LogisticsSubType,
+		"TradeDate":         s.TradeDate.In(taipeiLocation()).Format("2006/01/02 15:04:05"),
+		"UpdateStatusDate":  s.UpdatedAt.In(taipeiLocation()).Format("2006/01/02 15:04:05"),
+		"CVSPaymentNo":      s.PaymentNo,
+		"CVSValidationNo":   s.ValidationNo,
+		"BookingNote":       s.BookingNote,
+	}
+	f.mu.Unlock()
+	fmt.Fprint(w, f.signed(params))
+}
+
+// printableShipments resolves the comma-separated AllPayLogisticsID list of
+// a print request, checking CVSPaymentNo for C2C the way ECPay does.
+func (f *fakeEcpay) printableShipments(w http.ResponseWriter, r *http.Request) []*fakeShipment {
+	form := f.readSigned(w, r)
+	if form == nil {
+		return nil
+	}
+	ids := strings.Split(form.Get("AllPayLogisticsID"), ",")
+	var paymentNos []string
+	if raw := form.Get("CVSPaymentNo"); raw != "" {
+		paymentNos = strings.Split(raw, ",")
+	}
+
+	var out []*fakeShipment
+	for i, id := range ids {
+		s := f.lookup(strings.TrimSpace(id))
+		if s == nil {
+			fmt.Fprintf(w, "0|查無物流訂單 %s", id)
+			return nil
+		}
+		if strings.HasSuffix(s.LogisticsSubType, "C2C") && (i >= len(paymentNos) || paymentNos[i] != s.PaymentNo) {
+			fmt.Fprintf(w, "0|寄貨編號錯誤 %s", id)
+			return nil
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (f *fakeEcpay) baseURL(r *http.Request) string {
+	return "http://" + r.Host
+}
+
+func (f *fakeEcpay) printImages(w http.ResponseWriter, r *http.Request) {
+	shipments := f.printableShipments(w, r)
+	if shipments == nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html><html><head><title>列印託運單</title></head><body>\n")
+	for _, s := range shipments {
+		fmt.Fprintf(&b, "<div class=\"PrintArea\"><img src=\"%s/fake/label/%s\" alt=\"%s\"></div>\n",
+			f.baseURL(r), url.PathEscape(s.ID), html.EscapeString(s.ID))
+	}
+	b.WriteString("</body></html>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// printUnimart mimics ECPay handing 7-11 C2C printing off to 7-11 through an
+// auto-submitted form, which followEcpayFormRedirect follows.
+func (f *fakeEcpay) printUnimart(w http.ResponseWriter, r *http.Request) {
+	shipments := f.printableShipments(w, r)
+	if shipments == nil {
+		return
+	}
+	ids := make([]string, len(shipments))
+	for i, s := range shipments {
+		ids[i] = s.ID
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<html><body onload="document.forms[0].submit()">
+<form method="post" action="%s/fake/711/print">
+<input type="hidden" name="ids" value="%s">
+</form>
+</body></html>`, f.baseURL(r), html.EscapeString(strings.Join(ids, ",")))
+}
+
+// unimartPage is the 7-11 label page, laid out like the real one
+// (#Panel1 table, one label per cell) so patchUnimartHtml applies.
+func (f *fakeEcpay) unimartPage(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cells strings.Builder
+	for _, id := range strings.Split(r.PostForm.Get("ids"), ",") {
+		s := f.lookup(id)
+		if s == nil {
+			continue
+		}
+		fmt.Fprintf(&cells, "<td><div>交貨便服務代碼：%s%s<br>%s<br><img src=\"%s/fake/label/%s\"></div></td>\n",
+			html.EscapeString(s.PaymentNo), html.EscapeString(s.ValidationNo), html.EscapeString(s.ReceiverName),
+			f.baseURL(r), url.PathEscape(s.ID))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<html>
+<head><link href="css/print.css" rel="stylesheet" type="text/css"></head>
+<body>
+<div id="Panel1"><table><tbody><tr>
+%s</tr></tbody></table></div>
+</body>
+</html>`, cells.String())
+}
+
+// labelImage renders a placeholder label image laid out like ECPay's: a
+// bordered label with a barcode-ish stripe pattern derived from the
+// logistics ID on the left, and a bordered receipt half on the right.
+func (f *fakeEcpay) labelImage(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if f.lookup(id) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	img := fakeLabelImage(id)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// Layout of fakeLabelImage: the label occupies fakeLabelRect, the receipt
+// half the box to its right.
+var fakeLabelRect = image.Rect(20, 10, 420, 590)
+
+func fakeLabelImage(id string) *image.Gray {
+	const width, height = 700, 600
+	receipt := image.Rect(460, 10, 690, 590)
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	border := func(rect image.Rectangle, x, y int) bool {
+		return image.Pt(x, y).In(rect) && (x < rect.Min.X+4 || y < rect.Min.Y+4 || x >= rect.Max.X-4 || y >= rect.Max.Y-4)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := uint8(255)
+			if border(fakeLabelRect, x, y) || border(receipt, x, y) {
+				c = 0
+			}
+			if y > 60 && y < 200 && x > 60 && x < 380 {
+				if id[(x/6)%len(id)]%2 == byte(x/3%2) {
+					c = 0
+				}
+			}
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	return img
+}
+
+// pushStatus moves a shipment to status code and delivers the signed status
+// callback to its ServerReplyURL, like ECPay does on drop-off/pickup. It
+// returns the callback's reply.
+func (f *fakeEcpay) pushStatus(t *testing.T, id, code string) string {
+	t.Helper()
+	s := f.lookup(id)
+	if s == nil {
+		t.Fatalf("fake ECPay has no shipment %s", id)
+	}
+
+	f.mu.Lock()
+	s.Status = code
+	s.UpdatedAt = time.Now()
+	body := f.signed(map[string]string{
+		"MerchantID":        f.ecpay.MerchantID,
+		"MerchantTradeNo":   s.MerchantTradeNo,
+		"RtnCode":           code,
+		"RtnMsg":            ecpayLogisticsStatusMessages[code],
+		"AllPayLogisticsID": s.ID,
+		"LogisticsType":     s.LogisticsType,
+		"LogisticsSubType":  s.LogisticsSubType,
+		"GoodsAmount":       s.GoodsAmount,
+		"UpdateStatusDate":  s.UpdatedAt.In(taipeiLocation()).Format("2006/01/02 15:04:05"),
+		"ReceiverName":      s.ReceiverName,
+		"CVSPaymentNo":      s.PaymentNo,
+		"CVSValidationNo":   s.ValidationNo,
+		"BookingNote":       s.BookingNote,
+	})
+	replyURL := s.ServerReplyURL
+	f.mu.Unlock()
+
+	resp, err := http.Post(replyURL, "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("status callback: %v", err)
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return string(reply)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Label page size: 100mm x 150mm in PDF points.
+const (
+	labelPageWidthPt  = 100 / 25.4 * 72
+	labelPageHeightPt = 150 / 25.4 * 72
+)
+
+var labelImgRe = regexp.MustCompile(`<img[^>]+src="([^"]+)"`)
+
+// errLabelWebOnly is returned for 7-11 C2C shipments, whose labels only
+// exist as an HTML page on 7-11's site and so cannot go into a PDF.
+var errLabelWebOnly = errors.New("7-11 交貨便標籤只能以網頁列印，無法產生 PDF")
+
+// fetchLabelImages asks ECPay for one shipment's label page and downloads
+// the label images it references.
+func fetchLabelImages(ctx context.Context, ecpay *EcpayClient, info *ecpayShippingInfo) ([]image.Image, error) {
+	if info.LogisticsSubType == "UNIMARTC2C" {
+		return nil, errLabelWebOnly
+	}
+
+	urls, err := fetchLabelImageURLs(ctx, ecpay, info)
+	if err != nil {
+		return nil, err
+	}
+	var images []image.Image
+	for _, u := range urls {
+		img, err := fetchLabelImage(ctx, ecpay.HTTP, u)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// fetchLabelImage downloads and decodes one label image URL, which may
+// also be an inline data: URI.
+func fetchLabelImage(ctx context.Context, client *http.Client, src string) (image.Image, error) {
+	if strings.HasPrefix(src, "data:") {
+		comma := strings.IndexByte(src, ',')
+		if comma < 0 || !strings.Contains(src[:comma], ";base64") {
+			return nil, fmt.Errorf("不支援的圖片 data URI")
+		}
+		raw, err := base64.StdEncoding.DecodeString(src[comma+1:])
+		if err != nil {
+			return nil, fmt.Errorf("解碼標籤圖片失敗: %w", err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(raw))
+		return img, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("下載標籤圖片失敗: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下載標籤圖片失敗: HTTP %d", resp.StatusCode)
+	}
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("無法解析標籤圖片: %w", err)
+	}
+	return img, nil
+}
+
+// cropLabel trims an ECPay label image down to the label itself. The images
+// put the label on the left and a receipt half on the right, separated by a
+// band of blank columns; we cut at the widest such band in the middle of the
+// inked area and drop the blank margins around what is left.
+func cropLabel(img image.Image) image.Image {
+	b := img.Bounds()
+	inkedCol := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if isInk(img.At(x, y)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	left, right := b.Max.X, b.Min.X
+	for x := b.Min.X; x < b.Max.X; x++ {
+		if inkedCol(x, b.Min.Y, b.Max.Y) {
+			left = min(left, x)
+			right = x + 1
+		}
+	}
+	if left >= right {
+		return img
+	}
+
+	// Only a band starting between 35% and 80% of the inked width, at least
+	// 2% of the image wide, is taken for the label/receipt gap; narrower or
+	// off-centre gaps are whitespace within the label.
+	minGap := max(b.Dx()/50, 4)
+	lo, hi := left+(right-left)*35/100, left+(right-left)*80/100
+	gapStart, gapLen := 0, 0
+	for x := lo; x < hi; {
+		if inkedCol(x, b.Min.Y, b.Max.Y) {
+			x++
+			continue
+		}
+		start := x
+		for x < right && !inkedCol(x, b.Min.Y, b.Max.Y) {
+			x++
+		}
+		if x-start > gapLen {
+			gapStart, gapLen = start, x-start
+		}
+	}
+	if gapLen >= minGap {
+		right = gapStart
+	}
+
+	top, bottom := b.Max.Y, b.Min.Y
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := left; x < right; x++ {
+			if isInk(img.At(x, y)) {
+				top = min(top, y)
+				bottom = y + 1
+				break
+			}
+		}
+	}
+
+	rect := image.Rect(left, top, right, bottom)
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	return img
+}
+
+// isInk reports whether a pixel is dark enough to be part of the label,
+// treating transparency as white paper.
+func isInk(c color.Color) bool {
+	r, g, b, a := c.RGBA()
+	white := 0xffff - a
+	lum := (299*(r+white) + 587*(g+white) + 114*(b+white)) / 1000
+	return lum < 0xc000
+}
+
+// writeLabelPDF writes one 100x150mm page per image, each scaled to fit the
+// page and anchored at the top left.
+func writeLabelPDF(w io.Writer, images []image.Image) error {
+	var buf bytes.Buffer
+	var offsets []int
+	// obj starts object n (1-based, in order) and records its offset.
+	obj := func() int {
+		offsets = append(offsets, buf.Len())
+		n := len(offsets)
+		fmt.Fprintf(&buf, "%d 0 obj\n", n)
+		return n
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 and 2 are the catalog and page tree; each label then takes
+	// three objects: page, content stream and image.
+	obj()
+	buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	obj()
+	kids := make([]string, len(images))
+	for i := range images {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+i*3)
+	}
+	fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(images))
+
+	for _, img := range images {
+		b := img.Bounds()
+		drawW := labelPageWidthPt
+		drawH := drawW * float64(b.Dy()) / float64(b.Dx())
+		if drawH > labelPageHeightPt {
+			drawW, drawH = labelPageHeightPt*float64(b.Dx())/float64(b.Dy()), labelPageHeightPt
+		}
+
+		page := obj()
+		fmt.Fprintf(&buf, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			labelPageWidthPt, labelPageHeightPt, page+2, page+1)
+
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 %.2f cm /Im0 Do Q\n", drawW, drawH, labelPageHeightPt-drawH)
+		obj()
+		fmt.Fprintf(&buf, "<< /Length %d >>\nstream\n%sendstream\nendobj\n", len(content), content)
+
+		data, err := deflateRGB(img)
+		if err != nil {
+			return err
+		}
+		obj()
+		fmt.Fprintf(&buf, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n",
+			b.Dx(), b.Dy(), len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// deflateRGB returns img as zlib-compressed 8-bit RGB samples, with
+// transparency flattened onto white.
+func deflateRGB(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	row := make([]byte, b.Dx()*3)
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			white := 0xffff - a
+			i := (x - b.Min.X) * 3
+			row[i] = byte((r + white) >> 8)
+			row[i+1] = byte((g + white) >> 8)
+			row[i+2] = byte((bl + white) >> 8)
+		}
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// buildLabelPDF renders the labels of orderIDs, in that order, as one PDF.
+// Orders whose label cannot be rendered (or, with skipPrinted, was already
+// printed) are left out; the report says which and why.
+func buildLabelPDF(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderIDs []int, skipPrinted bool) ([]byte, []LabelPrintItem, error) {
+	report, infos := resolveLabelTargets(ctx, db, woo, orderIDs, skipPrinted)
+	var pages []image.Image
+	for i, info := range infos {
+		if info == nil {
+			continue
+		}
+		images, err := fetchLabelImages(ctx, ecpay, info)
+		if err != nil {
+			report[i].Error = err.Error()
+			report[i].WebOnly = errors.Is(err, errLabelWebOnly)
+			continue
+		}
+		for _, img := range images {
+			pages = append(pages, cropLabel(img))
+		}
+		report[i].OK = true
+	}
+	if len(pages) == 0 {
+		return nil, report, fmt.Errorf("沒有可產生 PDF 的標籤")
+	}
+
+	var buf bytes.Buffer
+	if err := writeLabelPDF(&buf, pages); err != nil {
+		return nil, report, err
+	}
+	return buf.Bytes(), report, nil
+}
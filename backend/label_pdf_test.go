@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestCropLabelCutsAtReceiptGap(t *testing.T) {
+	got := cropLabel(fakeLabelImage("1900001")).Bounds()
+	if got != fakeLabelRect {
+		t.Errorf("crop = %v, want the label box %v", got, fakeLabelRect)
+	}
+}
+
+func TestCropLabelTrimsMarginsOfSingleLabel(t *testing.T) {
+	// A label with no receipt half: only whitespace inside it, narrower than
+	// the label/receipt gap, and blank margins around it.
+	img := image.NewRGBA(image.Rect(0, 0, 500, 800))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	black := image.NewUniform(color.Black)
+	draw.Draw(img, image.Rect(30, 40, 230, 100), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(236, 40, 470, 100), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(30, 600, 470, 700), black, image.Point{}, draw.Src)
+
+	if got, want := cropLabel(img).Bounds(), image.Rect(30, 40, 470, 700); got != want {
+		t.Errorf("crop = %v, want %v", got, want)
+	}
+}
+
+func TestCropLabelTreatsTransparencyAsPaper(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, image.Rect(10, 20, 60, 70), image.NewUniform(color.NRGBA{A: 255}), image.Point{}, draw.Src)
+
+	if got, want := cropLabel(img).Bounds(), image.Rect(10, 20, 60, 70); got != want {
+		t.Errorf("crop = %v, want %v", got, want)
+	}
+}
+
+func TestCropLabelLeavesBlankImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 50, 50))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	if got := cropLabel(img).Bounds(); got != img.Bounds() {
+		t.Errorf("crop = %v, want the whole image", got)
+	}
+}
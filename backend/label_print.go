@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// LabelPrintItem reports whether one order's label made it into a batch
+// print document.
+type LabelPrintItem struct {
+	OrderID     int    `json:"order_id"`
+	LogisticsID string `json:"logistics_id,omitempty"`
+	SubType     string `json:"sub_type,omitempty"`
+	OK          bool   `json:"ok"`
+	Skipped     bool   `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+	WebOnly     bool   `json:"web_only,omitempty"` // 7-11 C2C: left out of PDFs, print the web page instead
+
+	// PreviouslyPrinted is the latest earlier print of this label, if any.
+	PreviouslyPrinted *LabelPrint `json:"previously_printed,omitempty"`
+}
+
+// labelPageCSS lays out image labels one per 100x150mm page, showing the
+// label half of ECPay's label images.
+const labelPageCSS = `<style>
+@media print {
+    @page {
+        size: 100mm 150mm;
+        margin: 0;
+    }
+    body { margin: 0; padding: 0; }
+    .label-page {
+        page-break-after: always;
+        width: 100mm;
+        height: 150mm;
+        overflow: hidden;
+    }
+    .label-page:last-child { page-break-after: avoid; }
+    .label-page img {
+        width: 175%;
+        max-width: none;
+    }
+    #printPageButton, #labelReport { display: none !important; }
+}
+.label-page {
+    margin: 10px auto;
+    border: 1px dashed #ccc;
+    padding: 0;
+    max-width: 100mm;
+    overflow: hidden;
+}
+.label-page img { width: 175%; max-width: none; }
+#labelReport { margin: 10px auto; max-width: 160mm; padding: 8px 12px; text-align: left; font-size: 14px; border-radius: 4px; }
+#labelReport.ok { background: #d1e7dd; color: #0f5132; }
+#labelReport.failed { background: #f8d7da; color: #842029; }
+</style>`
+
+// fetchLabelImageURLs asks ECPay for one non-7-11 shipment's label page and
+// returns the absolute URLs of the label images on it.
+func fetchLabelImageURLs(ctx context.Context, ecpay *EcpayClient, info *ecpayShippingInfo) ([]string, error) {
+	params := map[string]string{
+		"MerchantID":        ecpay.MerchantID,
+		"AllPayLogisticsID": info.LogisticsID,
+	}
+	if strings.HasSuffix(info.LogisticsSubType, "C2C") {
+		params["CVSPaymentNo"] = info.PaymentNo
+	}
+	printURL := ecpay.printURL(info.LogisticsSubType)
+	body, err := ecpay.post(ctx, printURL, params)
+	if err != nil {
+		return nil, fmt.Errorf("無法連線綠界列印服務: %w", err)
+	}
+
+	matches := labelImgRe.FindAllStringSubmatch(body, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("綠界回應中沒有標籤圖片")
+	}
+	base, _ := url.Parse(printURL)
+	urls := make([]string, 0, len(matches))
+	for _, m := range matches {
+		src := strings.ReplaceAll(m[1], "&amp;", "&")
+		if ref, err := url.Parse(src); err == nil && !strings.HasPrefix(src, "data:") {
+			src = base.ResolveReference(ref).String()
+		}
+		urls = append(urls, src)
+	}
+	return urls, nil
+}
+
+// fetchUnimartLabelPage follows ECPay's redirect chain to the 7-11 page
+// that prints every given UNIMARTC2C shipment, and patches it for thermal
+// label printing.
+func fetchUnimartLabelPage(ctx context.Context, ecpay *EcpayClient, infos []*ecpayShippingInfo) (string, error) {
+	var ids, paymentNos, validationNos []string
+	for _, info := range infos {
+		ids = append(ids, info.LogisticsID)
+		paymentNos = append(paymentNos, info.PaymentNo)
+		validationNos = append(validationNos, info.ValidationNo)
+	}
+	params := map[string]string{
+		"MerchantID":        ecpay.MerchantID,
+		"AllPayLogisticsID": strings.Join(ids, ","),
+		"CVSPaymentNo":      strings.Join(paymentNos, ","),
+		"CVSValidationNo":   strings.Join(validationNos, ","),
+	}
+	formData := url.Values{}
+	for k, v := range params {
+		formData.Set(k, v)
+	}
+	formData.Set("CheckMacValue", ecpay.checkMacValue(params))
+
+	client := newCookieClient(ecpay.HTTP)
+	ecpayBody, err := postFormContext(ctx, client, ecpay.printURL("UNIMARTC2C"), formData)
+	if err != nil {
+		return "", fmt.Errorf("無法連線綠界列印服務: %w", err)
+	}
+
+	sevenHtml, err := followEcpayFormRedirect(ctx, client, ecpayBody)
+	if err != nil {
+		return "", fmt.Errorf("無法取得 7-11 列印頁面: %w", err)
+	}
+	return patchUnimartHtml(sevenHtml), nil
+}
+
+// resolveLabelTargets looks up each order's active shipment and earlier
+// prints. infos[i] is nil when report[i] already says why order i gets no
+// label; with skipPrinted that includes labels printed before.
+func resolveLabelTargets(ctx context.Context, db *gorm.DB, woo *WooClient, orderIDs []int, skipPrinted bool) ([]LabelPrintItem, []*ecpayShippingInfo) {
+	report := make([]LabelPrintItem, len(orderIDs))
+	infos := make([]*ecpayShippingInfo, len(orderIDs))
+	var logisticsIDs []string
+	for i, id := range orderIDs {
+		report[i].OrderID = id
+		order, err := woo.fetchSingleOrder(ctx, id)
+		if err != nil {
+			report[i].Error = "無法取得訂單: " + err.Error()
+			continue
+		}
+		info := getEcpayShippingInfo(&order)
+		if info == nil {
+			report[i].Error = "此訂單沒有綠界物流資訊"
+			continue
+		}
+		report[i].LogisticsID = info.LogisticsID
+		report[i].SubType = info.LogisticsSubType
+		infos[i] = info
+		logisticsIDs = append(logisticsIDs, info.LogisticsID)
+	}
+
+	prints, err := lastLabelPrints(db, logisticsIDs)
+	if err != nil {
+		log.Printf("[label-print] 讀取列印紀錄失敗：%v", err)
+	}
+	for i := range report {
+		p, ok := prints[report[i].LogisticsID]
+		if infos[i] == nil || !ok {
+			continue
+		}
+		report[i].PreviouslyPrinted = p
+		if skipPrinted {
+			report[i].Skipped = true
+			infos[i] = nil
+		}
+	}
+	return report, infos
+}
+
+// buildBatchLabelDocument fetches the labels of every order across
+// carriers. 7-11 C2C labels come as one 7-11 page; the other carriers'
+// image labels follow it in request order. Every order gets a report item.
+func buildBatchLabelDocument(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderIDs []int, skipPrinted bool) (string, []LabelPrintItem) {
+	report, infos := resolveLabelTargets(ctx, db, woo, orderIDs, skipPrinted)
+	var unimart []*ecpayShippingInfo
+	var unimartItems []int
+	var labelPages strings.Builder
+
+	for i, info := range infos {
+		if info == nil {
+			continue
+		}
+		if info.LogisticsSubType == "UNIMARTC2C" {
+			unimart = append(unimart, info)
+			unimartItems = append(unimartItems, i)
+			continue
+		}
+
+		urls, err := fetchLabelImageURLs(ctx, ecpay, info)
+		if err != nil {
+			report[i].Error = err.Error()
+			continue
+		}
+		for _, u := range urls {
+			fmt.Fprintf(&labelPages, "<div class=\"label-page\"><img src=\"%s\"></div>\n", html.EscapeString(u))
+		}
+		report[i].OK = true
+	}
+
+	var sevenHtml string
+	if len(unimart) > 0 {
+		page, err := fetchUnimartLabelPage(ctx, ecpay, unimart)
+		for _, i := range unimartItems {
+			if err != nil {
+				report[i].Error = err.Error()
+			} else {
+				report[i].OK = true
+			}
+		}
+		sevenHtml = page
+	}
+
+	banner := labelReportBanner(report)
+	if sevenHtml == "" {
+		return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+%s
+<style>body { margin: 20px; text-align: center; }</style>
+</head>
+<body>
+<button id="printPageButton" onclick="window.print();">列印</button>
+%s
+%s
+</body>
+</html>`, labelPageCSS, banner, labelPages.String()), report
+	}
+
+	// Append the image labels and the report to the 7-11 page.
+	sevenHtml = strings.Replace(sevenHtml, "</head>", labelPageCSS+"\n</head>", 1)
+	bodyRe := regexp.MustCompile(`(<body[^>]*>(?:<button id="printPageButton"[^>]*>[^<]*</button>)?)`)
+	if loc := bodyRe.FindStringIndex(sevenHtml); loc != nil {
+		sevenHtml = sevenHtml[:loc[1]] + banner + sevenHtml[loc[1]:]
+	}
+	if labelPages.Len() > 0 {
+		extra := "<div style=\"page-break-before: always;\">\n" + labelPages.String() + "</div>\n"
+		if idx := strings.LastIndex(sevenHtml, "</body>"); idx >= 0 {
+			sevenHtml = sevenHtml[:idx] + extra + sevenHtml[idx:]
+		} else {
+			sevenHtml += extra
+		}
+	}
+	return sevenHtml, report
+}
+
+// labelReportBanner summarises a batch for the screen; it is hidden when
+// printing.
+func labelReportBanner(report []LabelPrintItem) string {
+	var failed, skipped, reprinted []string
+	for _, item := range report {
+		label := fmt.Sprintf("訂單 #%d", item.OrderID)
+		if item.SubType != "" {
+			label += " " + item.SubType
+		}
+		var printed string
+		if p := item.PreviouslyPrinted; p != nil {
+			printed = fmt.Sprintf("已於 %s 由 %s 列印", p.PrintedAt.In(taipeiLocation()).Format("2006-01-02 15:04"), p.PrintedBy)
+		}
+		switch {
+		case item.Skipped:
+			skipped = append(skipped, "<li>"+html.EscapeString(label+"："+printed)+"</li>")
+		case !item.OK:
+			failed = append(failed, "<li>"+html.EscapeString(label+"："+item.Error)+"</li>")
+		case printed != "":
+			reprinted = append(reprinted, "<li>"+html.EscapeString(label+"："+printed)+"</li>")
+		}
+	}
+
+	class := "ok"
+	if len(failed) > 0 || len(reprinted) > 0 {
+		class = "failed"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div id="labelReport" class="%s">共 %d 筆訂單`, class, len(report))
+	if len(failed)+len(skipped)+len(reprinted) == 0 {
+		b.WriteString("，標籤全部取得")
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, "<div>%d 筆無法取得標籤：<ul>%s</ul></div>", len(failed), strings.Join(failed, ""))
+	}
+	if len(reprinted) > 0 {
+		fmt.Fprintf(&b, "<div>%d 筆標籤先前已列印過，請確認是否重複列印：<ul>%s</ul></div>", len(reprinted), strings.Join(reprinted, ""))
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&b, "<div>略過 %d 筆已列印的標籤：<ul>%s</ul></div>", len(skipped), strings.Join(skipped, ""))
+	}
+	b.WriteString(`<div><small>開啟此頁時即記錄為已列印，實際未印出的標籤下次列印時仍會提示。</small></div></div>`)
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLabelPrintedByFoldsOperatorName(t *testing.T) {
+	for raw, want := range map[string]string{
+		"  小美  ":                "小美",
+		"小美\n#99（2026/01/01）":   "小美 #99（2026/01/01）",
+		strings.Repeat("長", 60): strings.Repeat("長", maxPrintedByRunes),
+		"":                      "192.0.2.1",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/?printed_by="+url.QueryEscape(raw), nil)
+		if got := labelPrintedBy(c); got != want {
+			t.Errorf("labelPrintedBy(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestLabelReportBannerEscapesPrintedBy(t *testing.T) {
+	prev := &LabelPrint{PrintedBy: `<img src=x onerror=alert(1)>`, PrintedAt: time.Now()}
+	banner := labelReportBanner([]LabelPrintItem{{OrderID: 1, OK: true, PreviouslyPrinted: prev}})
+	if strings.Contains(banner, "<img") {
+		t.Errorf("banner contains unescaped printed_by: %s", banner)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"database/sql/driver"
 	"encoding/hex"
@@ -19,7 +20,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -85,12 +85,20 @@ type OrderMetadata struct {
 	Remark      string      `json:"remark"`
 	Tags        StringArray `json:"tags" gorm:"type:jsonb"`
 	IsCompleted bool        `json:"is_completed"`
+
+	// WooCommerce note sync bookkeeping (see syncOrderNotes).
+	SyncedRemark string      `json:"-"`
+	SyncedTags   StringArray `json:"-" gorm:"type:jsonb"`
+	LastNoteID   int         `json:"-"`
+	NoteSyncedAt *time.Time  `json:"-"` // first sync; older wp-admin notes are never pulled
+	SyncConflict string      `json:"sync_conflict,omitempty"`
 }
 
 type WooOrder struct {
 	ID                 int            `json:"id"`
 	Status             string         `json:"status"`
 	DateCreated        string         `json:"date_created"`
+	DateModifiedGMT    string         `json:"date_modified_gmt"`
 	Shipping           ShippingInfo   `json:"shipping"`
 	Billing            BillingInfo    `json:"billing"`
 	Total              string         `json:"total"`
@@ -98,9 +106,14 @@ type WooOrder struct {
 	MetaData           []MetaData     `json:"meta_data"`
 	CustomerNote       string         `json:"customer_note"`
 	ShippingLines      []ShippingLine `json:"shipping_lines"`
+	PaymentMethod      string         `json:"payment_method"`
 	PaymentMethodTitle string         `json:"payment_method_title"`
 	OrderMetadata      OrderMetadata  `json:"order_metadata" gorm:"-"`
 	CVSStoreName       string         `json:"cvs_store_name" gorm:"-"`
+
+	ShipmentTimeline []LogisticsStatusEvent `json:"shipment_timeline,omitempty" gorm:"-"`
+	ShipmentStatus   *ShipmentStatus        `json:"shipment_status,omitempty" gorm:"-"`
+	LabelPrint       *LabelPrint            `json:"label_print,omitempty" gorm:"-"`
 }
 
 type BillingInfo struct {
@@ -112,6 +125,12 @@ type ShippingInfo struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Phone     string `json:"phone"`
+	Address1  string `json:"address_1"`
+	Address2  string `json:"address_2"`
+	City      string `json:"city"`
+	State     string `json:"state"`
+	Postcode  string `json:"postcode"`
+	Country   string `json:"country"`
 }
 
 type LineItem struct {
@@ -136,7 +155,8 @@ type ShippingLine struct {
 
 type UploadedOrder struct {
 	ID            uint      `json:"id" gorm:"primaryKey"`
-	OrderNo       string    `json:"order_no"`
+	OrderNo       string    `json:"order_no" gorm:"uniqueIndex:idx_uploaded_order_line"`
+	LineKey       string    `json:"line_key" gorm:"uniqueIndex:idx_uploaded_order_line"` // product name + "#" + occurrence within the order
 	OrderedAt     time.Time `json:"ordered_at"`
 	ReceiverName  string    `json:"receiver_name"`
 	Address       string    `json:"address"`
@@ -145,7 +165,28 @@ type UploadedOrder struct {
 	DiscountPrice float64   `json:"discount_price"`
 	Qty           int       `json:"qty"`
 	Note          string    `json:"note"`
-	IsShipping    bool      `json:"is_shipping" gorm:"default:false"`
+	IsShipping    bool      `json:"is_shipping" gorm:"default:false;uniqueIndex:idx_uploaded_order_line"`
+	BatchID       *uint     `json:"batch_id,omitempty" gorm:"index"` // batch that last wrote this row
+}
+
+// UploadResult counts what an upload did to the stored rows.
+type UploadResult struct {
+	Rows      int  `json:"rows"`
+	Inserted  int  `json:"inserted"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	Removed   int  `json:"removed"` // missing lines deleted (remove_missing)
+	Missing   int  `json:"missing"` // stored lines of uploaded orders missing from the file
+	BatchID   uint `json:"batch_id"`
+
+	// DuplicateOfBatch is an earlier, not rolled back batch of the same file.
+	DuplicateOfBatch uint `json:"duplicate_of_batch,omitempty"`
+
+	// Set when rows were rejected (allow_partial): the rejects and where
+	// to download them as an .xlsx.
+	Rejected   int              `json:"rejected,omitempty"`
+	Errors     []UploadRowError `json:"errors,omitempty"`
+	RejectsURL string           `json:"rejects_url,omitempty"`
 }
 
 type UploadedOrderItem struct {
@@ -181,8 +222,20 @@ type CombinedPickingItem struct {
 }
 
 type UploadBatch struct {
-	ID         uint      `json:"id" gorm:"primaryKey"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	Filename     string     `json:"filename"`
+	UploadedBy   string     `json:"uploaded_by"`
+	IsShipping   bool       `json:"is_shipping" gorm:"index"`
+	SheetName    string     `json:"sheet_name"`
+	FileHash     string     `json:"file_hash" gorm:"index"` // sha256 of the uploaded file
+	RowCount     int        `json:"row_count"`
+	Inserted     int        `json:"inserted"`
+	Updated      int        `json:"updated"`
+	Unchanged    int        `json:"unchanged"`
+	Removed      int        `json:"removed"`
+	Rejected     int        `json:"rejected"`
+	RolledBackAt *time.Time `json:"rolled_back_at,omitempty"`
 }
 
 type ProductNameMapping struct {
@@ -322,82 +375,90 @@ func logRow(label string, rowNumber int, row []string) {
 	log.Printf("%s 第 %d 列：%s", label, rowNumber, strings.Join(row, " | "))
 }
 
-func parseUploadedRow(row []string, headerIndex map[string]int, rowNumber int) (UploadedOrder, error) {
+// uploadedColumnLabels names each upload field in messages.
+var uploadedColumnLabels = map[string]string{
+	"order_no":       "訂單編號",
+	"ordered_at":     "訂購日期",
+	"receiver_name":  "收件人",
+	"address":        "取件地址",
+	"product_name":   "商品名稱",
+	"unit_price":     "單價",
+	"discount_price": "優惠價",
+	"qty":            "數量",
+	"note":           "備註",
+}
+
+// parseUploadedRow parses one data row, checking every column and
+// returning one UploadRowError per bad field.
+func parseUploadedRow(row []string, headerIndex map[string]int, rowNumber int) (UploadedOrder, []UploadRowError) {
+	var errs []UploadRowError
 	get := func(column string) string {
 		if idx, ok := headerIndex[column]; ok && idx < len(row) {
 			return strings.TrimSpace(row[idx])
 		}
 		return ""
 	}
-
-	order := UploadedOrder{}
-	if value := get("order_no"); value != "" {
-		order.OrderNo = value
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少訂單編號", rowNumber)
+	fail := func(column, value, reason string, format string, args ...interface{}) {
+		errs = append(errs, UploadRowError{
+			Row:    rowNumber,
+			Column: column,
+			Value:  value,
+			Reason: reason,
+			Error:  fmt.Sprintf(format, args...),
+		})
 	}
-
-	if value := get("receiver_name"); value != "" {
-		order.ReceiverName = value
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少收件人", rowNumber)
+	required := func(column string) string {
+		value := get(column)
+		if value == "" {
+			fail(column, value, "缺少"+uploadedColumnLabels[column], "第 %d 列缺少%s", rowNumber, uploadedColumnLabels[column])
+		}
+		return value
 	}
-
-	if value := get("address"); value != "" {
-		order.Address = value
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少取件地址", rowNumber)
+	invalid := func(column, value string, err error) {
+		fail(column, value, "格式錯誤："+err.Error(), "第 %d 列的%s格式錯誤：%v", rowNumber, uploadedColumnLabels[column], err)
 	}
 
-	if value := get("product_name"); value != "" {
-		order.ProductName = value
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少商品名稱", rowNumber)
+	order := UploadedOrder{
+		OrderNo:      required("order_no"),
+		ReceiverName: required("receiver_name"),
+		Address:      required("address"),
+		ProductName:  required("product_name"),
+		Note:         get("note"),
 	}
 
-	order.Note = get("note")
-
-	if value := get("ordered_at"); value != "" {
+	if value := required("ordered_at"); value != "" {
 		parsed, err := parseDateTime(value)
 		if err != nil {
-			return order, fmt.Errorf("第 %d 列的訂購日期格式錯誤：%w", rowNumber, err)
+			invalid("ordered_at", value, err)
 		}
 		order.OrderedAt = parsed
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少訂購日期", rowNumber)
 	}
 
-	if value := get("unit_price"); value != "" {
+	if value := required("unit_price"); value != "" {
 		parsed, err := parseNumber(value)
 		if err != nil {
-			return order, fmt.Errorf("第 %d 列的單價格式錯誤：%w", rowNumber, err)
+			invalid("unit_price", value, err)
 		}
 		order.UnitPrice = parsed
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少單價", rowNumber)
 	}
 
-	if value := get("discount_price"); value != "" {
+	if value := required("discount_price"); value != "" {
 		parsed, err := parseNumber(value)
 		if err != nil {
-			return order, fmt.Errorf("第 %d 列的優惠價格式錯誤：%w", rowNumber, err)
+			invalid("discount_price", value, err)
 		}
 		order.DiscountPrice = parsed
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少優惠價", rowNumber)
 	}
 
-	if value := get("qty"); value != "" {
+	if value := required("qty"); value != "" {
 		parsed, err := parseInteger(value)
 		if err != nil {
-			return order, fmt.Errorf("第 %d 列的數量格式錯誤：%w", rowNumber, err)
+			invalid("qty", value, err)
 		}
 		order.Qty = parsed
-	} else {
-		return order, fmt.Errorf("第 %d 列缺少數量", rowNumber)
 	}
 
-	return order, nil
+	return order, errs
 }
 
 func detectHeaderRow(rows [][]string) (map[string]int, int, error) {
@@ -464,6 +525,11 @@ func parseDateTime(raw string) (time.Time, error) {
 		"2006-01-02",
 		"2006.01.02 15:04:05",
 		"2006.1.2 15:04:05",
+		// CSV saved from Excel drops leading zeros and seconds.
+		"2006/1/2 15:04:05",
+		"2006/1/2 15:04",
+		"2006-1-2 15:04",
+		"2006/1/2",
 	}
 	for _, layout := range layouts {
 		if t, err := time.Parse(layout, clean); err == nil {
@@ -474,15 +540,209 @@ func parseDateTime(raw string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("無法解析日期：%s", raw)
 }
 
-func saveUploadedOrders(db *gorm.DB, orders []UploadedOrder) error {
+// assignLineKeys numbers repeated products within an order so every line
+// of an export gets a stable key: "商品#1", "商品#2", ...
+func assignLineKeys(orders []UploadedOrder) {
+	seen := make(map[[2]string]int)
+	for i := range orders {
+		k := [2]string{orders[i].OrderNo, orders[i].ProductName}
+		seen[k]++
+		orders[i].LineKey = fmt.Sprintf("%s#%d", orders[i].ProductName, seen[k])
+	}
+}
+
+// sameUploadedLine reports whether two rows for the same line carry the
+// same data.
+func sameUploadedLine(a, b UploadedOrder) bool {
+	return a.OrderedAt.Equal(b.OrderedAt) &&
+		a.ReceiverName == b.ReceiverName &&
+		a.Address == b.Address &&
+		a.ProductName == b.ProductName &&
+		a.UnitPrice == b.UnitPrice &&
+		a.DiscountPrice == b.DiscountPrice &&
+		a.Qty == b.Qty &&
+		a.Note == b.Note
+}
+
+// uploadPlan is what saving a set of parsed rows would do.
+type uploadPlan struct {
+	inserts   []UploadedOrder
+	updates   []uploadUpdate
+	unchanged []UploadedOrder
+	missing   []UploadedOrder // stored lines the export no longer has
+}
+
+type uploadUpdate struct {
+	before UploadedOrder
+	after  UploadedOrder // carries before's ID
+}
+
+// planUploadedOrders matches rows (line keys assigned) against the stored
+// rows with the same (is_shipping, order_no, line_key). Stored lines of an
+// uploaded order that the rows no longer have were renamed or dropped in
+// the export and are listed as missing, except in partial orders: those
+// had a rejected row, so their full set of lines is unknown. A rejected row
+// without an order number (partial[""]) could be any order's, so nothing
+// is listed then.
+func planUploadedOrders(db *gorm.DB, orders []UploadedOrder, partial map[string]bool) (uploadPlan, error) {
+	var plan uploadPlan
 	if len(orders) == 0 {
+		return plan, nil
+	}
+	orderNos := make([]string, 0, len(orders))
+	for _, o := range orders {
+		orderNos = append(orderNos, o.OrderNo)
+	}
+	var existing []UploadedOrder
+	if err := db.Where("is_shipping = ? AND order_no IN ?", orders[0].IsShipping, orderNos).
+		Order("id").Find(&existing).Error; err != nil {
+		return plan, err
+	}
+	byKey := make(map[[2]string]UploadedOrder, len(existing))
+	for _, e := range existing {
+		byKey[[2]string{e.OrderNo, e.LineKey}] = e
+	}
+
+	seen := make(map[[2]string]bool, len(orders))
+	for _, o := range orders {
+		seen[[2]string{o.OrderNo, o.LineKey}] = true
+		e, ok := byKey[[2]string{o.OrderNo, o.LineKey}]
+		switch {
+		case !ok:
+			plan.inserts = append(plan.inserts, o)
+		case sameUploadedLine(e, o):
+			plan.unchanged = append(plan.unchanged, e)
+		default:
+			o.ID = e.ID
+			plan.updates = append(plan.updates, uploadUpdate{before: e, after: o})
+		}
+	}
+	if partial[""] {
+		return plan, nil
+	}
+	for _, e := range existing {
+		if !seen[[2]string{e.OrderNo, e.LineKey}] && !partial[e.OrderNo] {
+			plan.missing = append(plan.missing, e)
+		}
+	}
+	return plan, nil
+}
+
+// saveUploadedOrders records batch and upserts an export's rows keyed on
+// (is_shipping, order_no, line_key), so uploading the same export again
+// updates rows instead of doubling them. Stored lines of an uploaded order
+// that the upload no longer has (see planUploadedOrders) are kept and
+// counted as missing unless removeMissing is set, which deletes them. Every
+// insert, update and delete is logged as an UploadRowChange so the batch
+// can be rolled back. orders carry the line keys parseUploadSheet assigned.
+func saveUploadedOrders(db *gorm.DB, batch *UploadBatch, orders []UploadedOrder, partial map[string]bool, removeMissing bool) (UploadResult, error) {
+	result := UploadResult{Rows: len(orders)}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		plan, err := planUploadedOrders(tx, orders, partial)
+		if err != nil {
+			return err
+		}
+
+		batch.UploadedAt = time.Now()
+		batch.RowCount = len(orders)
+		batch.Inserted = len(plan.inserts)
+		batch.Updated = len(plan.updates)
+		batch.Unchanged = len(plan.unchanged)
+		var removals []UploadedOrder
+		if removeMissing {
+			removals = plan.missing
+		}
+		batch.Removed = len(removals)
+		if err := tx.Create(batch).Error; err != nil {
+			return err
+		}
+
+		var changes []UploadRowChange
+		for _, u := range plan.updates {
+			u.after.BatchID = &batch.ID
+			if err := tx.Save(&u.after).Error; err != nil {
+				return err
+			}
+			before, _ := json.Marshal(u.before)
+			changes = append(changes, UploadRowChange{
+				BatchID: batch.ID, UploadedOrderID: u.after.ID, Action: "update", Before: string(before),
+			})
+		}
+		for _, r := range removals {
+			if err := tx.Delete(&UploadedOrder{}, r.ID).Error; err != nil {
+				return err
+			}
+			before, _ := json.Marshal(r)
+			changes = append(changes, UploadRowChange{
+				BatchID: batch.ID, UploadedOrderID: r.ID, Action: "delete", Before: string(before),
+			})
+		}
+		if len(plan.inserts) > 0 {
+			for i := range plan.inserts {
+				plan.inserts[i].BatchID = &batch.ID
+			}
+			if err := tx.Create(&plan.inserts).Error; err != nil {
+				return err
+			}
+			for _, o := range plan.inserts {
+				changes = append(changes, UploadRowChange{BatchID: batch.ID, UploadedOrderID: o.ID, Action: "insert"})
+			}
+		}
+		if len(changes) > 0 {
+			if err := tx.Create(&changes).Error; err != nil {
+				return err
+			}
+		}
+
+		result.Inserted = len(plan.inserts)
+		result.Updated = len(plan.updates)
+		result.Unchanged = len(plan.unchanged)
+		result.Removed = len(removals)
+		result.Missing = len(plan.missing) - len(removals)
+		result.BatchID = batch.ID
 		return nil
+	})
+	if err != nil {
+		return UploadResult{}, err
 	}
+	return result, nil
+}
 
-	return db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(&orders).Error; err != nil {
+// backfillUploadedOrderLineKeys gives rows stored before line keys existed
+// one, numbering repeated products in insertion order, so the unique index
+// on (is_shipping, order_no, line_key) can be created. It runs before
+// AutoMigrate and does nothing once every row has a key.
+func backfillUploadedOrderLineKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&UploadedOrder{}) {
+		return nil
+	}
+	if !m.HasColumn(&UploadedOrder{}, "LineKey") {
+		if err := m.AddColumn(&UploadedOrder{}, "LineKey"); err != nil {
 			return err
 		}
+	}
+
+	var rows []UploadedOrder
+	if err := db.Where("line_key IS NULL OR line_key = ''").Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		seen := make(map[string]int)
+		for _, row := range rows {
+			k := fmt.Sprintf("%t|%s|%s", row.IsShipping, row.OrderNo, row.ProductName)
+			seen[k]++
+			key := fmt.Sprintf("%s#%d", row.ProductName, seen[k])
+			if err := tx.Model(&UploadedOrder{}).Where("id = ?", row.ID).Update("line_key", key).Error; err != nil {
+				return err
+			}
+		}
+		log.Printf("[upload] 已為 %d 筆既有上傳資料補上 line_key", len(rows))
 		return nil
 	})
 }
@@ -491,18 +751,35 @@ func clearUploadedOrders(db *gorm.DB) error {
 	return db.Transaction(func(tx *gorm.DB) error {
 		switch tx.Dialector.Name() {
 		case "postgres":
-			if err := tx.Exec("TRUNCATE TABLE uploaded_orders RESTART IDENTITY").Error; err != nil {
+			// Row IDs restart, so the batch change log must go too.
+			if err := tx.Exec("TRUNCATE TABLE uploaded_orders, upload_row_changes RESTART IDENTITY").Error; err != nil {
 				return err
 			}
 		default:
 			if err := tx.Exec("DELETE FROM uploaded_orders").Error; err != nil {
 				return err
 			}
+			if err := tx.Exec("DELETE FROM upload_row_changes").Error; err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
+// clearShippingUploadedOrders deletes the shipping uploads together with
+// their batches' change log, so rolling one of those batches back later
+// cannot store a cleared line again.
+func clearShippingUploadedOrders(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		batches := tx.Model(&UploadBatch{}).Select("id").Where("is_shipping = ?", true)
+		if err := tx.Where("batch_id IN (?)", batches).Delete(&UploadRowChange{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("is_shipping = ?", true).Delete(&UploadedOrder{}).Error
+	})
+}
+
 func buildUploadedOrderSummaries(rows []UploadedOrder) []UploadedOrderSummary {
 	grouped := make(map[string]*UploadedOrderSummary)
 	for _, row := range rows {
@@ -572,29 +849,58 @@ func getCVSStoreName(order *WooOrder) string {
 
 type ecpayShippingInfo struct {
 	LogisticsID      string
+	LogisticsType    string // CVS or HOME
 	LogisticsSubType string
 	PaymentNo        string
 	ValidationNo     string
+	BookingNote      string
 }
 
-func getEcpayShippingInfo(order *WooOrder) *ecpayShippingInfo {
-	var (
-		shippingMap      map[string]interface{}
-		activeTrackingNo string // from top-level 運送編號 meta
-	)
+// trackingNo is what we store in the 運送編號 meta: PaymentNo+ValidationNo
+// for CVS, the BookingNote for HOME.
+func (i *ecpayShippingInfo) trackingNo() string {
+	if i.LogisticsType == "HOME" {
+		return i.BookingNote
+	}
+	return i.PaymentNo + i.ValidationNo
+}
+
+// ecpayShippingMap returns a copy of the order's _ecpay_shipping_info meta,
+// keyed by AllPayLogisticsID. The result is never nil.
+func ecpayShippingMap(order *WooOrder) map[string]interface{} {
+	merged := map[string]interface{}{}
 	for _, meta := range order.MetaData {
-		switch meta.Key {
-		case "_ecpay_shipping_info":
+		if meta.Key == "_ecpay_shipping_info" {
 			if m, ok := meta.Value.(map[string]interface{}); ok {
-				shippingMap = m
-			}
-		case "運送編號":
-			if s, ok := meta.Value.(string); ok {
-				activeTrackingNo = s
+				for k, v := range m {
+					merged[k] = v
+				}
 			}
 		}
 	}
-	if shippingMap == nil || len(shippingMap) == 0 {
+	return merged
+}
+
+// ecpayEntryVoided reports whether a _ecpay_shipping_info entry has been
+// cancelled at ECPay by us.
+func ecpayEntryVoided(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	voided, _ := m["voided"].(bool)
+	return voided
+}
+
+func getEcpayShippingInfo(order *WooOrder) *ecpayShippingInfo {
+	shippingMap := ecpayShippingMap(order)
+	activeTrackingNo := findMetaString(order, "運送編號")
+	for k, v := range shippingMap {
+		if ecpayEntryVoided(v) {
+			delete(shippingMap, k)
+		}
+	}
+	if len(shippingMap) == 0 {
 		return nil
 	}
 
@@ -610,6 +916,15 @@ func getEcpayShippingInfo(order *WooOrder) *ecpayShippingInfo {
 			if vn, ok := innerMap["ValidationNo"].(string); ok {
 				info.ValidationNo = vn
 			}
+			if bn, ok := innerMap["BookingNote"].(string); ok {
+				info.BookingNote = bn
+			}
+			if lt, ok := innerMap["LogisticsType"].(string); ok {
+				info.LogisticsType = lt
+			}
+		}
+		if info.LogisticsType == "" {
+			info.LogisticsType = ecpayLogisticsType(info.LogisticsSubType)
 		}
 		return info
 	}
@@ -618,7 +933,7 @@ func getEcpayShippingInfo(order *WooOrder) *ecpayShippingInfo {
 	if activeTrackingNo != "" {
 		for k, v := range shippingMap {
 			info := buildInfo(k, v)
-			if info.PaymentNo+info.ValidationNo == activeTrackingNo {
+			if info.trackingNo() == activeTrackingNo {
 				return info
 			}
 		}
@@ -646,21 +961,6 @@ func getEcpayShippingInfo(order *WooOrder) *ecpayShippingInfo {
 	return nil
 }
 
-func ecpayPrintURL(logisticsSubType string) string {
-	switch logisticsSubType {
-	case "UNIMARTC2C":
-		return "https://logistics.ecpay.com.tw/Express/PrintUniMartC2COrderInfo"
-	case "FAMIC2C":
-		return "https://logistics.ecpay.com.tw/Express/PrintFAMIC2COrderInfo"
-	case "HILIFEC2C":
-		return "https://logistics.ecpay.com.tw/Express/PrintHILIFEC2COrderInfo"
-	case "OKMARTC2C":
-		return "https://logistics.ecpay.com.tw/Express/PrintOKMARTC2COrderInfo"
-	default:
-		return "https://logistics.ecpay.com.tw/helper/printTradeDocument"
-	}
-}
-
 func generateCheckMacValue(params map[string]string, hashKey, hashIV string) string {
 	// 1. Sort keys
 	keys := make([]string, 0, len(params))
@@ -718,6 +1018,7 @@ type ReissueResult struct {
 	NewPaymentNo string `json:"new_payment_no,omitempty"`
 	LogisticsID  string `json:"logistics_id,omitempty"`
 	SubType      string `json:"sub_type,omitempty"`
+	Collection   int    `json:"collection_amount,omitempty"`
 	Error        string `json:"error,omitempty"`
 }
 
@@ -732,6 +1033,10 @@ func subTypeFromShippingMethod(methodID string) string {
 		return "HILIFEC2C"
 	case "ry_ecpay_shipping_cvs_ok":
 		return "OKMARTC2C"
+	case "ry_ecpay_shipping_home_tcat":
+		return "TCAT"
+	case "ry_ecpay_shipping_home_post":
+		return "POST"
 	}
 	return ""
 }
@@ -748,6 +1053,40 @@ func findMetaString(order *WooOrder, key string) string {
 	return ""
 }
 
+// isCashOnDelivery reports whether the customer pays on pickup (超商取貨付款),
+// so the shipment must collect the order total.
+func isCashOnDelivery(order *WooOrder) bool {
+	if order.PaymentMethod == "cod" || strings.Contains(order.PaymentMethod, "_cod") {
+		return true
+	}
+	return strings.Contains(order.PaymentMethodTitle, "取貨付款") || strings.Contains(order.PaymentMethodTitle, "貨到付款")
+}
+
+// entryCollectionAmount returns the amount a _ecpay_shipping_info entry
+// collects on pickup (0 when IsCollection is N). ok is false when the entry
+// doesn't say.
+func entryCollectionAmount(entry map[string]interface{}) (amount int, ok bool) {
+	isCollection, _ := entry["IsCollection"].(string)
+	switch isCollection {
+	case "N":
+		return 0, true
+	case "Y":
+	default:
+		return 0, false
+	}
+	for _, key := range []string{"CollectionAmount", "amount"} {
+		switch v := entry[key].(type) {
+		case float64:
+			return int(math.Round(v)), true
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return int(math.Round(f)), true
+			}
+		}
+	}
+	return 0, false
+}
+
 // sanitizeReceiverName matches the RY plugin behaviour: pure ASCII letters → 10 chars,
 // otherwise strip ASCII letters then truncate to 5 Chinese characters.
 func sanitizeReceiverName(name string) string {
@@ -793,105 +1132,71 @@ func truncateRunes(s string, n int) string {
 	return string(runes)
 }
 
-// --- Reissue in-flight dedup (server-side idempotency) ---
-
-var (
-	reissueInFlight   = make(map[int]time.Time)
-	reissueInFlightMu sync.Mutex
-)
-
-// claimReissueSlot returns false if the same orderID was claimed within the
-// last 30 seconds, otherwise it claims the slot and returns true. It also
-// opportunistically evicts entries older than 5 minutes.
-func claimReissueSlot(orderID int) bool {
-	reissueInFlightMu.Lock()
-	defer reissueInFlightMu.Unlock()
-	now := time.Now()
-	if t, ok := reissueInFlight[orderID]; ok && now.Sub(t) < 30*time.Second {
-		return false
-	}
-	reissueInFlight[orderID] = now
-	for id, ts := range reissueInFlight {
-		if now.Sub(ts) > 5*time.Minute {
-			delete(reissueInFlight, id)
-		}
-	}
-	return true
-}
-
-// putWooOrderRaw sends a PUT to the WooCommerce order endpoint with the given
-// JSON body. Shared by putWooOrderField and putWooOrderMeta.
-func putWooOrderRaw(orderID int, body []byte) error {
-	putURL := fmt.Sprintf("https://flowers.fenny-studio.com/wp-json/wc/v3/orders/%d", orderID)
-	req, err := http.NewRequest("PUT", putURL, strings.NewReader(string(body)))
-	if err != nil {
-		return fmt.Errorf("build PUT request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(os.Getenv("WOO_API_KEY"), os.Getenv("WOO_API_SECRET"))
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("PUT WooCommerce: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("WooCommerce PUT %d: %s", resp.StatusCode, string(respBody))
-	}
-	return nil
-}
-
-// putWooOrderField PUTs a single top-level order field (e.g. customer_note).
-func putWooOrderField(orderID int, field string, value interface{}) error {
-	body := map[string]interface{}{field: value}
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshal PUT body: %w", err)
-	}
-	return putWooOrderRaw(orderID, jsonBody)
+// regenerateTracking calls ECPay Create API to reissue a shipping number for an order
+// and writes the result back to the WooCommerce order's meta_data. Never panics and
+// never returns an error — failures are reported via ReissueResult.Error.
+func regenerateTracking(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderID int, home EcpayHomeOptions) ReissueResult {
+	return issueEcpayShipment(ctx, db, woo, ecpay, orderID, true, home)
 }
 
-// putWooOrderMeta PUTs a meta_data slice to a WC order.
-func putWooOrderMeta(orderID int, metaData []map[string]interface{}) error {
-	body := map[string]interface{}{"meta_data": metaData}
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshal PUT body: %w", err)
-	}
-	return putWooOrderRaw(orderID, jsonBody)
+// createShipment creates the first ECPay logistics order for an order that
+// has none yet. Orders with an active _ecpay_shipping_info entry are refused.
+func createShipment(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderID int, home EcpayHomeOptions) ReissueResult {
+	return issueEcpayShipment(ctx, db, woo, ecpay, orderID, false, home)
 }
 
-// regenerateTracking calls ECPay Create API to reissue a shipping number for an order
-// and writes the result back to the WooCommerce order's meta_data. Never panics and
-// never returns an error — failures are reported via ReissueResult.Error.
-func regenerateTracking(orderID int) ReissueResult {
+// issueEcpayShipment is the shared body of regenerateTracking and
+// createShipment. The logistics type (CVS C2C or HOME) follows the order's
+// current shipping method; home only applies to HOME shipments. Every call
+// is recorded as a ReissueAttempt, which also provides the idempotency.
+//
+// ctx only bounds the read-only steps. Once we are about to call ECPay the work
+// is detached from ctx, so an abandoned browser request can't leave a paid
+// shipment that was never written back to WooCommerce.
+func issueEcpayShipment(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderID int, reissue bool, home EcpayHomeOptions) ReissueResult {
 	result := ReissueResult{OrderID: orderID}
+	action := "建立物流單"
+	if reissue {
+		action = "重新取號"
+	}
 
 	// 1. Env sanity.
-	merchantID := os.Getenv("ECPAY_MERCHANT_ID")
-	hashKey := os.Getenv("ECPAY_HASH_KEY")
-	hashIV := os.Getenv("ECPAY_HASH_IV")
-	senderName := os.Getenv("ECPAY_SENDER_NAME")
-	senderPhone := os.Getenv("ECPAY_SENDER_PHONE")
-	senderCell := os.Getenv("ECPAY_SENDER_CELLPHONE")
-	if merchantID == "" || hashKey == "" || hashIV == "" {
+	if !ecpay.configured() {
 		result.Error = "ECPay credentials not configured"
 		return result
 	}
-	if senderName == "" || senderPhone == "" || senderCell == "" {
+	if ecpay.SenderName == "" || ecpay.SenderPhone == "" || ecpay.SenderCellPhone == "" {
 		result.Error = "ECPay sender info not configured (ECPAY_SENDER_NAME/PHONE/CELLPHONE)"
 		return result
 	}
 
-	// 2. Server-side idempotency dedup (catches accidental double-POSTs).
-	if !claimReissueSlot(orderID) {
-		result.Error = "同一訂單 30 秒內已請求過重新取號，請稍候再試"
+	// 2. Server-side idempotency dedup (catches accidental double-POSTs),
+	//    backed by the reissue_attempts table so it holds across restarts
+	//    and replicas.
+	attempt, err := claimReissueAttempt(db, orderID, reissue)
+	if err != nil {
+		result.Error = err.Error()
 		return result
 	}
+	// The attempt's final status follows how far we got.
+	ecpayCalled, ecpayOK := false, false
+	defer func() {
+		switch {
+		case result.Success:
+			attempt.Status = ReissueAttemptCompleted
+		case ecpayOK:
+			attempt.Status = ReissueAttemptWCFailed
+		case ecpayCalled:
+			attempt.Status = ReissueAttemptEcpayFailed
+		default:
+			attempt.Status = ReissueAttemptRejected
+		}
+		attempt.Error = result.Error
+		saveReissueAttempt(db, attempt)
+	}()
 
 	// 3. Fetch the current WC order.
-	order, err := fetchSingleOrder(orderID)
+	order, err := woo.fetchSingleOrder(ctx, orderID)
 	if err != nil {
 		result.Error = "fetch order: " + err.Error()
 		return result
@@ -905,32 +1210,58 @@ func regenerateTracking(orderID int) ReissueResult {
 		"failed":    true,
 	}
 	if blockedStatuses[order.Status] {
-		result.Error = fmt.Sprintf("訂單狀態為 %s，不允許重新取號", order.Status)
+		result.Error = fmt.Sprintf("訂單狀態為 %s，不允許%s", order.Status, action)
 		return result
 	}
+	if !reissue {
+		if active := getEcpayShippingInfo(&order); active != nil {
+			result.Error = fmt.Sprintf("訂單已有物流單 %s，請改用重新取號", active.LogisticsID)
+			return result
+		}
+	}
 
-	// 5. Shipping method gate — must be ECPay CVS, using the CURRENT
+	// 5. Shipping method gate — must be ECPay CVS or HOME, using the CURRENT
 	//    shipping_lines (authoritative), not stale _ecpay_shipping_info meta.
 	if len(order.ShippingLines) == 0 {
-		result.Error = "訂單沒有運送項目，無法重新取號"
+		result.Error = "訂單沒有運送項目，無法" + action
 		return result
 	}
 	methodID := order.ShippingLines[0].MethodID
-	if !strings.HasPrefix(methodID, "ry_ecpay_shipping_cvs_") {
-		result.Error = fmt.Sprintf("此訂單的運送方式不是綠界超商取貨（目前：%s），無法重新取號", methodID)
+	if !strings.HasPrefix(methodID, "ry_ecpay_shipping_cvs_") && !strings.HasPrefix(methodID, "ry_ecpay_shipping_home_") {
+		result.Error = fmt.Sprintf("此訂單的運送方式不是綠界超商取貨或宅配（目前：%s），無法%s", methodID, action)
 		return result
 	}
 	subType := subTypeFromShippingMethod(methodID)
 	if subType == "" {
-		result.Error = fmt.Sprintf("不支援的綠界 C2C 子類型：%s", methodID)
+		result.Error = fmt.Sprintf("不支援的綠界物流子類型：%s", methodID)
 		return result
 	}
+	logisticsType := ecpayLogisticsType(subType)
 
-	// 6. Store ID check.
-	storeID := findMetaString(&order, "_shipping_cvs_store_ID")
-	if storeID == "" {
-		result.Error = "missing _shipping_cvs_store_ID meta"
-		return result
+	// 6. Store ID (CVS) or address (HOME) check.
+	var storeID, receiverZip, receiverAddress string
+	if logisticsType == "HOME" {
+		if ecpay.SenderZipCode == "" || ecpay.SenderAddress == "" {
+			result.Error = "ECPay sender address not configured (ECPAY_SENDER_ZIPCODE/ADDRESS)"
+			return result
+		}
+		home = home.withDefaults(ecpay.HomeDefaults)
+		if err := home.validate(subType); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		receiverZip = strings.TrimSpace(order.Shipping.Postcode)
+		receiverAddress = strings.TrimSpace(order.Shipping.State + order.Shipping.City + order.Shipping.Address1 + order.Shipping.Address2)
+		if receiverZip == "" || receiverAddress == "" {
+			result.Error = "empty receiver zip code or address"
+			return result
+		}
+	} else {
+		storeID = findMetaString(&order, "_shipping_cvs_store_ID")
+		if storeID == "" {
+			result.Error = "missing _shipping_cvs_store_ID meta"
+			return result
+		}
 	}
 
 	// 7. GoodsAmount / GoodsName / Receiver sanitization.
@@ -961,18 +1292,45 @@ func regenerateTracking(orderID int) ReissueResult {
 		return result
 	}
 
+	// 7b. Cash on delivery. A reissue must collect exactly what the shipment
+	// it replaces collects, or the shop silently gains/loses money.
+	cod := isCashOnDelivery(&order)
+	collectionAmount := 0
+	if cod {
+		if logisticsType == "HOME" {
+			result.Error = "綠界宅配不支援貨到付款，請改用超商取貨付款"
+			return result
+		}
+		collectionAmount = goodsAmount
+	}
+	if reissue {
+		if active := getEcpayShippingInfo(&order); active != nil {
+			entry, _ := ecpayShippingMap(&order)[active.LogisticsID].(map[string]interface{})
+			original, known := entryCollectionAmount(entry)
+			switch {
+			case !known && cod:
+				result.Error = fmt.Sprintf("無法確認原物流單 %s 的代收金額，取貨付款訂單不允許重新取號", active.LogisticsID)
+				return result
+			case known && original != collectionAmount:
+				result.Error = fmt.Sprintf("代收金額不一致（原物流單 %d 元，本次 %d 元），不允許重新取號", original, collectionAmount)
+				return result
+			}
+		}
+	}
+	isCollection := "N"
+	if cod {
+		isCollection = "Y"
+	}
+
 	// 8. WC write permission pre-check — no-op PUT with current customer_note.
 	// If this fails (e.g. read-only key), we never call ECPay.
-	if err := putWooOrderField(orderID, "customer_note", order.CustomerNote); err != nil {
+	if err := woo.putOrderField(ctx, orderID, "customer_note", order.CustomerNote); err != nil {
 		result.Error = "WC write permission check failed: " + err.Error()
 		return result
 	}
 
 	// 9. Build ECPay params.
-	tz, _ := time.LoadLocation("Asia/Taipei")
-	if tz == nil {
-		tz = time.FixedZone("CST", 8*3600)
-	}
+	tz := taipeiLocation()
 	now := time.Now()
 	// Match RY-Tools plugin's pre_generate_trade_no format so its callback handler
 	// can parse the order ID via strrpos('TS') and correctly route status updates.
@@ -984,57 +1342,59 @@ func regenerateTracking(orderID int) ReissueResult {
 	merchantTradeDate := now.In(tz).Format("2006/01/02 15:04:05")
 
 	params := map[string]string{
-		"MerchantID":        merchantID,
+		"MerchantID":        ecpay.MerchantID,
 		"MerchantTradeNo":   merchantTradeNo,
 		"MerchantTradeDate": merchantTradeDate,
-		"LogisticsType":     "CVS",
+		"LogisticsType":     logisticsType,
 		"LogisticsSubType":  subType,
 		"GoodsAmount":       strconv.Itoa(goodsAmount),
 		"GoodsName":         goodsName,
-		"IsCollection":      "N",
-		"CollectionAmount":  "0",
-		"SenderName":        senderName,
-		"SenderPhone":       senderPhone,
-		"SenderCellPhone":   senderCell,
+		"IsCollection":      isCollection,
+		"CollectionAmount":  strconv.Itoa(collectionAmount),
+		"SenderName":        ecpay.SenderName,
+		"SenderPhone":       ecpay.SenderPhone,
+		"SenderCellPhone":   ecpay.SenderCellPhone,
 		"ReceiverName":      receiverName,
 		"ReceiverCellPhone": receiverCell,
-		"ReceiverStoreID":   storeID,
-		"ServerReplyURL":    "https://flowers.fenny-studio.com/wc-api/ry_ecpay_shipping_callback/",
-	}
-	params["CheckMacValue"] = generateCheckMacValue(params, hashKey, hashIV)
-
-	form := url.Values{}
-	for k, v := range params {
-		form.Set(k, v)
+		"ServerReplyURL":    ecpayServerReplyURL(woo),
+	}
+	if logisticsType == "HOME" {
+		params["SenderZipCode"] = ecpay.SenderZipCode
+		params["SenderAddress"] = ecpay.SenderAddress
+		params["ReceiverZipCode"] = receiverZip
+		params["ReceiverAddress"] = receiverAddress
+		params["Temperature"] = home.Temperature
+		params["Specification"] = home.Specification
+		params["ScheduledPickupTime"] = home.ScheduledPickupTime
+		params["ScheduledDeliveryTime"] = home.ScheduledDeliveryTime
+		if subType == "POST" {
+			params["GoodsWeight"] = home.GoodsWeight
+		}
+	} else {
+		params["ReceiverStoreID"] = storeID
 	}
 
 	// 10. Log before POST.
-	log.Printf("[reissue] order=%d MerchantTradeNo=%s subType=%s storeID=%s goodsAmount=%d",
-		orderID, merchantTradeNo, subType, storeID, goodsAmount)
-
-	// 11. POST to ECPay.
-	httpClient := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest("POST", "https://logistics.ecpay.com.tw/Express/Create", strings.NewReader(form.Encode()))
-	if err != nil {
-		result.Error = "build request: " + err.Error()
-		return result
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := httpClient.Do(req)
+	log.Printf("[reissue] order=%d reissue=%v MerchantTradeNo=%s subType=%s storeID=%s zip=%s goodsAmount=%d collection=%d",
+		orderID, reissue, merchantTradeNo, subType, storeID, receiverZip, goodsAmount, collectionAmount)
+
+	attempt.MerchantTradeNo = merchantTradeNo
+	attempt.RequestParams = marshalAuditParams(params)
+	saveReissueAttempt(db, attempt)
+
+	// 11. POST to ECPay. From here on nothing is cancelled with the caller.
+	writeCtx := context.WithoutCancel(ctx)
+	ecpayCalled = true
+	bodyStr, err := ecpay.post(writeCtx, ecpay.url("/Express/Create"), params)
+	attempt.EcpayResponse = bodyStr
 	if err != nil {
+		log.Printf("[reissue] order=%d ECPay request failed: %v", orderID, err)
 		result.Error = "ECPay request: " + err.Error()
 		return result
 	}
-	defer resp.Body.Close()
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		result.Error = "read ECPay response: " + err.Error()
-		return result
-	}
-	bodyStr := string(bodyBytes)
 
 	// 12. Log after POST (always — success or failure).
-	log.Printf("[reissue] order=%d ECPay HTTP=%d body=%q", orderID, resp.StatusCode, bodyStr)
+	log.Printf("[reissue] order=%d ECPay body=%q", orderID, bodyStr)
 
 	// 13. Parse response.
 	parts := strings.SplitN(bodyStr, "|", 2)
@@ -1066,14 +1426,14 @@ func regenerateTracking(orderID int) ReissueResult {
 	}
 
 	// 14. Log after parse with new IDs — critical for recovery if WC PUT fails.
-	log.Printf("[reissue] order=%d ECPay OK LogisticsID=%s PaymentNo=%s ValidationNo=%s",
-		orderID, logisticsID, paymentNo, validationNo)
+	log.Printf("[reissue] order=%d ECPay OK LogisticsID=%s PaymentNo=%s ValidationNo=%s BookingNote=%s",
+		orderID, logisticsID, paymentNo, validationNo, bookingNote)
 
 	// 15. Merge new entry into _ecpay_shipping_info.
 	nowStr := now.In(tz).Format("2006-01-02T15:04:05-07:00")
 	newEntry := map[string]interface{}{
 		"ID":               logisticsID,
-		"LogisticsType":    "CVS",
+		"LogisticsType":    logisticsType,
 		"LogisticsSubType": subType,
 		"PaymentNo":        paymentNo,
 		"ValidationNo":     validationNo,
@@ -1084,29 +1444,26 @@ func regenerateTracking(orderID int) ReissueResult {
 		"create":           nowStr,
 		"edit":             nowStr,
 		"amount":           goodsAmount,
-		"IsCollection":     "N",
+		"IsCollection":     isCollection,
+		"CollectionAmount": collectionAmount,
 		"temp":             "1",
 	}
 
-	mergedMap := map[string]interface{}{}
-	for _, meta := range order.MetaData {
-		if meta.Key == "_ecpay_shipping_info" {
-			if m, ok := meta.Value.(map[string]interface{}); ok {
-				for k, v := range m {
-					mergedMap[k] = v
-				}
-			}
-		}
-	}
-	mergedMap[logisticsID] = newEntry
+	newInfo := ecpayShippingInfo{LogisticsType: logisticsType, PaymentNo: paymentNo, ValidationNo: validationNo, BookingNote: bookingNote}
+	combinedNo := newInfo.trackingNo()
 
-	combinedNo := paymentNo + validationNo
+	// Persist what the write-back needs before attempting it, so a failed
+	// PUT can be retried from the attempt alone.
+	ecpayOK = true
+	entryJSON, _ := json.Marshal(newEntry)
+	attempt.Status = ReissueAttemptEcpayOK
+	attempt.LogisticsID = logisticsID
+	attempt.TrackingNo = combinedNo
+	attempt.ShippingEntry = string(entryJSON)
+	saveReissueAttempt(db, attempt)
 
 	// 16. PUT meta back to WC.
-	if err := putWooOrderMeta(orderID, []map[string]interface{}{
-		{"key": "_ecpay_shipping_info", "value": mergedMap},
-		{"key": "運送編號", "value": combinedNo},
-	}); err != nil {
+	if err := writeBackShipment(writeCtx, woo, &order, logisticsID, newEntry, combinedNo); err != nil {
 		result.Error = err.Error()
 		return result
 	}
@@ -1116,12 +1473,13 @@ func regenerateTracking(orderID int) ReissueResult {
 	result.NewPaymentNo = combinedNo
 	result.LogisticsID = logisticsID
 	result.SubType = subType
+	result.Collection = collectionAmount
 	return result
 }
 
 // followEcpayFormRedirect parses auto-submit form from ECPay HTML and POSTs to target URL.
 // Uses the provided http.Client to maintain cookies across redirects.
-func followEcpayFormRedirect(client *http.Client, htmlBody string) (string, error) {
+func followEcpayFormRedirect(ctx context.Context, client *http.Client, htmlBody string) (string, error) {
 	actionRe := regexp.MustCompile(`action="([^"]+)"`)
 	actionMatch := actionRe.FindStringSubmatch(htmlBody)
 	if actionMatch == nil {
@@ -1137,9 +1495,20 @@ func followEcpayFormRedirect(client *http.Client, htmlBody string) (string, erro
 		formData.Set(input[1], input[2])
 	}
 
-	resp, err := client.PostForm(targetURL, formData)
+	return postFormContext(ctx, client, targetURL, formData)
+}
+
+// postFormContext POSTs form to target with ctx and returns the response
+// body.
+func postFormContext(ctx context.Context, client *http.Client, target string, form url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("POST to %s failed: %w", targetURL, err)
+		return "", fmt.Errorf("POST to %s failed: %w", target, err)
 	}
 	defer resp.Body.Close()
 
@@ -1147,14 +1516,16 @@ func followEcpayFormRedirect(client *http.Client, htmlBody string) (string, erro
 	if err != nil {
 		return "", fmt.Errorf("read response failed: %w", err)
 	}
-
 	return string(body), nil
 }
 
-// newCookieClient creates an http.Client with a cookie jar for maintaining session cookies
-func newCookieClient() *http.Client {
+// newCookieClient copies base (its timeout and transport) with a cookie
+// jar for maintaining session cookies.
+func newCookieClient(base *http.Client) *http.Client {
 	jar, _ := cookiejar.New(nil)
-	return &http.Client{Jar: jar}
+	client := *base
+	client.Jar = jar
+	return &client
 }
 
 // patchUnimartHtml modifies 7-11 HTML for thermal label printing (100mm x 150mm)
@@ -1328,13 +1699,9 @@ func buildCombinedPickingList(db *gorm.DB, wooOrders []WooOrder, sellOrders []Up
 	return list
 }
 
-func recordUploadBatch(db *gorm.DB) error {
-	return db.Create(&UploadBatch{UploadedAt: time.Now()}).Error
-}
-
 func getLastUploadTime(db *gorm.DB) (time.Time, error) {
 	var batch UploadBatch
-	err := db.Order("uploaded_at desc").First(&batch).Error
+	err := db.Where("rolled_back_at IS NULL").Order("uploaded_at desc").First(&batch).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return time.Time{}, nil
 	}
@@ -1344,8 +1711,8 @@ func getLastUploadTime(db *gorm.DB) (time.Time, error) {
 	return batch.UploadedAt, nil
 }
 
-func syncProductNamesFromWooCommerce(db *gorm.DB) error {
-	orders, err := fetchProcessingOrders()
+func syncProductNamesFromWooCommerce(ctx context.Context, db *gorm.DB, woo *WooClient) error {
+	orders, err := woo.fetchProcessingOrders(ctx)
 	if err != nil {
 		return err
 	}
@@ -1578,7 +1945,39 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to database after multiple attempts: %v", err)
 	}
-	db.AutoMigrate(&ChecklistItem{}, &OrderMetadata{}, &UploadedOrder{}, &UploadBatch{}, &ProductNameMapping{})
+	if err := backfillUploadedOrderLineKeys(db); err != nil {
+		log.Printf("Failed to backfill uploaded order line keys: %v", err)
+	}
+	db.AutoMigrate(&ChecklistItem{}, &OrderMetadata{}, &UploadedOrder{}, &UploadBatch{}, &UploadRowChange{}, &ProductNameMapping{},
+		&CachedWooOrder{}, &OrderSyncState{}, &WooWebhookDelivery{}, &LogisticsStatusEvent{},
+		&ShipmentStatus{}, &ReissueAttempt{}, &LabelPrint{}, &EcpayCallbackForward{})
+	if err := migrateLogisticsEventIndex(db); err != nil {
+		log.Printf("Failed to migrate logistics event index: %v", err)
+	}
+
+	// --- WooCommerce / ECPay Clients ---
+	woo := newWooClientFromEnv()
+	ecpay := newEcpayClientFromEnv()
+
+	// Opt-in mirroring of remarks/tags to WooCommerce order notes.
+	noteSyncEnabled := os.Getenv("WOO_NOTE_SYNC") == "true"
+
+	// --- Local Order Cache ---
+	orderCache := newOrderSyncer(db, woo)
+	woo.OnOrderUpdated = orderCache.storeOrder
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile-reissues" {
+		runReconcileReissues(db, woo, os.Args[2:])
+		return
+	}
+	go orderCache.Run(context.Background())
+
+	// --- ECPay Shipment Status Polling ---
+	shipmentPoller := newShipmentPoller(db, ecpay, orderCache)
+	go shipmentPoller.Run(context.Background())
+	callbackForwarder := newCallbackForwarder(db, ecpayPluginCallbackURL(woo))
+	go callbackForwarder.Run(context.Background())
+	reissueJobs := newReissueJobManager()
 
 	// --- Gin Router Setup ---
 	r := gin.Default()
@@ -1713,80 +2112,11 @@ func main() {
 	r.GET("/shipping-product-order-search.html", func(c *gin.Context) {
 		serveHTML(c, "./frontend/shipping-product-order-search.html")
 	})
-	r.POST("/orders/upload", func(c *gin.Context) {
-		file, err := c.FormFile("file")
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "file 欄位缺失"})
-			return
-		}
-
-		if !strings.HasSuffix(strings.ToLower(file.Filename), ".xlsx") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "僅接受 .xlsx 檔案"})
-			return
-		}
-
-		src, err := file.Open()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "無法讀取上傳檔案"})
-			return
-		}
-		defer src.Close()
-
-		xl, err := excelize.OpenReader(src)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("解析檔案失敗：%v", err)})
-			return
-		}
-
-		sheetName := xl.GetSheetName(xl.GetActiveSheetIndex())
-		if sheetName == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "找不到有效的工作表"})
-			return
-		}
-
-		rows, err := xl.GetRows(sheetName)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "讀取工作表資料失敗"})
-			return
-		}
-
-		if len(rows) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "沒有資料"})
-			return
-		}
-
-		headerIndex, dataStartRow, err := detectHeaderRow(rows)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		var orders []UploadedOrder
-		for i := dataStartRow; i < len(rows); i++ {
-			logRow("解析列", i+1, rows[i])
-			if !rowHasData(rows[i]) {
-				continue
-			}
-			order, err := parseUploadedRow(rows[i], headerIndex, i+1)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			orders = append(orders, order)
-		}
-
-		if err := saveUploadedOrders(db, orders); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		if err := recordUploadBatch(db); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		c.JSON(http.StatusOK, gin.H{"rows": len(orders)})
-	})
+	uploadPreviews := newUploadPreviewStore()
+	r.POST("/orders/upload", uploadOrdersHandler(db, uploadPreviews, false))
+	r.POST("/orders/upload/confirm", uploadConfirmHandler(db, uploadPreviews))
+	r.GET("/orders/upload/rejects/:token", uploadRejectsHandler(uploadPreviews))
+	registerUploadBatchRoutes(r, db)
 
 	r.GET("/orders/uploaded", func(c *gin.Context) {
 		var stored []UploadedOrder
@@ -1848,86 +2178,12 @@ func main() {
 	})
 
 	// --- Shipping Sell Orders Routes ---
-	r.POST("/orders/upload-shipping", func(c *gin.Context) {
-		file, err := c.FormFile("file")
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "file 欄位缺失"})
-			return
-		}
+	r.POST("/orders/upload-shipping", uploadOrdersHandler(db, uploadPreviews, true))
 
-		if !strings.HasSuffix(strings.ToLower(file.Filename), ".xlsx") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "僅接受 .xlsx 檔案"})
-			return
-		}
-
-		src, err := file.Open()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "無法讀取上傳檔案"})
-			return
-		}
-		defer src.Close()
-
-		xl, err := excelize.OpenReader(src)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("解析檔案失敗：%v", err)})
-			return
-		}
-
-		sheetName := xl.GetSheetName(xl.GetActiveSheetIndex())
-		if sheetName == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "找不到有效的工作表"})
-			return
-		}
-
-		rows, err := xl.GetRows(sheetName)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "讀取工作表資料失敗"})
-			return
-		}
-
-		if len(rows) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "沒有資料"})
-			return
-		}
-
-		headerIndex, dataStartRow, err := detectHeaderRow(rows)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		var orders []UploadedOrder
-		for i := dataStartRow; i < len(rows); i++ {
-			logRow("解析列", i+1, rows[i])
-			if !rowHasData(rows[i]) {
-				continue
-			}
-			order, err := parseUploadedRow(rows[i], headerIndex, i+1)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			order.IsShipping = true // Mark as shipping order
-			orders = append(orders, order)
-		}
-
-		if err := saveUploadedOrders(db, orders); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		if err := recordUploadBatch(db); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		c.JSON(http.StatusOK, gin.H{"rows": len(orders)})
-	})
-
-	r.GET("/orders/uploaded-shipping/summary", func(c *gin.Context) {
-		var stored []UploadedOrder
-		if err := db.Where("is_shipping = ?", true).Order("ordered_at desc, id desc").Find(&stored).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	r.GET("/orders/uploaded-shipping/summary", func(c *gin.Context) {
+		var stored []UploadedOrder
+		if err := db.Where("is_shipping = ?", true).Order("ordered_at desc, id desc").Find(&stored).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -1939,7 +2195,7 @@ func main() {
 	})
 
 	r.DELETE("/orders/uploaded-shipping", func(c *gin.Context) {
-		if err := db.Where("is_shipping = ?", true).Delete(&UploadedOrder{}).Error; err != nil {
+		if err := clearShippingUploadedOrders(db); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -1955,6 +2211,10 @@ func main() {
 		c.File("./frontend/js/" + c.Param("filepath"))
 	})
 
+	// --- Webhooks ---
+	r.POST("/webhooks/woocommerce", wooWebhookHandler(db, os.Getenv("WOO_WEBHOOK_SECRET")))
+	r.POST("/webhooks/ecpay/logistics", ecpayLogisticsCallbackHandler(db, ecpay, callbackForwarder))
+
 	r.Static("/css", "./frontend/css")
 	r.StaticFile("/nav.html", "./frontend/nav.html")
 
@@ -2046,7 +2306,7 @@ func main() {
 	// ... (file content up to the new routes)
 	// --- New WooCommerce Routes ---
 	api.GET("/orders", func(c *gin.Context) {
-		wooOrders, err := fetchProcessingOrders()
+		wooOrders, err := orderCache.fetchProcessingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2070,6 +2330,11 @@ func main() {
 			metadataMap[m.OrderID] = m
 		}
 
+		labelPrints, err := labelPrintsForOrders(db, wooOrders)
+		if err != nil {
+			log.Printf("Failed to load label prints: %v", err)
+		}
+
 		// Merge data and apply tag filter
 		var filteredWooOrders []WooOrder
 		requestedTags := c.QueryArray("tags") // Get tags as a slice of strings from query parameter
@@ -2088,6 +2353,7 @@ func main() {
 			}
 			order.OrderMetadata = metadata
 			order.CVSStoreName = getCVSStoreName(&order)
+			order.LabelPrint = labelPrints[order.ID]
 
 			// Apply tag filtering (OR logic - match any of the requested tags)
 			tagMatch := true
@@ -2161,6 +2427,38 @@ func main() {
 		c.JSON(http.StatusOK, filteredWooOrders)
 	})
 
+	api.GET("/orders/sync", func(c *gin.Context) {
+		state, err := orderCache.State()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var cached int64
+		db.Model(&CachedWooOrder{}).Count(&cached)
+
+		var lastSyncedAt interface{}
+		if !state.LastSyncedAt.IsZero() {
+			lastSyncedAt = state.LastSyncedAt.Format(time.RFC3339)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"last_synced_at": lastSyncedAt,
+			"syncing":        orderCache.Syncing(),
+			"cached_orders":  cached,
+		})
+	})
+
+	api.POST("/orders/sync", func(c *gin.Context) {
+		full := c.Query("full") == "true"
+		// Let the sync finish even if the browser gives up waiting.
+		result, err := orderCache.SyncNow(context.WithoutCancel(c.Request.Context()), full)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "同步 WooCommerce 訂單失敗: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
 	api.PUT("/orders/:id", func(c *gin.Context) {
 		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
@@ -2179,12 +2477,20 @@ func main() {
 
 		metadataUpdate.OrderID = id
 
-		if err := db.Save(&metadataUpdate).Error; err != nil {
+		if err := saveOrderMetadataFields(db, &metadataUpdate); err != nil {
 			log.Printf("Failed to save metadata for order %d: %v", id, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save metadata: %v", err)})
 			return
 		}
 
+		if noteSyncEnabled {
+			if result, err := syncOrderNotes(c.Request.Context(), db, woo, id, NoteSyncResolveNone); err != nil {
+				log.Printf("Failed to sync notes for order %d: %v", id, err)
+			} else {
+				metadataUpdate = result.Metadata
+			}
+		}
+
 		c.JSON(http.StatusOK, metadataUpdate)
 	})
 
@@ -2195,7 +2501,7 @@ func main() {
 			return
 		}
 
-		wooOrder, err := fetchSingleOrder(id)
+		wooOrder, err := woo.fetchSingleOrder(c.Request.Context(), id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2207,15 +2513,52 @@ func main() {
 			metadata = OrderMetadata{OrderID: wooOrder.ID, Remark: "", Tags: []string{}}
 			db.Create(&metadata)
 		}
+		if timeline, err := shipmentTimeline(db, &wooOrder); err != nil {
+			log.Printf("Failed to load shipment timeline for order %d: %v", id, err)
+		} else {
+			wooOrder.ShipmentTimeline = timeline
+		}
 		wooOrder.OrderMetadata = metadata
 		wooOrder.CVSStoreName = getCVSStoreName(&wooOrder)
 
 		c.JSON(http.StatusOK, wooOrder)
 	})
 
+	api.POST("/orders/:id/notes/sync", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
+		if !noteSyncEnabled {
+			// Order details sync on every open; with syncing off that is
+			// simply nothing to do.
+			c.JSON(http.StatusOK, NoteSyncResult{OrderID: id, Pushed: []string{}, Pulled: []string{}, Disabled: true})
+			return
+		}
+
+		resolve := c.Query("resolve")
+		if resolve != NoteSyncResolveNone && resolve != NoteSyncResolveLocal && resolve != NoteSyncResolveRemote {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "resolve must be local or remote"})
+			return
+		}
+
+		result, err := syncOrderNotes(c.Request.Context(), db, woo, id, resolve)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if result.Conflict != "" {
+			c.JSON(http.StatusConflict, result)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
 	api.POST("/orders/regenerate-tracking", func(c *gin.Context) {
 		var req struct {
-			OrderIDs []int `json:"order_ids"`
+			OrderIDs    []int            `json:"order_ids"`
+			HomeOptions EcpayHomeOptions `json:"home_options"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
@@ -2225,154 +2568,226 @@ func main() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
 			return
 		}
-		results := make([]ReissueResult, 0, len(req.OrderIDs))
-		for _, id := range req.OrderIDs {
-			results = append(results, regenerateTracking(id))
+		job := reissueJobs.Start(req.OrderIDs, func(ctx context.Context, id int) ReissueResult {
+			return regenerateTracking(ctx, db, woo, ecpay, id, req.HomeOptions)
+		})
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "total": job.Total})
+	})
+
+	api.GET("/reissue-jobs/:id", func(c *gin.Context) {
+		job := reissueJobs.Get(c.Param("id"))
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到批次工作"})
+			return
 		}
-		c.JSON(http.StatusOK, gin.H{"results": results})
+		c.JSON(http.StatusOK, job.snapshot())
 	})
 
-	api.GET("/orders/:id/print-label", func(c *gin.Context) {
-		id, err := strconv.Atoi(c.Param("id"))
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+	api.GET("/reissue-jobs/:id/events", reissueJobEventsHandler(reissueJobs))
+
+	api.GET("/reissue-attempts", func(c *gin.Context) {
+		query := db.Order("id desc")
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if raw := c.Query("order_id"); raw != "" {
+			orderID, err := strconv.Atoi(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+				return
+			}
+			query = query.Where("order_id = ?", orderID)
+		}
+		limit := 100
+		if raw := c.Query("limit"); raw != "" {
+			if n, err := strconv.Atoi(raw); err == nil && n > 0 && n <= 1000 {
+				limit = n
+			}
+		}
+
+		var attempts []ReissueAttempt
+		if err := query.Limit(limit).Find(&attempts).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, attempts)
+	})
 
-		merchantID := os.Getenv("ECPAY_MERCHANT_ID")
-		hashKey := os.Getenv("ECPAY_HASH_KEY")
-		hashIV := os.Getenv("ECPAY_HASH_IV")
-		if merchantID == "" || hashKey == "" || hashIV == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "ECPay credentials not configured"})
+	api.POST("/reissue-attempts/reconcile", func(c *gin.Context) {
+		dryRun := c.Query("dry_run") == "true"
+		report, err := reconcileReissues(context.WithoutCancel(c.Request.Context()), db, woo, dryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, report)
+	})
 
-		wooOrder, err := fetchSingleOrder(id)
+	api.POST("/reissue-attempts/:id/retry", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order: " + err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attempt ID"})
 			return
 		}
+		attempt, err := retryReissueWriteBack(c.Request.Context(), db, woo, uint(id))
+		var refused *refusedError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到取號紀錄"})
+			return
+		case errors.As(err, &refused):
+			c.JSON(http.StatusConflict, gin.H{"error": refused.reason, "attempt": attempt})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadGateway, gin.H{"error": "重試寫回失敗: " + err.Error(), "attempt": attempt})
+			return
+		}
+		c.JSON(http.StatusOK, attempt)
+	})
 
-		info := getEcpayShippingInfo(&wooOrder)
-		if info == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "此訂單沒有綠界物流資訊"})
+	// Marks an interrupted attempt as checked in the ECPay back office:
+	// {"note": "..."} records what was found.
+	api.POST("/reissue-attempts/:id/resolve", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attempt ID"})
+			return
+		}
+		var req struct {
+			Note string `json:"note"`
+		}
+		c.ShouldBindJSON(&req)
+		attempt, err := resolveReissueAttempt(db, uint(id), req.Note)
+		var refused *refusedError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到取號紀錄"})
+			return
+		case errors.As(err, &refused):
+			c.JSON(http.StatusConflict, gin.H{"error": refused.reason, "attempt": attempt})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, attempt)
+	})
 
-		params := map[string]string{
-			"MerchantID":        merchantID,
-			"AllPayLogisticsID": info.LogisticsID,
+	api.POST("/orders/create-shipment", func(c *gin.Context) {
+		var req struct {
+			OrderIDs    []int            `json:"order_ids"`
+			HomeOptions EcpayHomeOptions `json:"home_options"`
 		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+			return
+		}
+		if len(req.OrderIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+			return
+		}
+		results := make([]ReissueResult, 0, len(req.OrderIDs))
+		for _, id := range req.OrderIDs {
+			results = append(results, createShipment(c.Request.Context(), db, woo, ecpay, id, req.HomeOptions))
+		}
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	})
 
-		// C2C endpoints require CVSPaymentNo; UniMart C2C also requires CVSValidationNo
-		isC2C := strings.HasSuffix(info.LogisticsSubType, "C2C")
-		if isC2C {
-			params["CVSPaymentNo"] = info.PaymentNo
-			if info.LogisticsSubType == "UNIMARTC2C" {
-				params["CVSValidationNo"] = info.ValidationNo
-			}
+	api.POST("/orders/:id/cancel-shipment", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
+		var req struct {
+			LogisticsID string `json:"logistics_id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.LogisticsID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "logistics_id is required"})
+			return
 		}
 
-		checkMacValue := generateCheckMacValue(params, hashKey, hashIV)
-		printURL := ecpayPrintURL(info.LogisticsSubType)
+		result, err := cancelSupersededShipment(c.Request.Context(), db, woo, ecpay, id, req.LogisticsID)
+		var refused *refusedError
+		switch {
+		case errors.As(err, &refused):
+			c.JSON(http.StatusConflict, gin.H{"error": refused.reason})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadGateway, gin.H{"error": "取消物流單失敗: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
 
-		// Server-side proxy: POST to ECPay and parse response
-		formData := url.Values{}
-		for k, v := range params {
-			formData.Set(k, v)
+	api.POST("/orders/status", func(c *gin.Context) {
+		var req struct {
+			OrderIDs []int  `json:"order_ids"`
+			Status   string `json:"status"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body: " + err.Error()})
+			return
+		}
+		if len(req.OrderIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+			return
+		}
+		if len(req.OrderIDs) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum 100 orders per request"})
+			return
+		}
+		if !isKnownTargetStatus(req.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不支援的目標狀態：" + req.Status})
+			return
 		}
-		formData.Set("CheckMacValue", checkMacValue)
 
-		resp, err := http.PostForm(printURL, formData)
+		results, err := changeOrderStatuses(c.Request.Context(), woo, req.OrderIDs, req.Status)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "無法連線綠界列印服務: " + err.Error()})
+			c.JSON(http.StatusBadGateway, gin.H{"error": "變更訂單狀態失敗: " + err.Error()})
 			return
 		}
-		defer resp.Body.Close()
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	})
 
-		body, err := io.ReadAll(resp.Body)
+	api.GET("/orders/:id/print-label", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "讀取綠界回應失敗: " + err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
 			return
 		}
 
-		// UNIMARTC2C single order: redirect chain is too complex (4 steps + JS),
-		// fall back to browser form-submit approach
-		if info.LogisticsSubType == "UNIMARTC2C" {
-			var fields strings.Builder
-			for k, v := range params {
-				fields.WriteString(fmt.Sprintf("  <input type=\"hidden\" name=\"%s\" value=\"%s\">\n", k, v))
-			}
-			fields.WriteString(fmt.Sprintf("  <input type=\"hidden\" name=\"CheckMacValue\" value=\"%s\">\n", checkMacValue))
-
-			html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<body>
-<form id="ecpay-form" method="POST" action="%s">
-%s</form>
-<script>document.getElementById('ecpay-form').submit();</script>
-</body>
-</html>`, printURL, fields.String())
-
-			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+		if !ecpay.configured() {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ECPay credentials not configured"})
 			return
 		}
 
-		// Extract img src URLs from ECPay response HTML (for non-UNIMART)
-		imgRe := regexp.MustCompile(`<img[^>]+src="([^"]+)"`)
-		matches := imgRe.FindAllStringSubmatch(string(body), -1)
-		if len(matches) == 0 {
-			// Debug: return raw ECPay HTML to inspect structure
-			c.Data(http.StatusOK, "text/html; charset=utf-8", body)
+		if c.Query("format") == "pdf" {
+			pdf, report, err := buildLabelPDF(c.Request.Context(), db, woo, ecpay, []int{id}, false)
+			if err != nil {
+				// err says why there is no PDF; the report item, when the
+				// label could not be fetched, says why.
+				msg := err.Error()
+				if report[0].Error != "" {
+					msg += "：" + report[0].Error
+				}
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg, "web_only": report[0].WebOnly})
+				return
+			}
+			recordLabelPrints(db, report, "pdf", labelPrintedBy(c))
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="label_%d.pdf"`, id))
+			c.Data(http.StatusOK, "application/pdf", pdf)
 			return
 		}
 
-		var labelPages strings.Builder
-		for _, m := range matches {
-			labelPages.WriteString(fmt.Sprintf("<div class=\"label-page\"><img src=\"%s\"></div>\n", m[1]))
+		// Same path as the batch print, for one order.
+		doc, report := buildBatchLabelDocument(c.Request.Context(), db, woo, ecpay, []int{id}, false)
+		if !report[0].OK {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": report[0].Error})
+			return
 		}
-
-		html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-<style>
-@media print {
-    @page {
-        size: 100mm 150mm;
-        margin: 0;
-    }
-    body { margin: 0; padding: 0; }
-    .label-page {
-        page-break-after: always;
-        width: 100mm;
-        height: 150mm;
-        overflow: hidden;
-    }
-    .label-page:last-child { page-break-after: avoid; }
-    .label-page img {
-        width: 175%%;
-        max-width: none;
-    }
-    #printPageButton { display: none; }
-}
-body { margin: 20px; text-align: center; }
-.label-page {
-    margin: 10px auto;
-    border: 1px dashed #ccc;
-    padding: 0;
-    max-width: 100mm;
-    overflow: hidden;
-}
-.label-page img { width: 175%%; max-width: none; }
-</style>
-</head>
-<body>
-<button id="printPageButton" onclick="window.print();">列印</button>
-%s
-</body>
-</html>`, labelPages.String())
-
-		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+		recordLabelPrints(db, report, "html", labelPrintedBy(c))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(doc))
 	})
 
 	api.GET("/orders/batch-print-label", func(c *gin.Context) {
@@ -2393,194 +2808,59 @@ body { margin: 20px; text-align: center; }
 			c.JSON(http.StatusBadRequest, gin.H{"error": "請選擇至少一筆訂單"})
 			return
 		}
-		requestBody := struct{ OrderIDs []int }{OrderIDs: orderIDs}
-
-		merchantID := os.Getenv("ECPAY_MERCHANT_ID")
-		hashKey := os.Getenv("ECPAY_HASH_KEY")
-		hashIV := os.Getenv("ECPAY_HASH_IV")
-		if merchantID == "" || hashKey == "" || hashIV == "" {
+		if !ecpay.configured() {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ECPay credentials not configured"})
 			return
 		}
 
-		// Group orders by LogisticsSubType, collect comma-separated values
-		type printGroup struct {
-			logisticsIDs  []string
-			paymentNos    []string
-			validationNos []string
-			subType       string
-		}
-		groups := make(map[string]*printGroup)
+		// skip_printed=true leaves out labels that were printed before;
+		// otherwise the report flags them as reprints.
+		skipPrinted := c.Query("skip_printed") == "true"
 
-		for _, orderID := range requestBody.OrderIDs {
-			wooOrder, err := fetchSingleOrder(orderID)
+		// format=pdf: one PDF, labels in request order. Orders left out are
+		// listed in X-Skipped-Orders; the 7-11 C2C ones among them, which
+		// must be printed from the web page instead, also in X-Web-Only-Orders.
+		if c.Query("format") == "pdf" {
+			pdf, report, err := buildLabelPDF(c.Request.Context(), db, woo, ecpay, orderIDs, skipPrinted)
 			if err != nil {
-				continue
-			}
-			info := getEcpayShippingInfo(&wooOrder)
-			if info == nil {
-				continue
-			}
-			g, ok := groups[info.LogisticsSubType]
-			if !ok {
-				g = &printGroup{subType: info.LogisticsSubType}
-				groups[info.LogisticsSubType] = g
-			}
-			g.logisticsIDs = append(g.logisticsIDs, info.LogisticsID)
-			g.paymentNos = append(g.paymentNos, info.PaymentNo)
-			g.validationNos = append(g.validationNos, info.ValidationNo)
-		}
-
-		if len(groups) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "所選訂單都沒有綠界物流資訊"})
-			return
-		}
-
-		// Server-side proxy: POST to ECPay for each group and collect label content
-		imgRe := regexp.MustCompile(`<img[^>]+src="([^"]+)"`)
-		var allImageURLs []string
-
-		for _, g := range groups {
-			if g.subType == "UNIMARTC2C" {
-				// UNIMARTC2C: send all IDs together, follow redirect to 7-11
-				params := map[string]string{
-					"MerchantID":        merchantID,
-					"AllPayLogisticsID": strings.Join(g.logisticsIDs, ","),
-					"CVSPaymentNo":      strings.Join(g.paymentNos, ","),
-					"CVSValidationNo":   strings.Join(g.validationNos, ","),
-				}
-				checkMacValue := generateCheckMacValue(params, hashKey, hashIV)
-				printURL := ecpayPrintURL(g.subType)
-
-				formData := url.Values{}
-				for k, v := range params {
-					formData.Set(k, v)
-				}
-				formData.Set("CheckMacValue", checkMacValue)
-
-				client := newCookieClient()
-				resp, err := client.PostForm(printURL, formData)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "無法連線綠界列印服務: " + err.Error()})
-					return
-				}
-				ecpayBody, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "讀取綠界回應失敗: " + err.Error()})
-					return
-				}
-
-				sevenHtml, err := followEcpayFormRedirect(client, string(ecpayBody))
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "無法取得 7-11 列印頁面: " + err.Error()})
-					return
-				}
-
-				c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(patchUnimartHtml(sevenHtml)))
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "report": report})
 				return
 			}
-
-			// Other logistics types: extract <img> one by one
-			for i := 0; i < len(g.logisticsIDs); i++ {
-				end := i + 1
-				if end > len(g.logisticsIDs) {
-					end = len(g.logisticsIDs)
-				}
-
-				params := map[string]string{
-					"MerchantID":        merchantID,
-					"AllPayLogisticsID": strings.Join(g.logisticsIDs[i:end], ","),
-				}
-
-				isC2C := strings.HasSuffix(g.subType, "C2C")
-				if isC2C {
-					params["CVSPaymentNo"] = strings.Join(g.paymentNos[i:end], ",")
-				}
-
-				checkMacValue := generateCheckMacValue(params, hashKey, hashIV)
-				printURL := ecpayPrintURL(g.subType)
-
-				formData := url.Values{}
-				for k, v := range params {
-					formData.Set(k, v)
-				}
-				formData.Set("CheckMacValue", checkMacValue)
-
-				resp, err := http.PostForm(printURL, formData)
-				if err != nil {
-					log.Printf("批次列印: 無法連線綠界列印服務: %v", err)
-					continue
-				}
-				body, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					log.Printf("批次列印: 讀取綠界回應失敗: %v", err)
-					continue
+			var skipped, webOnly []string
+			for _, item := range report {
+				if !item.OK {
+					skipped = append(skipped, strconv.Itoa(item.OrderID))
 				}
-
-				matches := imgRe.FindAllStringSubmatch(string(body), -1)
-				for _, m := range matches {
-					allImageURLs = append(allImageURLs, m[1])
+				if item.WebOnly {
+					webOnly = append(webOnly, strconv.Itoa(item.OrderID))
 				}
 			}
-		}
-
-		if len(allImageURLs) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "無法從綠界回應中解析任何標籤圖片"})
+			if len(skipped) > 0 {
+				c.Header("X-Skipped-Orders", strings.Join(skipped, ","))
+			}
+			if len(webOnly) > 0 {
+				c.Header("X-Web-Only-Orders", strings.Join(webOnly, ","))
+			}
+			recordLabelPrints(db, report, "pdf", labelPrintedBy(c))
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="labels_%d.pdf"`, time.Now().Unix()))
+			c.Data(http.StatusOK, "application/pdf", pdf)
 			return
 		}
 
-		var labelPages strings.Builder
-		for _, imgURL := range allImageURLs {
-			labelPages.WriteString(fmt.Sprintf("<div class=\"label-page\"><img src=\"%s\"></div>\n", imgURL))
+		// format=json: the report alone, without fetching any label from
+		// ECPay. ok means the order has a shipment whose label would print.
+		if c.Query("format") == "json" {
+			report, infos := resolveLabelTargets(c.Request.Context(), db, woo, orderIDs, skipPrinted)
+			for i := range report {
+				report[i].OK = infos[i] != nil
+			}
+			c.JSON(http.StatusOK, gin.H{"report": report})
+			return
 		}
 
-		html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-<style>
-@media print {
-    @page {
-        size: 100mm 150mm;
-        margin: 0;
-    }
-    body { margin: 0; padding: 0; }
-    .label-page {
-        page-break-after: always;
-        width: 100mm;
-        height: 150mm;
-        overflow: hidden;
-    }
-    .label-page:last-child { page-break-after: avoid; }
-    .label-page img {
-        width: 175%%;
-        max-width: none;
-    }
-    .label-html iframe {
-        width: 100%% !important;
-        height: 100%% !important;
-    }
-    #printPageButton { display: none; }
-}
-body { margin: 20px; text-align: center; }
-.label-page {
-    margin: 10px auto;
-    border: 1px dashed #ccc;
-    padding: 0;
-    max-width: 100mm;
-    overflow: hidden;
-}
-.label-page img { width: 175%%; max-width: none; }
-</style>
-</head>
-<body>
-<button id="printPageButton" onclick="window.print();">列印</button>
-%s
-</body>
-</html>`, labelPages.String())
-
-		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+		doc, report := buildBatchLabelDocument(c.Request.Context(), db, woo, ecpay, orderIDs, skipPrinted)
+		recordLabelPrints(db, report, "html", labelPrintedBy(c))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(doc))
 	})
 
 	api.POST("/orders/batch", func(c *gin.Context) {
@@ -2603,7 +2883,7 @@ body { margin: 20px; text-align: center; }
 			return
 		}
 
-		orders, err := fetchMultipleOrders(requestBody.OrderIDs)
+		orders, err := woo.fetchMultipleOrders(c.Request.Context(), requestBody.OrderIDs)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2646,7 +2926,7 @@ body { margin: 20px; text-align: center; }
 		}
 
 		// Fetch all necessary data
-		wooOrders, err := fetchProcessingOrders()
+		wooOrders, err := orderCache.fetchProcessingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch WooCommerce orders: " + err.Error()})
 			return
@@ -2690,7 +2970,7 @@ body { margin: 20px; text-align: center; }
 
 	// --- Shipping Orders Routes (prepare-stock status) ---
 	api.GET("/shipping-orders", func(c *gin.Context) {
-		wooOrders, err := fetchShippingOrders()
+		wooOrders, err := orderCache.fetchShippingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2714,6 +2994,15 @@ body { margin: 20px; text-align: center; }
 			metadataMap[m.OrderID] = m
 		}
 
+		shipmentStatuses, err := shipmentStatusesForOrders(db, wooOrders, shipmentStaleDays())
+		if err != nil {
+			log.Printf("Failed to load shipment statuses: %v", err)
+		}
+		labelPrints, err := labelPrintsForOrders(db, wooOrders)
+		if err != nil {
+			log.Printf("Failed to load label prints: %v", err)
+		}
+
 		// Merge data and apply tag filter
 		var filteredWooOrders []WooOrder
 		requestedTags := c.QueryArray("tags")
@@ -2731,6 +3020,8 @@ body { margin: 20px; text-align: center; }
 			}
 			order.OrderMetadata = metadata
 			order.CVSStoreName = getCVSStoreName(&order)
+			order.ShipmentStatus = shipmentStatuses[order.ID]
+			order.LabelPrint = labelPrints[order.ID]
 
 			// Apply tag filtering (OR logic)
 			tagMatch := true
@@ -2798,6 +3089,57 @@ body { margin: 20px; text-align: center; }
 		c.JSON(http.StatusOK, filteredWooOrders)
 	})
 
+	api.POST("/shipments/poll", func(c *gin.Context) {
+		// Keep polling even if the browser gives up waiting.
+		result, err := shipmentPoller.PollNow(context.WithoutCancel(c.Request.Context()))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "查詢物流狀態失敗: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	api.GET("/shipments/stale", func(c *gin.Context) {
+		days := shipmentStaleDays()
+		if raw := c.Query("days"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days"})
+				return
+			}
+			days = n
+		}
+
+		var orders []WooOrder
+		for _, status := range cachedOrderStatuses {
+			batch, err := orderCache.fetchOrdersByStatus(c.Request.Context(), status)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			orders = append(orders, batch...)
+		}
+		statuses, err := shipmentStatusesForOrders(db, orders, days)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		stale := []*ShipmentStatus{}
+		for _, st := range statuses {
+			if st.Stale {
+				stale = append(stale, st)
+			}
+		}
+		sort.Slice(stale, func(i, j int) bool {
+			if stale[i].AwaitingDays != stale[j].AwaitingDays {
+				return stale[i].AwaitingDays > stale[j].AwaitingDays
+			}
+			return stale[i].OrderID < stale[j].OrderID
+		})
+		c.JSON(http.StatusOK, gin.H{"days": days, "shipments": stale})
+	})
+
 	api.PUT("/shipping-orders/:id", func(c *gin.Context) {
 		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
@@ -2814,12 +3156,20 @@ body { margin: 20px; text-align: center; }
 
 		metadataUpdate.OrderID = id
 
-		if err := db.Save(&metadataUpdate).Error; err != nil {
+		if err := saveOrderMetadataFields(db, &metadataUpdate); err != nil {
 			log.Printf("Failed to save metadata for order %d: %v", id, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save metadata: %v", err)})
 			return
 		}
 
+		if noteSyncEnabled {
+			if result, err := syncOrderNotes(c.Request.Context(), db, woo, id, NoteSyncResolveNone); err != nil {
+				log.Printf("Failed to sync notes for order %d: %v", id, err)
+			} else {
+				metadataUpdate = result.Metadata
+			}
+		}
+
 		c.JSON(http.StatusOK, metadataUpdate)
 	})
 
@@ -2831,7 +3181,7 @@ body { margin: 20px; text-align: center; }
 		}
 
 		// Fetch shipping orders
-		wooOrders, err := fetchShippingOrders()
+		wooOrders, err := orderCache.fetchShippingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch WooCommerce orders: " + err.Error()})
 			return
@@ -2873,7 +3223,7 @@ body { margin: 20px; text-align: center; }
 	})
 
 	api.GET("/shipping-picking-list", func(c *gin.Context) {
-		orders, err := fetchShippingOrders()
+		orders, err := orderCache.fetchShippingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2889,7 +3239,7 @@ body { margin: 20px; text-align: center; }
 
 	api.GET("/shipping-combined-picking-list", func(c *gin.Context) {
 		// Fetch WooCommerce shipping orders
-		wooOrders, err := fetchShippingOrders()
+		wooOrders, err := orderCache.fetchShippingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch WooCommerce orders: %v", err)})
 			return
@@ -2916,7 +3266,7 @@ body { margin: 20px; text-align: center; }
 
 	// --- Processing Orders Routes ---
 	api.GET("/picking-list", func(c *gin.Context) {
-		orders, err := fetchProcessingOrders()
+		orders, err := orderCache.fetchProcessingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2932,7 +3282,7 @@ body { margin: 20px; text-align: center; }
 
 	api.GET("/combined-picking-list", func(c *gin.Context) {
 		// Fetch WooCommerce processing orders
-		wooOrders, err := fetchProcessingOrders()
+		wooOrders, err := orderCache.fetchProcessingOrders(c.Request.Context())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch WooCommerce orders: %v", err)})
 			return
@@ -2998,7 +3348,7 @@ body { margin: 20px; text-align: center; }
 	})
 
 	api.POST("/product-mappings/sync", func(c *gin.Context) {
-		if err := syncProductNamesFromWooCommerce(db); err != nil {
+		if err := syncProductNamesFromWooCommerce(c.Request.Context(), db, woo); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync WooCommerce products: " + err.Error()})
 			return
 		}
@@ -3047,142 +3397,3 @@ func generatePickingList(db *gorm.DB, orders []WooOrder) []PickingListItem {
 
 	return pickingList
 }
-
-func fetchProcessingOrders() ([]WooOrder, error) {
-	return fetchOrdersByStatus("processing")
-}
-
-func fetchShippingOrders() ([]WooOrder, error) {
-	return fetchOrdersByStatus("prepare-stock")
-}
-
-func fetchOrdersByStatus(status string) ([]WooOrder, error) {
-	var allOrders []WooOrder
-	page := 1
-	perPage := 100
-
-	for {
-		url := fmt.Sprintf("https://flowers.fenny-studio.com/wp-json/wc/v3/orders?status=%s&per_page=%d&page=%d", status, perPage, page)
-
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, fmt.Errorf("error creating request: %w", err)
-		}
-
-		apiKey := os.Getenv("WOO_API_KEY")
-		apiSecret := os.Getenv("WOO_API_SECRET")
-		req.SetBasicAuth(apiKey, apiSecret)
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error performing request: %w", err)
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			return nil, fmt.Errorf("received non-200 status code: %d - %s", resp.StatusCode, string(bodyBytes))
-		}
-
-		var orders []WooOrder
-		if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
-			resp.Body.Close()
-			return nil, fmt.Errorf("error decoding response: %w", err)
-		}
-		resp.Body.Close()
-
-		// 將這一頁的訂單加入總列表
-		allOrders = append(allOrders, orders...)
-
-		log.Printf("已取得第 %d 頁，共 %d 筆訂單（本頁 %d 筆）[狀態: %s]", page, len(allOrders), len(orders), status)
-
-		// 如果這頁的訂單數少於 per_page，表示已經是最後一頁
-		if len(orders) < perPage {
-			break
-		}
-
-		page++
-	}
-
-	log.Printf("總共取得 %d 筆 processing 訂單", len(allOrders))
-	return allOrders, nil
-}
-
-func fetchSingleOrder(orderID int) (WooOrder, error) {
-	url := fmt.Sprintf("https://flowers.fenny-studio.com/wp-json/wc/v3/orders/%d", orderID)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return WooOrder{}, fmt.Errorf("error creating request: %w", err)
-	}
-
-	apiKey := os.Getenv("WOO_API_KEY")
-	apiSecret := os.Getenv("WOO_API_SECRET")
-	req.SetBasicAuth(apiKey, apiSecret)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return WooOrder{}, fmt.Errorf("error performing request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return WooOrder{}, fmt.Errorf("received non-200 status code: %d - %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	var order WooOrder
-	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
-		return WooOrder{}, fmt.Errorf("error decoding response: %w", err)
-	}
-
-	return order, nil
-}
-
-func fetchMultipleOrders(orderIDs []int) ([]WooOrder, error) {
-	if len(orderIDs) == 0 {
-		return []WooOrder{}, nil
-	}
-
-	// WooCommerce API supports fetching multiple orders using include parameter
-	// Build comma-separated list of order IDs
-	includeParam := ""
-	for i, id := range orderIDs {
-		if i > 0 {
-			includeParam += ","
-		}
-		includeParam += strconv.Itoa(id)
-	}
-
-	url := fmt.Sprintf("https://flowers.fenny-studio.com/wp-json/wc/v3/orders?include=%s&per_page=%d", includeParam, len(orderIDs))
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
-	}
-
-	apiKey := os.Getenv("WOO_API_KEY")
-	apiSecret := os.Getenv("WOO_API_SECRET")
-	req.SetBasicAuth(apiKey, apiSecret)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error performing request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("received non-200 status code: %d - %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	var orders []WooOrder
-	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
-		return nil, fmt.Errorf("error decoding response: %w", err)
-	}
-
-	return orders, nil
-}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CachedWooOrder is the local copy of one WooCommerce order. Data holds the
+// order as JSON; Status and DateModifiedGMT are lifted out for querying.
+type CachedWooOrder struct {
+	ID              int       `gorm:"primaryKey;autoIncrement:false"`
+	Status          string    `gorm:"index"`
+	DateModifiedGMT time.Time `gorm:"index"`
+	Data            string    `gorm:"type:jsonb"`
+	SyncedAt        time.Time
+}
+
+func (CachedWooOrder) TableName() string {
+	return "woo_orders"
+}
+
+// OrderSyncState is a single-row table recording how far the syncer got.
+type OrderSyncState struct {
+	ID              uint      `json:"-" gorm:"primaryKey"`
+	LastSyncedAt    time.Time `json:"last_synced_at"`
+	LastFullSyncAt  time.Time `json:"last_full_sync_at"`
+	LastModifiedGMT time.Time `json:"last_modified_gmt"` // high-water mark of date_modified_gmt
+}
+
+// OrderSyncResult summarises one sync run.
+type OrderSyncResult struct {
+	Full         bool      `json:"full"`
+	Upserted     int       `json:"upserted"`
+	Removed      int       `json:"removed"`
+	LastSyncedAt time.Time `json:"last_synced_at"`
+}
+
+// cachedOrderStatuses are the statuses the dashboard lists. A full sync
+// re-reads them completely to catch orders that left them without a
+// modified_after hit (e.g. trashed orders).
+var cachedOrderStatuses = []string{"processing", "prepare-stock"}
+
+// OrderSyncer keeps the woo_orders table in step with WooCommerce using
+// modified_after polling, and serves list reads from it.
+type OrderSyncer struct {
+	db           *gorm.DB
+	woo          *WooClient
+	interval     time.Duration
+	fullInterval time.Duration
+
+	mu      sync.Mutex // serialises sync runs
+	syncing atomic.Bool
+}
+
+// newOrderSyncer reads ORDER_SYNC_INTERVAL_SECONDS (default 120, 0 disables
+// the background loop) and ORDER_FULL_SYNC_INTERVAL_MINUTES (default 60).
+func newOrderSyncer(db *gorm.DB, woo *WooClient) *OrderSyncer {
+	s := &OrderSyncer{
+		db:           db,
+		woo:          woo,
+		interval:     2 * time.Minute,
+		fullInterval: time.Hour,
+	}
+	if raw := os.Getenv("ORDER_SYNC_INTERVAL_SECONDS"); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs >= 0 {
+			s.interval = time.Duration(secs) * time.Second
+		}
+	}
+	if raw := os.Getenv("ORDER_FULL_SYNC_INTERVAL_MINUTES"); raw != "" {
+		if mins, err := strconv.Atoi(raw); err == nil && mins > 0 {
+			s.fullInterval = time.Duration(mins) * time.Minute
+		}
+	}
+	return s
+}
+
+// Run syncs in the background until ctx is done.
+func (s *OrderSyncer) Run(ctx context.Context) {
+	if s.interval == 0 {
+		log.Printf("[order-sync] 背景同步已停用")
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		state, err := s.State()
+		if err != nil {
+			log.Printf("[order-sync] 讀取同步狀態失敗：%v", err)
+		} else {
+			full := time.Since(state.LastFullSyncAt) >= s.fullInterval
+			if _, err := s.SyncNow(ctx, full); err != nil {
+				log.Printf("[order-sync] 同步失敗：%v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Syncing reports whether a sync run is in progress.
+func (s *OrderSyncer) Syncing() bool {
+	return s.syncing.Load()
+}
+
+// State returns the persisted sync state (zero value before the first run).
+func (s *OrderSyncer) State() (OrderSyncState, error) {
+	var state OrderSyncState
+	err := s.db.First(&state, 1).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return OrderSyncState{ID: 1}, nil
+	}
+	return state, err
+}
+
+// SyncNow runs one sync. An incremental run fetches orders modified since the
+// high-water mark; a full run (or the first run) re-reads every cached status.
+func (s *OrderSyncer) SyncNow(ctx context.Context, full bool) (OrderSyncResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncing.Store(true)
+	defer s.syncing.Store(false)
+
+	state, err := s.State()
+	if err != nil {
+		return OrderSyncResult{}, err
+	}
+	if state.LastModifiedGMT.IsZero() {
+		full = true
+	}
+
+	started := time.Now()
+	result := OrderSyncResult{Full: full}
+	if full {
+		err = s.syncFull(ctx, &state, &result)
+	} else {
+		err = s.syncIncremental(ctx, &state, &result)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	state.ID = 1
+	state.LastSyncedAt = started
+	if full {
+		state.LastFullSyncAt = started
+	}
+	if err := s.db.Save(&state).Error; err != nil {
+		return result, err
+	}
+	result.LastSyncedAt = started
+	log.Printf("[order-sync] 完成（full=%v）：更新 %d 筆，移除 %d 筆", full, result.Upserted, result.Removed)
+	return result, nil
+}
+
+func (s *OrderSyncer) syncIncremental(ctx context.Context, state *OrderSyncState, result *OrderSyncResult) error {
+	// Overlap by a minute so orders saved in the same second as the last
+	// high-water mark are not missed; the upsert makes re-reads harmless.
+	since := state.LastModifiedGMT.Add(-time.Minute)
+
+	query := url.Values{}
+	query.Set("status", "any")
+	query.Set("modified_after", since.UTC().Format("2006-01-02T15:04:05"))
+	query.Set("dates_are_gmt", "true")
+	orders, err := s.woo.fetchOrderPages(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if err := upsertCachedOrders(s.db, orders); err != nil {
+		return err
+	}
+	result.Upserted = len(orders)
+	advanceHighWater(state, orders)
+	return nil
+}
+
+func (s *OrderSyncer) syncFull(ctx context.Context, state *OrderSyncState, result *OrderSyncResult) error {
+	seen := make(map[int]bool)
+	for _, status := range cachedOrderStatuses {
+		orders, err := s.woo.fetchOrdersByStatus(ctx, status)
+		if err != nil {
+			return err
+		}
+		if err := upsertCachedOrders(s.db, orders); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			seen[order.ID] = true
+		}
+		result.Upserted += len(orders)
+		advanceHighWater(state, orders)
+	}
+
+	// Cached orders still listed under a dashboard status that WC no longer
+	// returned have moved on (or been deleted); re-read them individually.
+	var staleIDs []int
+	if err := s.db.Model(&CachedWooOrder{}).Where("status IN ?", cachedOrderStatuses).Pluck("id", &staleIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range staleIDs {
+		if seen[id] {
+			continue
+		}
+		order, err := s.woo.fetchSingleOrder(ctx, id)
+		var statusErr *wooStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			if err := s.db.Delete(&CachedWooOrder{}, id).Error; err != nil {
+				return err
+			}
+			result.Removed++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("refresh order %d: %w", id, err)
+		}
+		if err := upsertCachedOrders(s.db, []WooOrder{order}); err != nil {
+			return err
+		}
+		result.Upserted++
+	}
+	return nil
+}
+
+// advanceHighWater moves state.LastModifiedGMT forward to the newest
+// date_modified_gmt among orders.
+func advanceHighWater(state *OrderSyncState, orders []WooOrder) {
+	for _, order := range orders {
+		if t := parseWooGMT(order.DateModifiedGMT); t.After(state.LastModifiedGMT) {
+			state.LastModifiedGMT = t
+		}
+	}
+}
+
+// parseWooGMT parses WooCommerce *_gmt timestamps, which carry no zone.
+func parseWooGMT(raw string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", raw, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// upsertCachedOrders writes orders into woo_orders. A row is only replaced
+// when the incoming copy is at least as new as the stored one, so a slow
+// poll can't overwrite a fresher copy written meanwhile.
+func upsertCachedOrders(db *gorm.DB, orders []WooOrder) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	rows := make([]CachedWooOrder, 0, len(orders))
+	for _, order := range orders {
+		order.OrderMetadata = OrderMetadata{}
+		order.CVSStoreName = ""
+		order.ShipmentTimeline = nil
+		order.ShipmentStatus = nil
+		order.LabelPrint = nil
+		data, err := json.Marshal(order)
+		if err != nil {
+			return fmt.Errorf("marshal order %d: %w", order.ID, err)
+		}
+		rows = append(rows, CachedWooOrder{
+			ID:              order.ID,
+			Status:          order.Status,
+			DateModifiedGMT: parseWooGMT(order.DateModifiedGMT),
+			Data:            string(data),
+			SyncedAt:        now,
+		})
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "date_modified_gmt", "data", "synced_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "woo_orders.date_modified_gmt <= excluded.date_modified_gmt"},
+		}},
+	}).CreateInBatches(rows, 100).Error
+}
+
+// storeOrder refreshes the cached copy of a single order. Used as the
+// WooClient write hook so our own PUTs show up without waiting for a poll.
+func (s *OrderSyncer) storeOrder(order WooOrder) {
+	if err := upsertCachedOrders(s.db, []WooOrder{order}); err != nil {
+		log.Printf("[order-sync] 更新訂單 %d 快取失敗：%v", order.ID, err)
+	}
+}
+
+func (s *OrderSyncer) fetchProcessingOrders(ctx context.Context) ([]WooOrder, error) {
+	return s.fetchOrdersByStatus(ctx, "processing")
+}
+
+func (s *OrderSyncer) fetchShippingOrders(ctx context.Context) ([]WooOrder, error) {
+	return s.fetchOrdersByStatus(ctx, "prepare-stock")
+}
+
+// fetchOrdersByStatus reads orders from the local cache. Until the first
+// sync has completed it falls back to asking WooCommerce directly.
+func (s *OrderSyncer) fetchOrdersByStatus(ctx context.Context, status string) ([]WooOrder, error) {
+	state, err := s.State()
+	if err != nil {
+		return nil, err
+	}
+	if state.LastSyncedAt.IsZero() {
+		return s.woo.fetchOrdersByStatus(ctx, status)
+	}
+
+	var rows []CachedWooOrder
+	if err := s.db.WithContext(ctx).Where("status = ?", status).Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	orders := make([]WooOrder, 0, len(rows))
+	for _, row := range rows {
+		var order WooOrder
+		if err := json.Unmarshal([]byte(row.Data), &order); err != nil {
+			return nil, fmt.Errorf("decode cached order %d: %w", row.ID, err)
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// remarkNotePrefix marks WC order notes written by this app, so they are not
+// mistaken for remarks typed in wp-admin when pulling.
+const remarkNotePrefix = "[揀貨備註] "
+
+// tagsMetaKey is the WC order meta key our tags are mirrored to.
+const tagsMetaKey = "_checklist_tags"
+
+// Ways to resolve a remark/tags sync conflict (NoteSyncResolve*).
+const (
+	NoteSyncResolveNone   = ""
+	NoteSyncResolveLocal  = "local"
+	NoteSyncResolveRemote = "remote"
+)
+
+// NoteSyncResult reports what one syncOrderNotes call did.
+type NoteSyncResult struct {
+	OrderID  int           `json:"order_id"`
+	Pushed   []string      `json:"pushed"`
+	Pulled   []string      `json:"pulled"`
+	Conflict string        `json:"conflict,omitempty"`
+	Disabled bool          `json:"disabled,omitempty"` // WOO_NOTE_SYNC is off; nothing was synced
+	Metadata OrderMetadata `json:"metadata"`
+}
+
+// saveOrderMetadataFields upserts the user-editable metadata columns without
+// touching the sync bookkeeping columns.
+func saveOrderMetadataFields(db *gorm.DB, meta *OrderMetadata) error {
+	if meta.Tags == nil {
+		meta.Tags = StringArray{}
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "order_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"remark", "tags", "is_completed"}),
+	}).Create(meta).Error
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteTags reads our tags meta from a WC order. ok is false when the meta
+// has never been written.
+func remoteTags(order *WooOrder) (tags []string, ok bool) {
+	for _, m := range order.MetaData {
+		if m.Key != tagsMetaKey {
+			continue
+		}
+		switch v := m.Value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				if s, isStr := item.(string); isStr {
+					tags = append(tags, s)
+				}
+			}
+			return tags, true
+		case string:
+			if v == "" {
+				return []string{}, true
+			}
+			if err := json.Unmarshal([]byte(v), &tags); err == nil {
+				return tags, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// syncOrderNotes reconciles an order's local remark and tags with WooCommerce.
+// Local remark edits are pushed as private order notes and tags as the
+// _checklist_tags meta; notes typed in wp-admin since the last sync are
+// pulled into the remark. The first sync of an order only records where the
+// note history stands, so older notes never overwrite the remark. When both
+// sides changed since the last sync the field is left alone and a conflict
+// is recorded, unless resolve picks a side.
+//
+// It writes to WooCommerce, so only call it from write requests.
+func syncOrderNotes(ctx context.Context, db *gorm.DB, woo *WooClient, orderID int, resolve string) (NoteSyncResult, error) {
+	result := NoteSyncResult{OrderID: orderID, Pushed: []string{}, Pulled: []string{}}
+
+	var meta OrderMetadata
+	if err := db.First(&meta, orderID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return result, err
+		}
+		meta = OrderMetadata{OrderID: orderID, Tags: StringArray{}}
+	}
+
+	notes, err := woo.listOrderNotes(ctx, orderID)
+	if err != nil {
+		return result, fmt.Errorf("list notes: %w", err)
+	}
+	order, err := woo.fetchSingleOrder(ctx, orderID)
+	if err != nil {
+		return result, fmt.Errorf("fetch order: %w", err)
+	}
+
+	// Newest note typed by a person in wp-admin since the last sync.
+	// LastNoteID predates NoteSyncedAt, so either marks an earlier sync.
+	firstSync := meta.NoteSyncedAt == nil && meta.LastNoteID == 0
+	maxNoteID := meta.LastNoteID
+	var remote *WooOrderNote
+	for i := range notes {
+		n := &notes[i]
+		if n.ID > maxNoteID {
+			maxNoteID = n.ID
+		}
+		if firstSync || n.ID <= meta.LastNoteID || n.CustomerNote || !n.AddedByUser || strings.HasPrefix(n.Note, remarkNotePrefix) {
+			continue
+		}
+		if remote == nil || n.ID > remote.ID {
+			remote = n
+		}
+	}
+
+	localRemarkChanged := meta.Remark != meta.SyncedRemark
+	remoteRemarkChanged := remote != nil && strings.TrimSpace(remote.Note) != meta.SyncedRemark
+
+	wcTags, hasWCTags := remoteTags(&order)
+	localTagsChanged := !sameTags(meta.Tags, meta.SyncedTags)
+	remoteTagsChanged := hasWCTags && !sameTags(wcTags, meta.SyncedTags)
+
+	switch resolve {
+	case NoteSyncResolveLocal:
+		remoteRemarkChanged, remoteTagsChanged = false, false
+	case NoteSyncResolveRemote:
+		localRemarkChanged = localRemarkChanged && !remoteRemarkChanged
+		localTagsChanged = localTagsChanged && !remoteTagsChanged
+	}
+
+	var conflicts []string
+	remarkConflict := localRemarkChanged && remoteRemarkChanged && strings.TrimSpace(remote.Note) != meta.Remark
+	tagsConflict := localTagsChanged && remoteTagsChanged && !sameTags(wcTags, meta.Tags)
+
+	// Remark.
+	switch {
+	case remarkConflict:
+		conflicts = append(conflicts, fmt.Sprintf("備註：本地「%s」與後台「%s」都有修改", meta.Remark, strings.TrimSpace(remote.Note)))
+	case localRemarkChanged:
+		text := meta.Remark
+		if text == "" {
+			text = "(已清除)"
+		}
+		created, err := woo.createOrderNote(ctx, orderID, remarkNotePrefix+text)
+		if err != nil {
+			return result, fmt.Errorf("push remark: %w", err)
+		}
+		if created.ID > maxNoteID {
+			maxNoteID = created.ID
+		}
+		meta.SyncedRemark = meta.Remark
+		meta.LastNoteID = maxNoteID
+		result.Pushed = append(result.Pushed, "remark")
+	case remoteRemarkChanged:
+		meta.Remark = strings.TrimSpace(remote.Note)
+		meta.SyncedRemark = meta.Remark
+		meta.LastNoteID = maxNoteID
+		result.Pulled = append(result.Pulled, "remark")
+	default:
+		meta.LastNoteID = maxNoteID
+	}
+
+	// Tags.
+	switch {
+	case tagsConflict:
+		conflicts = append(conflicts, fmt.Sprintf("標籤：本地 %v 與後台 %v 都有修改", []string(meta.Tags), wcTags))
+	case localTagsChanged:
+		if err := woo.putOrderMeta(ctx, orderID, []map[string]interface{}{
+			{"key": tagsMetaKey, "value": []string(meta.Tags)},
+		}); err != nil {
+			return result, fmt.Errorf("push tags: %w", err)
+		}
+		meta.SyncedTags = append(StringArray{}, meta.Tags...)
+		result.Pushed = append(result.Pushed, "tags")
+	case remoteTagsChanged:
+		meta.Tags = append(StringArray{}, wcTags...)
+		meta.SyncedTags = append(StringArray{}, wcTags...)
+		result.Pulled = append(result.Pulled, "tags")
+	}
+
+	meta.SyncConflict = strings.Join(conflicts, "；")
+	if meta.NoteSyncedAt == nil {
+		now := time.Now()
+		meta.NoteSyncedAt = &now
+	}
+	if err := db.Save(&meta).Error; err != nil {
+		return result, err
+	}
+	result.Conflict = meta.SyncConflict
+	result.Metadata = meta
+	return result, nil
+}
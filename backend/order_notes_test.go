@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeWooNotes stands in for the WC order and order-notes endpoints of one
+// order.
+type fakeWooNotes struct {
+	mu     sync.Mutex
+	notes  []WooOrderNote
+	posted []string
+	puts   int
+}
+
+func (f *fakeWooNotes) addNote(id int, text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notes = append(f.notes, WooOrderNote{ID: id, Note: text, AddedByUser: true})
+}
+
+func (f *fakeWooNotes) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/notes") && r.Method == http.MethodGet:
+		json.NewEncoder(rw).Encode(f.notes)
+	case strings.HasSuffix(r.URL.Path, "/notes") && r.Method == http.MethodPost:
+		var body struct {
+			Note string `json:"note"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.posted = append(f.posted, body.Note)
+		note := WooOrderNote{ID: 1000 + len(f.posted), Note: body.Note, AddedByUser: false}
+		f.notes = append(f.notes, note)
+		json.NewEncoder(rw).Encode(note)
+	case r.Method == http.MethodPut:
+		f.puts++
+		json.NewEncoder(rw).Encode(WooOrder{ID: 7})
+	default:
+		json.NewEncoder(rw).Encode(WooOrder{ID: 7})
+	}
+}
+
+func newNoteSyncTest(t *testing.T) (*fakeWooNotes, *WooClient) {
+	t.Helper()
+	fake := &fakeWooNotes{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, newTestWooClient(srv)
+}
+
+func TestSyncOrderNotesIgnoresHistoryOnFirstSync(t *testing.T) {
+	db := newTestDB(t, &OrderMetadata{})
+	fake, woo := newNoteSyncTest(t)
+	fake.addNote(10, "三年前的舊備註")
+	ctx := context.Background()
+
+	result, err := syncOrderNotes(ctx, db, woo, 7, NoteSyncResolveNone)
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+	if len(result.Pulled) != 0 || result.Metadata.Remark != "" {
+		t.Fatalf("first sync pulled %v, remark %q; historical notes must be ignored", result.Pulled, result.Metadata.Remark)
+	}
+	if len(fake.posted) != 0 || fake.puts != 0 {
+		t.Errorf("first sync with nothing local wrote to WooCommerce: notes %v, puts %d", fake.posted, fake.puts)
+	}
+
+	// A note typed after the first sync is pulled.
+	fake.addNote(11, "請改寄宅配")
+	result, err = syncOrderNotes(ctx, db, woo, 7, NoteSyncResolveNone)
+	if err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if result.Metadata.Remark != "請改寄宅配" {
+		t.Errorf("remark = %q, want the new wp-admin note", result.Metadata.Remark)
+	}
+}
+
+func TestSyncOrderNotesPushesLocalRemark(t *testing.T) {
+	db := newTestDB(t, &OrderMetadata{})
+	fake, woo := newNoteSyncTest(t)
+	fake.addNote(10, "舊備註")
+	ctx := context.Background()
+
+	if err := saveOrderMetadataFields(db, &OrderMetadata{OrderID: 7, Remark: "缺貨，週五出"}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := syncOrderNotes(ctx, db, woo, 7, NoteSyncResolveNone)
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(fake.posted) != 1 || fake.posted[0] != remarkNotePrefix+"缺貨，週五出" {
+		t.Fatalf("posted %v, want the local remark", fake.posted)
+	}
+	if result.Metadata.Remark != "缺貨，週五出" {
+		t.Errorf("remark = %q, local remark was overwritten", result.Metadata.Remark)
+	}
+
+	// Our own note is not pulled back, and nothing is pushed twice.
+	if _, err := syncOrderNotes(ctx, db, woo, 7, NoteSyncResolveNone); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.posted) != 1 {
+		t.Errorf("posted %v after an unchanged sync", fake.posted)
+	}
+}
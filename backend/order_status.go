@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// allowedStatusTransitions lists, per current WooCommerce status, the
+// statuses the dashboard may move an order to.
+var allowedStatusTransitions = map[string][]string{
+	"on-hold":       {"processing"},
+	"processing":    {"prepare-stock", "completed", "on-hold"},
+	"prepare-stock": {"completed", "processing"},
+}
+
+// StatusChangeResult represents the outcome of changing one order's status.
+type StatusChangeResult struct {
+	OrderID    int    `json:"order_id"`
+	Success    bool   `json:"success"`
+	FromStatus string `json:"from_status,omitempty"`
+	ToStatus   string `json:"to_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func statusTransitionAllowed(from, to string) bool {
+	for _, s := range allowedStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func isKnownTargetStatus(status string) bool {
+	for _, targets := range allowedStatusTransitions {
+		for _, s := range targets {
+			if s == status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changeOrderStatuses moves orderIDs to target through the WC batch endpoint.
+// Current statuses are read live from WooCommerce, orders whose transition
+// isn't allowed are rejected individually, and results keep request order.
+func changeOrderStatuses(ctx context.Context, woo *WooClient, orderIDs []int, target string) ([]StatusChangeResult, error) {
+	orderIDs = uniqueInts(orderIDs)
+	orders, err := woo.fetchMultipleOrders(ctx, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int]string, len(orders))
+	for _, order := range orders {
+		current[order.ID] = order.Status
+	}
+
+	results := make([]StatusChangeResult, len(orderIDs))
+	index := make(map[int]int, len(orderIDs))
+	var updates []map[string]interface{}
+	for i, id := range orderIDs {
+		results[i] = StatusChangeResult{OrderID: id, ToStatus: target}
+		from, ok := current[id]
+		switch {
+		case !ok:
+			results[i].Error = "找不到訂單"
+		case from == target:
+			results[i].FromStatus = from
+			results[i].Success = true
+		case !statusTransitionAllowed(from, target):
+			results[i].FromStatus = from
+			results[i].Error = fmt.Sprintf("不允許從 %s 變更為 %s", from, target)
+		default:
+			results[i].FromStatus = from
+			index[id] = i
+			updates = append(updates, map[string]interface{}{"id": id, "status": target})
+		}
+	}
+	if len(updates) == 0 {
+		return results, nil
+	}
+
+	items, err := woo.batchUpdateOrders(ctx, updates)
+	for _, item := range items {
+		i, ok := index[item.ID]
+		if !ok {
+			continue
+		}
+		if item.Error != nil {
+			results[i].Error = item.Error.Message
+			continue
+		}
+		results[i].Success = true
+		delete(index, item.ID)
+	}
+	for _, i := range index {
+		if !results[i].Success && results[i].Error == "" {
+			if err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Error = "WooCommerce 未回傳此訂單的結果"
+			}
+		}
+	}
+	return results, nil
+}
+
+// uniqueInts drops repeated values, keeping first-seen order.
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	out := make([]int, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
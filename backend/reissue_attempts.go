@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Reissue attempt statuses (ReissueAttempt.Status).
+const (
+	ReissueAttemptPending     = "pending"      // claimed, ECPay not answered yet
+	ReissueAttemptRejected    = "rejected"     // refused before calling ECPay
+	ReissueAttemptEcpayFailed = "ecpay_failed" // ECPay refused or was unreachable
+	ReissueAttemptEcpayOK     = "ecpay_ok"     // ECPay created the shipment, WC not written yet
+	ReissueAttemptWCFailed    = "wc_failed"    // ECPay created the shipment, WC write-back failed
+	ReissueAttemptCompleted   = "completed"
+	ReissueAttemptInterrupted = "interrupted" // left pending by a crash; check ECPay by hand
+	ReissueAttemptResolved    = "resolved"    // interrupted, then checked by hand
+)
+
+// reissueDedupWindow is how long after an attempt the same order is refused.
+const reissueDedupWindow = 30 * time.Second
+
+// reissueStaleAfter is how long a pending attempt may stay pending before it
+// is considered abandoned by a crashed process.
+const reissueStaleAfter = 5 * time.Minute
+
+// ReissueAttempt is the audit record of one create/reissue call to ECPay.
+// At most one attempt per order may be pending, which is what makes
+// concurrent requests (from any replica) idempotent.
+type ReissueAttempt struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	OrderID         int       `json:"order_id" gorm:"index;uniqueIndex:idx_reissue_attempt_pending,where:status = 'pending'"`
+	Reissue         bool      `json:"reissue"` // false for a first-time create
+	Status          string    `json:"status" gorm:"index"`
+	MerchantTradeNo string    `json:"merchant_trade_no"`
+	RequestParams   string    `json:"request_params"` // JSON, without CheckMacValue
+	EcpayResponse   string    `json:"ecpay_response"`
+	LogisticsID     string    `json:"logistics_id"`
+	TrackingNo      string    `json:"tracking_no"`
+	ShippingEntry   string    `json:"shipping_entry"` // JSON _ecpay_shipping_info entry to write back
+	Error           string    `json:"error"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// errReissueInFlight is returned by claimReissueAttempt when the order has a
+// pending or very recent attempt.
+var errReissueInFlight = errors.New("同一訂單 30 秒內已請求過取號，請稍候再試")
+
+// claimReissueAttempt records a new pending attempt for orderID, refusing
+// while another attempt is pending or one was made in the dedup window.
+func claimReissueAttempt(db *gorm.DB, orderID int, reissue bool) (*ReissueAttempt, error) {
+	attempt := &ReissueAttempt{OrderID: orderID, Reissue: reissue, Status: ReissueAttemptPending}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// A pending row this old belongs to a process that died mid-call.
+		if err := tx.Model(&ReissueAttempt{}).
+			Where("order_id = ? AND status = ? AND created_at < ?", orderID, ReissueAttemptPending, time.Now().Add(-reissueStaleAfter)).
+			Updates(map[string]interface{}{"status": ReissueAttemptInterrupted, "error": "attempt abandoned while pending"}).Error; err != nil {
+			return err
+		}
+
+		var recent int64
+		if err := tx.Model(&ReissueAttempt{}).
+			Where("order_id = ? AND status <> ? AND created_at > ?", orderID, ReissueAttemptRejected, time.Now().Add(-reissueDedupWindow)).
+			Count(&recent).Error; err != nil {
+			return err
+		}
+		if recent > 0 {
+			return errReissueInFlight
+		}
+		return tx.Create(attempt).Error
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, errReissueInFlight
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// saveReissueAttempt persists attempt, logging rather than failing: the
+// audit row must never turn a paid shipment into a reported failure.
+func saveReissueAttempt(db *gorm.DB, attempt *ReissueAttempt) {
+	if err := db.Save(attempt).Error; err != nil {
+		log.Printf("[reissue] order=%d 儲存取號紀錄 #%d 失敗：%v", attempt.OrderID, attempt.ID, err)
+	}
+}
+
+// marshalAuditParams encodes ECPay request params for the audit log,
+// dropping the signature.
+func marshalAuditParams(params map[string]string) string {
+	clean := make(map[string]string, len(params))
+	for k, v := range params {
+		if k == "CheckMacValue" {
+			continue
+		}
+		clean[k] = v
+	}
+	data, _ := json.Marshal(clean)
+	return string(data)
+}
+
+// writeBackShipment merges entry into the order's _ecpay_shipping_info under
+// logisticsID and points 運送編號 at trackingNo.
+func writeBackShipment(ctx context.Context, woo *WooClient, order *WooOrder, logisticsID string, entry map[string]interface{}, trackingNo string) error {
+	mergedMap := ecpayShippingMap(order)
+	mergedMap[logisticsID] = entry
+	return woo.putOrderMeta(ctx, order.ID, []map[string]interface{}{
+		{"key": "_ecpay_shipping_info", "value": mergedMap},
+		{"key": "運送編號", "value": trackingNo},
+	})
+}
+
+// What applyReissueAttempt did (or, in a dry run, would do) with an attempt.
+const (
+	ReconcileAlreadyApplied = "already_applied" // the entry is already on the order
+	ReconcileApplied        = "applied"         // entry merged and 運送編號 updated
+	ReconcileEntryOnly      = "entry_only"      // entry merged; a newer shipment stays active
+	ReconcileManualCheck    = "manual_check"    // interrupted before ECPay answered
+	ReconcileFailed         = "failed"
+)
+
+// ReconcileItem is one attempt looked at by reconcileReissues.
+type ReconcileItem struct {
+	AttemptID   uint   `json:"attempt_id"`
+	OrderID     int    `json:"order_id"`
+	LogisticsID string `json:"logistics_id,omitempty"`
+	Action      string `json:"action"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ReconcileReport summarises a reconcileReissues run.
+type ReconcileReport struct {
+	DryRun  bool            `json:"dry_run"`
+	Applied int             `json:"applied"`
+	Failed  int             `json:"failed"`
+	Items   []ReconcileItem `json:"items"`
+}
+
+// logisticsIDNewer reports whether ECPay logistics ID a was issued after b.
+// IDs are increasing numbers; non-numeric IDs never count as newer.
+func logisticsIDNewer(a, b string) bool {
+	ai, errA := strconv.ParseInt(a, 10, 64)
+	bi, errB := strconv.ParseInt(b, 10, 64)
+	return errA == nil && errB == nil && ai > bi
+}
+
+// applyReissueAttempt writes an attempt's shipment back to WooCommerce. It
+// is idempotent: an entry already present is left alone, and if the order
+// has since moved on to a newer shipment the entry is only recorded in
+// _ecpay_shipping_info while 運送編號 keeps pointing at the newer one.
+func applyReissueAttempt(ctx context.Context, db *gorm.DB, woo *WooClient, attempt *ReissueAttempt, dryRun bool) (string, error) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(attempt.ShippingEntry), &entry); err != nil || len(entry) == 0 || attempt.LogisticsID == "" {
+		return ReconcileFailed, &refusedError{fmt.Sprintf("取號紀錄 #%d 沒有可寫回的物流資料", attempt.ID)}
+	}
+
+	order, err := woo.fetchSingleOrder(ctx, attempt.OrderID)
+	if err != nil {
+		return ReconcileFailed, fmt.Errorf("fetch order: %w", err)
+	}
+
+	newerActive := false
+	if active := getEcpayShippingInfo(&order); active != nil && active.LogisticsID != attempt.LogisticsID {
+		newerActive = logisticsIDNewer(active.LogisticsID, attempt.LogisticsID)
+	}
+	var newerAttempts int64
+	if err := db.Model(&ReissueAttempt{}).
+		Where("order_id = ? AND id > ? AND status = ?", attempt.OrderID, attempt.ID, ReissueAttemptCompleted).
+		Count(&newerAttempts).Error; err != nil {
+		return ReconcileFailed, err
+	}
+	newerActive = newerActive || newerAttempts > 0
+
+	mergedMap := ecpayShippingMap(&order)
+	_, present := mergedMap[attempt.LogisticsID]
+	action := ReconcileApplied
+	switch {
+	case present && (newerActive || findMetaString(&order, "運送編號") == attempt.TrackingNo):
+		action = ReconcileAlreadyApplied
+	case newerActive:
+		action = ReconcileEntryOnly
+	}
+	if dryRun {
+		return action, nil
+	}
+
+	if action != ReconcileAlreadyApplied {
+		if !present {
+			mergedMap[attempt.LogisticsID] = entry
+		}
+		meta := []map[string]interface{}{{"key": "_ecpay_shipping_info", "value": mergedMap}}
+		if action == ReconcileApplied {
+			meta = append(meta, map[string]interface{}{"key": "運送編號", "value": attempt.TrackingNo})
+		}
+		if err := woo.putOrderMeta(context.WithoutCancel(ctx), attempt.OrderID, meta); err != nil {
+			attempt.Status = ReissueAttemptWCFailed
+			attempt.Error = err.Error()
+			saveReissueAttempt(db, attempt)
+			return ReconcileFailed, err
+		}
+	}
+
+	attempt.Status = ReissueAttemptCompleted
+	attempt.Error = ""
+	if action == ReconcileEntryOnly {
+		attempt.Error = "已補寫物流資料，但訂單已有較新的物流單，未變更運送編號"
+	}
+	saveReissueAttempt(db, attempt)
+	log.Printf("[reissue] order=%d 取號紀錄 #%d 寫回（%s）LogisticsID=%s", attempt.OrderID, attempt.ID, action, attempt.LogisticsID)
+	return action, nil
+}
+
+// claimReissueWriteBack takes attempt for a write-back. A wc_failed attempt,
+// or an ecpay_ok one left behind by a crash, is set to a fresh ecpay_ok in
+// one conditional UPDATE, which keeps every other retry or reconcile off it
+// until the write-back is done. It reports false if the attempt is not in
+// such a state any more, or its original request may still be writing back.
+func claimReissueWriteBack(db *gorm.DB, attempt *ReissueAttempt) (bool, error) {
+	now := time.Now()
+	res := db.Model(&ReissueAttempt{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))",
+			attempt.ID, ReissueAttemptWCFailed, ReissueAttemptEcpayOK, now.Add(-reissueStaleAfter)).
+		Updates(map[string]interface{}{"status": ReissueAttemptEcpayOK, "updated_at": now})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	attempt.Status = ReissueAttemptEcpayOK
+	attempt.UpdatedAt = now
+	return true, nil
+}
+
+// retryReissueWriteBack repeats the WooCommerce write-back of an attempt
+// whose ECPay call succeeded but whose WC PUT did not.
+func retryReissueWriteBack(ctx context.Context, db *gorm.DB, woo *WooClient, id uint) (*ReissueAttempt, error) {
+	var attempt ReissueAttempt
+	if err := db.First(&attempt, id).Error; err != nil {
+		return nil, err
+	}
+	if attempt.Status != ReissueAttemptWCFailed && attempt.Status != ReissueAttemptEcpayOK {
+		return &attempt, &refusedError{fmt.Sprintf("取號紀錄狀態為 %s，只有 ECPay 成功但寫回失敗的紀錄可以重試", attempt.Status)}
+	}
+	claimed, err := claimReissueWriteBack(db, &attempt)
+	if err != nil {
+		return &attempt, err
+	}
+	if !claimed {
+		return &attempt, &refusedError{fmt.Sprintf("取號紀錄 #%d 正在寫回 WooCommerce，請稍後再試", attempt.ID)}
+	}
+	_, err = applyReissueAttempt(ctx, db, woo, &attempt, false)
+	return &attempt, err
+}
+
+// reconcileReissues finds shipments ECPay created but WooCommerce never
+// received (wc_failed, or ecpay_ok left behind by a crash) and applies them
+// with applyReissueAttempt. Interrupted attempts, including pending ones a
+// crash left behind, are listed for a manual check since we never learned
+// their AllPayLogisticsID, until resolveReissueAttempt marks them checked.
+func reconcileReissues(ctx context.Context, db *gorm.DB, woo *WooClient, dryRun bool) (ReconcileReport, error) {
+	report := ReconcileReport{DryRun: dryRun, Items: []ReconcileItem{}}
+
+	// An ecpay_ok or pending attempt younger than this may still be running.
+	inFlightCutoff := time.Now().Add(-reissueStaleAfter)
+
+	var attempts []ReissueAttempt
+	if err := db.Where("status = ? OR status = ? OR (status = ? AND updated_at < ?) OR (status = ? AND created_at < ?)",
+		ReissueAttemptWCFailed, ReissueAttemptInterrupted, ReissueAttemptEcpayOK, inFlightCutoff, ReissueAttemptPending, inFlightCutoff).
+		Order("id").Find(&attempts).Error; err != nil {
+		return report, err
+	}
+
+	for i := range attempts {
+		attempt := &attempts[i]
+		item := ReconcileItem{AttemptID: attempt.ID, OrderID: attempt.OrderID, LogisticsID: attempt.LogisticsID}
+		if attempt.Status == ReissueAttemptPending && !dryRun {
+			// Same as claimReissueAttempt does when the order is retried.
+			attempt.Status = ReissueAttemptInterrupted
+			attempt.Error = "attempt abandoned while pending"
+			saveReissueAttempt(db, attempt)
+		}
+		if attempt.Status == ReissueAttemptInterrupted || attempt.Status == ReissueAttemptPending {
+			item.Action = ReconcileManualCheck
+			item.Error = "MerchantTradeNo " + attempt.MerchantTradeNo + " 可能已在綠界建立，請至綠界後台確認後標記為已處理"
+			report.Items = append(report.Items, item)
+			continue
+		}
+
+		if !dryRun {
+			claimed, err := claimReissueWriteBack(db, attempt)
+			if err != nil {
+				return report, err
+			}
+			if !claimed {
+				continue // a retry is writing it back right now
+			}
+		}
+		action, err := applyReissueAttempt(ctx, db, woo, attempt, dryRun)
+		item.Action = action
+		if err != nil {
+			item.Action = ReconcileFailed
+			item.Error = err.Error()
+			report.Failed++
+		} else if action == ReconcileApplied || action == ReconcileEntryOnly {
+			report.Applied++
+		}
+		report.Items = append(report.Items, item)
+	}
+	return report, nil
+}
+
+// resolveReissueAttempt marks an interrupted attempt as checked by hand, so
+// reconcileReissues stops listing it. note records what the check found.
+func resolveReissueAttempt(db *gorm.DB, id uint, note string) (*ReissueAttempt, error) {
+	var attempt ReissueAttempt
+	if err := db.First(&attempt, id).Error; err != nil {
+		return nil, err
+	}
+	resolution := "已人工確認"
+	if note = strings.TrimSpace(note); note != "" {
+		resolution += "：" + note
+	}
+	res := db.Model(&ReissueAttempt{}).Where("id = ? AND status = ?", id, ReissueAttemptInterrupted).
+		Updates(map[string]interface{}{"status": ReissueAttemptResolved, "error": resolution})
+	if res.Error != nil {
+		return &attempt, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &attempt, &refusedError{fmt.Sprintf("取號紀錄狀態為 %s，只有中斷的紀錄可以標記為已處理", attempt.Status)}
+	}
+	attempt.Status = ReissueAttemptResolved
+	attempt.Error = resolution
+	return &attempt, nil
+}
+
+// runReconcileReissues is the "reconcile-reissues [--dry-run]
+// [--resolve ID [--note TEXT]]" subcommand.
+func runReconcileReissues(db *gorm.DB, woo *WooClient, args []string) {
+	fs := flag.NewFlagSet("reconcile-reissues", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be written without writing")
+	resolve := fs.Uint("resolve", 0, "mark this interrupted attempt as checked by hand instead")
+	note := fs.String("note", "", "what the check found, with --resolve")
+	fs.Parse(args)
+
+	if *resolve != 0 {
+		attempt, err := resolveReissueAttempt(db, *resolve, *note)
+		if err != nil {
+			log.Fatalf("reconcile-reissues: %v", err)
+		}
+		fmt.Printf("#%d\torder=%d\t%s\t%s\n", attempt.ID, attempt.OrderID, attempt.Status, attempt.Error)
+		return
+	}
+
+	report, err := reconcileReissues(context.Background(), db, woo, *dryRun)
+	if err != nil {
+		log.Fatalf("reconcile-reissues: %v", err)
+	}
+	for _, item := range report.Items {
+		fmt.Printf("#%d\torder=%d\tlogistics=%s\t%s\t%s\n", item.AttemptID, item.OrderID, item.LogisticsID, item.Action, item.Error)
+	}
+	fmt.Printf("dry_run=%v applied=%d failed=%d total=%d\n", report.DryRun, report.Applied, report.Failed, len(report.Items))
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconcileReissuesReportsAbandonedPendingAttempts(t *testing.T) {
+	db := newTestDB(t, &ReissueAttempt{})
+	stale := ReissueAttempt{OrderID: 1, Status: ReissueAttemptPending, MerchantTradeNo: "1TS1", CreatedAt: time.Now().Add(-time.Hour)}
+	running := ReissueAttempt{OrderID: 2, Status: ReissueAttemptPending, MerchantTradeNo: "2TS1", CreatedAt: time.Now().Add(-time.Minute)}
+	for _, a := range []*ReissueAttempt{&stale, &running} {
+		if err := db.Create(a).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	report, err := reconcileReissues(ctx, db, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Items) != 1 || report.Items[0].AttemptID != stale.ID || report.Items[0].Action != ReconcileManualCheck {
+		t.Fatalf("dry run items = %+v, want only the abandoned attempt for a manual check", report.Items)
+	}
+	var got ReissueAttempt
+	db.First(&got, stale.ID)
+	if got.Status != ReissueAttemptPending {
+		t.Errorf("dry run changed the status to %s", got.Status)
+	}
+
+	report, err = reconcileReissues(ctx, db, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Items) != 1 || report.Items[0].Action != ReconcileManualCheck {
+		t.Fatalf("items = %+v", report.Items)
+	}
+	db.First(&got, stale.ID)
+	if got.Status != ReissueAttemptInterrupted {
+		t.Errorf("abandoned attempt status = %s, want interrupted", got.Status)
+	}
+	var other ReissueAttempt
+	db.First(&other, running.ID)
+	if other.Status != ReissueAttemptPending {
+		t.Errorf("running attempt status = %s, want it left pending", other.Status)
+	}
+
+	// Once interrupted it is still listed until checked by hand.
+	report, _ = reconcileReissues(ctx, db, nil, false)
+	if len(report.Items) != 1 || report.Items[0].AttemptID != stale.ID {
+		t.Errorf("items = %+v", report.Items)
+	}
+
+	resolved, err := resolveReissueAttempt(db, stale.ID, "綠界後台查無此筆")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if resolved.Status != ReissueAttemptResolved || resolved.Error != "已人工確認：綠界後台查無此筆" {
+		t.Errorf("resolved = %+v", resolved)
+	}
+	if report, _ = reconcileReissues(ctx, db, nil, false); len(report.Items) != 0 {
+		t.Errorf("items after resolving = %+v, want none", report.Items)
+	}
+	var refused *refusedError
+	if _, err := resolveReissueAttempt(db, running.ID, ""); !errors.As(err, &refused) {
+		t.Errorf("resolving a pending attempt = %v, want refused", err)
+	}
+}
+
+func TestRetryReissueWriteBackClaimsAttempt(t *testing.T) {
+	db := newTestDB(t, &ReissueAttempt{})
+	writing := ReissueAttempt{OrderID: 1, Status: ReissueAttemptEcpayOK, LogisticsID: "1900001"}
+	failed := ReissueAttempt{OrderID: 2, Status: ReissueAttemptWCFailed, LogisticsID: "1900002"}
+	for _, a := range []*ReissueAttempt{&writing, &failed} {
+		if err := db.Create(a).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The original request is still writing back a fresh ecpay_ok attempt.
+	var refused *refusedError
+	if _, err := retryReissueWriteBack(context.Background(), db, nil, writing.ID); !errors.As(err, &refused) {
+		t.Errorf("retry of an in-flight attempt = %v, want refused", err)
+	}
+
+	// Of two retries of a wc_failed attempt only the first gets it.
+	first, second := failed, failed
+	if ok, err := claimReissueWriteBack(db, &first); err != nil || !ok {
+		t.Fatalf("first claim = %v, %v", ok, err)
+	}
+	if ok, err := claimReissueWriteBack(db, &second); err != nil || ok {
+		t.Errorf("second claim = %v, %v; want it refused", ok, err)
+	}
+	if first.Status != ReissueAttemptEcpayOK {
+		t.Errorf("claimed status = %s, want ecpay_ok", first.Status)
+	}
+}
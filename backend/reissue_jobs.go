@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reissueJobRetention is how long a finished job stays queryable.
+const reissueJobRetention = time.Hour
+
+// ReissueJob is a batch of reissues running in the background. Results are
+// appended in completion order, not request order.
+type ReissueJob struct {
+	ID         string          `json:"job_id"`
+	Total      int             `json:"total"`
+	Results    []ReissueResult `json:"results"`
+	Finished   bool            `json:"finished"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every update
+}
+
+// snapshot copies the job state under its lock.
+func (j *ReissueJob) snapshot() ReissueJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return ReissueJob{
+		ID:         j.ID,
+		Total:      j.Total,
+		Results:    append([]ReissueResult(nil), j.Results...),
+		Finished:   j.Finished,
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// since returns the results after the first n, whether the job is finished,
+// and a channel that is closed on the next update.
+func (j *ReissueJob) since(n int) ([]ReissueResult, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var pending []ReissueResult
+	if n < len(j.Results) {
+		pending = append(pending, j.Results[n:]...)
+	}
+	return pending, j.Finished, j.changed
+}
+
+func (j *ReissueJob) update(fn func()) {
+	j.mu.Lock()
+	fn()
+	close(j.changed)
+	j.changed = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// ReissueJobManager runs reissue jobs with at most `concurrency` orders in
+// flight across all jobs, so a large batch neither times out the browser
+// nor floods WooCommerce and ECPay.
+type ReissueJobManager struct {
+	sem chan struct{}
+
+	mu   sync.Mutex
+	jobs map[string]*ReissueJob
+}
+
+// newReissueJobManager reads REISSUE_CONCURRENCY (default 4).
+func newReissueJobManager() *ReissueJobManager {
+	concurrency := 4
+	if raw := os.Getenv("REISSUE_CONCURRENCY"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			concurrency = n
+		}
+	}
+	return &ReissueJobManager{
+		sem:  make(chan struct{}, concurrency),
+		jobs: make(map[string]*ReissueJob),
+	}
+}
+
+// Start queues fn for every order ID (duplicates dropped) and returns
+// immediately. fn runs with a background context since the HTTP request
+// that started the job will be long gone.
+func (m *ReissueJobManager) Start(orderIDs []int, fn func(ctx context.Context, orderID int) ReissueResult) *ReissueJob {
+	seen := make(map[int]bool, len(orderIDs))
+	ids := make([]int, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	job := &ReissueJob{
+		ID:        newReissueJobID(),
+		Total:     len(ids),
+		Results:   make([]ReissueResult, 0, len(ids)),
+		CreatedAt: time.Now(),
+		changed:   make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	for id, old := range m.jobs {
+		if done := old.snapshot().FinishedAt; done != nil && time.Since(*done) > reissueJobRetention {
+			delete(m.jobs, id)
+		}
+	}
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	go func() {
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func(orderID int) {
+				defer wg.Done()
+				m.sem <- struct{}{}
+				defer func() { <-m.sem }()
+
+				result := fn(context.Background(), orderID)
+				job.update(func() { job.Results = append(job.Results, result) })
+			}(id)
+		}
+		wg.Wait()
+		job.update(func() {
+			now := time.Now()
+			job.Finished = true
+			job.FinishedAt = &now
+		})
+	}()
+	return job
+}
+
+// Get returns the job with the given ID, or nil.
+func (m *ReissueJobManager) Get(id string) *ReissueJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+func newReissueJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// reissueJobEventsHandler streams a job as Server-Sent Events: one "result"
+// event per order (id = its position, so a reconnecting EventSource resumes
+// via Last-Event-ID) and a final "done" event with the totals.
+func reissueJobEventsHandler(jobs *ReissueJobManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job := jobs.Get(c.Param("id"))
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到批次工作"})
+			return
+		}
+
+		sent := 0
+		if raw := c.GetHeader("Last-Event-ID"); raw != "" {
+			if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+				sent = n + 1
+			}
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		ctx := c.Request.Context()
+		c.Stream(func(w io.Writer) bool {
+			results, finished, changed := job.since(sent)
+			for _, r := range results {
+				data, _ := json.Marshal(r)
+				fmt.Fprintf(w, "id: %d\nevent: result\ndata: %s\n\n", sent, data)
+				sent++
+			}
+			if finished {
+				ok := 0
+				for _, r := range job.snapshot().Results {
+					if r.Success {
+						ok++
+					}
+				}
+				c.SSEvent("done", gin.H{"total": job.Total, "success": ok, "failed": job.Total - ok})
+				return false
+			}
+			if len(results) > 0 {
+				return true
+			}
+			select {
+			case <-changed:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fakeWooShop serves GET and PUT of WC orders from memory. PUT merges
+// meta_data by key, the way WooCommerce does.
+type fakeWooShop struct {
+	mu     sync.Mutex
+	orders map[int]*WooOrder
+}
+
+func (s *fakeWooShop) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/wp-json/wc/v3/orders/"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[id]
+	if err != nil || order == nil {
+		http.NotFound(rw, r)
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body struct {
+			MetaData []MetaData `json:"meta_data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	next:
+		for _, m := range body.MetaData {
+			for i := range order.MetaData {
+				if order.MetaData[i].Key == m.Key {
+					order.MetaData[i].Value = m.Value
+					continue next
+				}
+			}
+			order.MetaData = append(order.MetaData, m)
+		}
+	}
+	json.NewEncoder(rw).Encode(order)
+}
+
+// order returns the shop's current copy of an order, as the client sees it.
+func (s *fakeWooShop) order(t *testing.T, id int) WooOrder {
+	t.Helper()
+	s.mu.Lock()
+	data, _ := json.Marshal(s.orders[id])
+	s.mu.Unlock()
+	var order WooOrder
+	if err := json.Unmarshal(data, &order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// cvsOrder is a paid-by-transfer order picked up at a convenience store.
+func cvsOrder(id int, methodID string) *WooOrder {
+	return &WooOrder{
+		ID:            id,
+		Status:        "processing",
+		Total:         "480",
+		LineItems:     []LineItem{{Name: "手工皂禮盒", Quantity: 1, Total: "480"}},
+		Shipping:      ShippingInfo{LastName: "王", FirstName: "小明", Phone: "0912-345-678"},
+		ShippingLines: []ShippingLine{{MethodID: methodID}},
+		MetaData:      []MetaData{{Key: "_shipping_cvs_store_ID", Value: "991182"}},
+		PaymentMethod: "bacs",
+	}
+}
+
+type shipmentFlowTest struct {
+	db    *gorm.DB
+	shop  *fakeWooShop
+	woo   *WooClient
+	fake  *fakeEcpay
+	ecpay *EcpayClient
+}
+
+// newShipmentFlowTest wires a fake shop and a fake ECPay together, with
+// ECPay's status callbacks going to our own callback handler.
+func newShipmentFlowTest(t *testing.T, orders ...*WooOrder) *shipmentFlowTest {
+	t.Helper()
+	db := newTestDB(t, &ReissueAttempt{}, &LogisticsStatusEvent{}, &ShipmentStatus{}, &LabelPrint{})
+	if err := migrateLogisticsEventIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	shop := &fakeWooShop{orders: map[int]*WooOrder{}}
+	for _, o := range orders {
+		shop.orders[o.ID] = o
+	}
+	shopSrv := httptest.NewServer(shop)
+	t.Cleanup(shopSrv.Close)
+	fake, ecpay := newFakeEcpay(t)
+
+	r := gin.New()
+	r.POST("/webhooks/ecpay/logistics", ecpayLogisticsCallbackHandler(db, ecpay, nil))
+	callbackSrv := httptest.NewServer(r)
+	t.Cleanup(callbackSrv.Close)
+	t.Setenv("ECPAY_SERVER_REPLY_URL", callbackSrv.URL+"/webhooks/ecpay/logistics")
+
+	return &shipmentFlowTest{db: db, shop: shop, woo: newTestWooClient(shopSrv), fake: fake, ecpay: ecpay}
+}
+
+func (s *shipmentFlowTest) create(t *testing.T, orderID int, reissue bool) ReissueResult {
+	t.Helper()
+	// Step outside the dedup window of any earlier attempt.
+	if err := s.db.Model(&ReissueAttempt{}).Where("order_id = ?", orderID).
+		Update("created_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	var result ReissueResult
+	if reissue {
+		result = regenerateTracking(context.Background(), s.db, s.woo, s.ecpay, orderID, EcpayHomeOptions{})
+	} else {
+		result = createShipment(context.Background(), s.db, s.woo, s.ecpay, orderID, EcpayHomeOptions{})
+	}
+	if !result.Success {
+		t.Fatalf("order %d (reissue=%v): %s", orderID, reissue, result.Error)
+	}
+	return result
+}
+
+func TestReissueShipmentAgainstFakeEcpay(t *testing.T) {
+	s := newShipmentFlowTest(t, cvsOrder(501, "ry_ecpay_shipping_cvs_711"))
+	ctx := context.Background()
+
+	first := s.create(t, 501, false)
+	if first.SubType != "UNIMARTC2C" || first.NewPaymentNo == "" {
+		t.Fatalf("create = %+v", first)
+	}
+	order := s.shop.order(t, 501)
+	if got := findMetaString(&order, "運送編號"); got != first.NewPaymentNo {
+		t.Errorf("運送編號 = %q, want %q", got, first.NewPaymentNo)
+	}
+
+	// A second create is refused; a reissue replaces the active shipment.
+	if again := createShipment(ctx, s.db, s.woo, s.ecpay, 501, EcpayHomeOptions{}); again.Success {
+		t.Error("second createShipment succeeded, want it refused")
+	}
+	second := s.create(t, 501, true)
+	if second.LogisticsID == first.LogisticsID {
+		t.Fatalf("reissue kept logistics ID %s", first.LogisticsID)
+	}
+	order = s.shop.order(t, 501)
+	if active := getEcpayShippingInfo(&order); active == nil || active.LogisticsID != second.LogisticsID {
+		t.Errorf("active shipment = %+v, want %s", active, second.LogisticsID)
+	}
+	if _, kept := ecpayShippingMap(&order)[first.LogisticsID]; !kept {
+		t.Error("reissue dropped the superseded entry")
+	}
+
+	var attempts []ReissueAttempt
+	s.db.Order("id").Find(&attempts)
+	var completed int
+	for _, a := range attempts {
+		if a.Status == ReissueAttemptCompleted {
+			completed++
+		}
+		if strings.Contains(a.RequestParams, "CheckMacValue") {
+			t.Errorf("attempt #%d logged the signature", a.ID)
+		}
+	}
+	if completed != 2 {
+		t.Errorf("%d completed attempts, want 2: %+v", completed, attempts)
+	}
+
+	// The superseded 7-11 shipment can be cancelled, the active one not.
+	if _, err := cancelSupersededShipment(ctx, s.db, s.woo, s.ecpay, 501, second.LogisticsID); err == nil {
+		t.Error("cancelled the active shipment")
+	}
+	if _, err := cancelSupersededShipment(ctx, s.db, s.woo, s.ecpay, 501, first.LogisticsID); err != nil {
+		t.Fatalf("cancel superseded: %v", err)
+	}
+	if got := s.fake.lookup(first.LogisticsID).Status; got != "cancelled" {
+		t.Errorf("fake ECPay status = %q, want cancelled", got)
+	}
+
+	// ECPay's drop-off callback reaches us.
+	if reply := s.fake.pushStatus(t, second.LogisticsID, "2068"); reply != "1|OK" {
+		t.Fatalf("callback reply = %q", reply)
+	}
+	var status ShipmentStatus
+	if err := s.db.Where("all_pay_logistics_id = ?", second.LogisticsID).First(&status).Error; err != nil {
+		t.Fatalf("shipment status: %v", err)
+	}
+	if status.StatusCode != "2068" || status.OrderID != 501 {
+		t.Errorf("shipment status = %+v", status)
+	}
+}
+
+func TestBatchLabelDocumentAgainstFakeEcpay(t *testing.T) {
+	s := newShipmentFlowTest(t,
+		cvsOrder(601, "ry_ecpay_shipping_cvs_711"),
+		cvsOrder(602, "ry_ecpay_shipping_cvs_family"),
+		cvsOrder(603, "ry_ecpay_shipping_cvs_family"))
+	ctx := context.Background()
+	seven := s.create(t, 601, false)
+	fami := s.create(t, 602, false)
+
+	doc, report := buildBatchLabelDocument(ctx, s.db, s.woo, s.ecpay, []int{601, 602, 603}, false)
+	if len(report) != 3 || !report[0].OK || !report[1].OK || report[2].OK {
+		t.Fatalf("report = %+v, want 601 and 602 OK, 603 failed", report)
+	}
+	if report[0].LogisticsID != seven.LogisticsID || report[1].LogisticsID != fami.LogisticsID {
+		t.Errorf("report logistics IDs = %s, %s", report[0].LogisticsID, report[1].LogisticsID)
+	}
+	if !strings.Contains(doc, `id="Panel1"`) || !strings.Contains(doc, seven.NewPaymentNo[:9]) {
+		t.Error("document is missing the 7-11 label page")
+	}
+	if !strings.Contains(doc, "/fake/label/"+fami.LogisticsID) {
+		t.Error("document is missing the FamilyMart label image")
+	}
+	if !strings.Contains(doc, "1 筆無法取得標籤") {
+		t.Error("document does not report the order without a shipment")
+	}
+
+	// Once recorded, the same labels are flagged, or skipped on request.
+	recordLabelPrints(s.db, report, "html", "小美")
+	_, report = buildBatchLabelDocument(ctx, s.db, s.woo, s.ecpay, []int{601, 602}, false)
+	for _, item := range report {
+		if !item.OK || item.PreviouslyPrinted == nil || item.PreviouslyPrinted.PrintedBy != "小美" {
+			t.Errorf("reprint item = %+v, want OK and flagged as printed", item)
+		}
+	}
+	doc, report = buildBatchLabelDocument(ctx, s.db, s.woo, s.ecpay, []int{601, 602}, true)
+	for _, item := range report {
+		if !item.Skipped || item.OK {
+			t.Errorf("skip item = %+v, want skipped", item)
+		}
+	}
+	if strings.Contains(doc, "/fake/label/") {
+		t.Error("skipped labels were still fetched")
+	}
+}
+
+func TestLabelPDFAgainstFakeEcpay(t *testing.T) {
+	s := newShipmentFlowTest(t,
+		cvsOrder(701, "ry_ecpay_shipping_cvs_family"),
+		cvsOrder(702, "ry_ecpay_shipping_cvs_711"))
+	s.create(t, 701, false)
+	s.create(t, 702, false)
+	ctx := context.Background()
+
+	pdf, report, err := buildLabelPDF(ctx, s.db, s.woo, s.ecpay, []int{701, 702}, false)
+	if err != nil {
+		t.Fatalf("buildLabelPDF: %v", err)
+	}
+	if len(report) != 2 || !report[0].OK || report[0].WebOnly {
+		t.Fatalf("report[0] = %+v, want the FamilyMart label in the PDF", report[0])
+	}
+	if report[1].OK || !report[1].WebOnly {
+		t.Errorf("report[1] = %+v, want the 7-11 label reported as web only", report[1])
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("not a PDF: %q", pdf[:min(len(pdf), 16)])
+	}
+	if pages := bytes.Count(pdf, []byte("/Type /Page ")); pages != 1 {
+		t.Errorf("PDF has %d pages, want 1", pages)
+	}
+
+	// With only 7-11 orders there is nothing to render.
+	if _, report, err := buildLabelPDF(ctx, s.db, s.woo, s.ecpay, []int{702}, false); err == nil || !report[0].WebOnly {
+		t.Errorf("7-11 only: err = %v, report = %+v", err, report)
+	}
+}
+
+func TestUnimartLabelPageStopsWhenCancelled(t *testing.T) {
+	s := newShipmentFlowTest(t, cvsOrder(801, "ry_ecpay_shipping_cvs_711"))
+	s.create(t, 801, false)
+	order := s.shop.order(t, 801)
+	infos := []*ecpayShippingInfo{getEcpayShippingInfo(&order)}
+
+	page, err := fetchUnimartLabelPage(context.Background(), s.ecpay, infos)
+	if err != nil || !strings.Contains(page, `id="Panel1"`) {
+		t.Fatalf("fetch = %v, page has Panel1: %v", err, strings.Contains(page, `id="Panel1"`))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fetchUnimartLabelPage(ctx, s.ecpay, infos); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled fetch = %v, want context.Canceled", err)
+	}
+}
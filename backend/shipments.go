@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LogisticsStatusEvent is one ECPay logistics status change for a shipment
+// (AllPayLogisticsID), either pushed to us by ECPay or found by polling.
+type LogisticsStatusEvent struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	OrderID           int        `json:"order_id" gorm:"index"`
+	AllPayLogisticsID string     `json:"logistics_id" gorm:"index"`
+	MerchantTradeNo   string     `json:"merchant_trade_no"`
+	LogisticsSubType  string     `json:"sub_type"`
+	StatusCode        string     `json:"status_code"`
+	StatusMsg         string     `json:"status_msg"`
+	StatusAt          *time.Time `json:"status_at"` // nil when ECPay sent no time
+	Source            string     `json:"source"`    // "callback" or "poll"
+	Payload           string     `json:"-"`
+	ReceivedAt        time.Time  `json:"received_at" gorm:"autoCreateTime"`
+}
+
+// migrateLogisticsEventIndex replaces the old unique index over
+// (logistics ID, status code, status_at), which never matched events without
+// a status time because NULLs are distinct, with one over coalesce(status_at).
+// Duplicates that slipped in through the old index are removed first.
+func migrateLogisticsEventIndex(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasIndex(&LogisticsStatusEvent{}, "idx_logistics_event") {
+		if err := m.DropIndex(&LogisticsStatusEvent{}, "idx_logistics_event"); err != nil {
+			return err
+		}
+	}
+	if err := db.Exec(`DELETE FROM logistics_status_events
+		WHERE status_at IS NULL AND id NOT IN (
+			SELECT MIN(id) FROM logistics_status_events
+			WHERE status_at IS NULL
+			GROUP BY all_pay_logistics_id, status_code)`).Error; err != nil {
+		return err
+	}
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_logistics_event_once
+		ON logistics_status_events (all_pay_logistics_id, status_code, COALESCE(status_at, '1970-01-01 00:00:00+00'))`).Error
+}
+
+// orderIDFromMerchantTradeNo parses the order ID out of a RY-Tools style
+// MerchantTradeNo (<prefix><orderID>TS<suffix>). Returns 0 if it can't.
+func orderIDFromMerchantTradeNo(tradeNo string) int {
+	idx := strings.LastIndex(tradeNo, "TS")
+	if idx <= 0 {
+		return 0
+	}
+	head := tradeNo[:idx]
+	// Strip any non-numeric order prefix.
+	start := len(head)
+	for start > 0 && head[start-1] >= '0' && head[start-1] <= '9' {
+		start--
+	}
+	id, err := strconv.Atoi(head[start:])
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// parseEcpayTime parses ECPay's "2006/01/02 15:04:05" timestamps (Taipei time).
+func parseEcpayTime(raw string) *time.Time {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	for _, layout := range []string{"2006/01/02 15:04:05", "2006-01-02 15:04:05", "2006/01/02 15:04"} {
+		if t, err := time.ParseInLocation(layout, raw, taipeiLocation()); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// taipeiLocation returns Asia/Taipei, falling back to a fixed +08:00 zone on
+// systems without tzdata.
+func taipeiLocation() *time.Location {
+	tz, _ := time.LoadLocation("Asia/Taipei")
+	if tz == nil {
+		tz = time.FixedZone("CST", 8*3600)
+	}
+	return tz
+}
+
+// recordLogisticsEvent stores ev, ignoring exact repeats of an event already
+// stored. It reports whether a new row was written.
+func recordLogisticsEvent(db *gorm.DB, ev *LogisticsStatusEvent) (bool, error) {
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(ev)
+	return res.RowsAffected > 0, res.Error
+}
+
+// shipmentTimeline returns every status event for an order, matched by
+// order ID or by any logistics ID in its _ecpay_shipping_info, oldest first.
+func shipmentTimeline(db *gorm.DB, order *WooOrder) ([]LogisticsStatusEvent, error) {
+	var logisticsIDs []string
+	for id := range ecpayShippingMap(order) {
+		logisticsIDs = append(logisticsIDs, id)
+	}
+
+	query := db.Where("order_id = ?", order.ID)
+	if len(logisticsIDs) > 0 {
+		query = db.Where("order_id = ? OR all_pay_logistics_id IN ?", order.ID, logisticsIDs)
+	}
+
+	var events []LogisticsStatusEvent
+	if err := query.Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	at := func(ev LogisticsStatusEvent) time.Time {
+		if ev.StatusAt != nil {
+			return *ev.StatusAt
+		}
+		return ev.ReceivedAt
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return at(events[i]).Before(at(events[j]))
+	})
+	return events, nil
+}
+
+// ShipmentStatus is the latest known ECPay status of one shipment. Events
+// are kept in LogisticsStatusEvent; this row is what lists and the poller read.
+type ShipmentStatus struct {
+	AllPayLogisticsID string     `json:"logistics_id" gorm:"primaryKey"`
+	OrderID           int        `json:"order_id" gorm:"index"`
+	LogisticsSubType  string     `json:"sub_type"`
+	StatusCode        string     `json:"status_code"`
+	StatusMsg         string     `json:"status_msg"`
+	StatusAt          *time.Time `json:"status_at"`
+	TradeDate         *time.Time `json:"trade_date"` // when the shipment was created at ECPay
+	LastPolledAt      *time.Time `json:"last_polled_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	AwaitingDays int  `json:"awaiting_days,omitempty" gorm:"-"`
+	Stale        bool `json:"stale,omitempty" gorm:"-"`
+}
+
+// ecpayLogisticsStatusMessages covers the C2C status codes we act on. ECPay
+// sends RtnMsg with callbacks, but QueryLogisticsTradeInfo only returns codes.
+var ecpayLogisticsStatusMessages = map[string]string{
+	"300":  "訂單處理中(已收到訂單資料)",
+	"310":  "上傳電子訂單檔處理中",
+	"2030": "物流中心驗收成功",
+	"2063": "商品配達買家取貨門市",
+	"2067": "消費者成功取件",
+	"2068": "交貨便收件(賣家已至門市寄件)",
+	"2073": "商品配達買家取貨門市",
+	"2074": "消費者七天未取，商品離開買家取貨門市",
+	"3018": "到店尚未取貨，簡訊通知取件",
+	"3022": "買家已到店取貨",
+	"3024": "貨件已至物流中心",
+	"3032": "賣家已到門市寄件",
+}
+
+// shipmentAwaitingDropOff reports whether a status code means the seller has
+// not handed the parcel to the store yet.
+func shipmentAwaitingDropOff(code string) bool {
+	return code == "300" || code == "310"
+}
+
+// shipmentClosed reports whether a status code is final (picked up), so the
+// poller can stop asking about it.
+func shipmentClosed(code string) bool {
+	return code == "2067" || code == "3022"
+}
+
+// applyShipmentStatus moves a shipment's latest status forward. An update
+// whose timestamp is older than the stored one is ignored. It reports whether
+// the status code changed.
+func applyShipmentStatus(db *gorm.DB, update ShipmentStatus) (bool, error) {
+	changed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current ShipmentStatus
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&current, "all_pay_logistics_id = ?", update.AllPayLogisticsID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			changed = update.StatusCode != ""
+			return tx.Create(&update).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if update.OrderID != 0 {
+			current.OrderID = update.OrderID
+		}
+		if update.LogisticsSubType != "" {
+			current.LogisticsSubType = update.LogisticsSubType
+		}
+		if update.TradeDate != nil {
+			current.TradeDate = update.TradeDate
+		}
+		if update.LastPolledAt != nil {
+			current.LastPolledAt = update.LastPolledAt
+		}
+		stale := update.StatusAt != nil && current.StatusAt != nil && update.StatusAt.Before(*current.StatusAt)
+		if update.StatusCode != "" && !stale {
+			changed = update.StatusCode != current.StatusCode
+			current.StatusCode = update.StatusCode
+			current.StatusMsg = update.StatusMsg
+			if update.StatusAt != nil {
+				current.StatusAt = update.StatusAt
+			}
+		}
+		return tx.Save(&current).Error
+	})
+	return changed, err
+}
+
+// shipmentStatusesForOrders returns the status of each order's active
+// shipment (see getEcpayShippingInfo), keyed by order ID. Shipments still
+// waiting for drop-off longer than staleDays are flagged Stale.
+func shipmentStatusesForOrders(db *gorm.DB, orders []WooOrder, staleDays int) (map[int]*ShipmentStatus, error) {
+	activeByOrder := make(map[int]string)
+	var logisticsIDs []string
+	for i := range orders {
+		if info := getEcpayShippingInfo(&orders[i]); info != nil {
+			activeByOrder[orders[i].ID] = info.LogisticsID
+			logisticsIDs = append(logisticsIDs, info.LogisticsID)
+		}
+	}
+	result := make(map[int]*ShipmentStatus)
+	if len(logisticsIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []ShipmentStatus
+	if err := db.Where("all_pay_logistics_id IN ?", logisticsIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*ShipmentStatus, len(rows))
+	for i := range rows {
+		byID[rows[i].AllPayLogisticsID] = &rows[i]
+	}
+
+	now := time.Now()
+	for orderID, logisticsID := range activeByOrder {
+		st, ok := byID[logisticsID]
+		if !ok {
+			continue
+		}
+		if shipmentAwaitingDropOff(st.StatusCode) {
+			since := st.CreatedAt
+			if st.TradeDate != nil {
+				since = *st.TradeDate
+			}
+			st.AwaitingDays = int(now.Sub(since).Hours() / 24)
+			st.Stale = st.AwaitingDays >= staleDays
+		}
+		result[orderID] = st
+	}
+	return result, nil
+}
+
+// shipmentStaleDays reads SHIPMENT_STALE_DAYS (default 3).
+func shipmentStaleDays() int {
+	if raw := os.Getenv("SHIPMENT_STALE_DAYS"); raw != "" {
+		if days, err := strconv.Atoi(raw); err == nil && days > 0 {
+			return days
+		}
+	}
+	return 3
+}
+
+// ShipmentPollResult summarises one ShipmentPoller run.
+type ShipmentPollResult struct {
+	Polled  int      `json:"polled"`
+	Changed int      `json:"changed"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// ShipmentPoller asks ECPay for the status of every open shipment on the
+// dashboard's orders, for parcels whose callbacks never reached us.
+type ShipmentPoller struct {
+	db       *gorm.DB
+	ecpay    *EcpayClient
+	orders   *OrderSyncer
+	interval time.Duration
+
+	mu sync.Mutex // serialises poll runs
+}
+
+// newShipmentPoller reads ECPAY_POLL_INTERVAL_MINUTES (default 60, 0 disables
+// the background loop).
+func newShipmentPoller(db *gorm.DB, ecpay *EcpayClient, orders *OrderSyncer) *ShipmentPoller {
+	p := &ShipmentPoller{db: db, ecpay: ecpay, orders: orders, interval: time.Hour}
+	if raw := os.Getenv("ECPAY_POLL_INTERVAL_MINUTES"); raw != "" {
+		if mins, err := strconv.Atoi(raw); err == nil && mins >= 0 {
+			p.interval = time.Duration(mins) * time.Minute
+		}
+	}
+	return p
+}
+
+// Run polls in the background until ctx is done.
+func (p *ShipmentPoller) Run(ctx context.Context) {
+	if p.interval == 0 || !p.ecpay.configured() {
+		log.Printf("[shipment-poll] 背景查詢已停用")
+		return
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := p.PollNow(ctx); err != nil {
+			log.Printf("[shipment-poll] 查詢失敗：%v", err)
+		}
+	}
+}
+
+// PollNow queries ECPay once for every open shipment.
+func (p *ShipmentPoller) PollNow(ctx context.Context) (ShipmentPollResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := ShipmentPollResult{}
+	if !p.ecpay.configured() {
+		return result, errors.New("ECPay credentials not configured")
+	}
+
+	var orders []WooOrder
+	for _, status := range cachedOrderStatuses {
+		batch, err := p.orders.fetchOrdersByStatus(ctx, status)
+		if err != nil {
+			return result, err
+		}
+		orders = append(orders, batch...)
+	}
+	statuses, err := shipmentStatusesForOrders(p.db, orders, shipmentStaleDays())
+	if err != nil {
+		return result, err
+	}
+
+	for i := range orders {
+		info := getEcpayShippingInfo(&orders[i])
+		if info == nil {
+			continue
+		}
+		if st, ok := statuses[orders[i].ID]; ok && shipmentClosed(st.StatusCode) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		changed, err := p.pollOne(ctx, orders[i].ID, info)
+		result.Polled++
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("order %d (%s): %v", orders[i].ID, info.LogisticsID, err))
+			continue
+		}
+		if changed {
+			result.Changed++
+		}
+	}
+	log.Printf("[shipment-poll] 完成：查詢 %d 筆，狀態變更 %d 筆，失敗 %d 筆", result.Polled, result.Changed, result.Failed)
+	return result, nil
+}
+
+func (p *ShipmentPoller) pollOne(ctx context.Context, orderID int, info *ecpayShippingInfo) (bool, error) {
+	values, err := p.ecpay.queryLogisticsTradeInfo(ctx, info.LogisticsID)
+	if err != nil {
+		return false, err
+	}
+
+	code := values.Get("LogisticsStatus")
+	now := time.Now()
+	update := ShipmentStatus{
+		AllPayLogisticsID: info.LogisticsID,
+		OrderID:           orderID,
+		LogisticsSubType:  info.LogisticsSubType,
+		StatusCode:        code,
+		StatusMsg:         ecpayLogisticsStatusMessages[code],
+		StatusAt:          parseEcpayTime(values.Get("UpdateStatusDate")),
+		TradeDate:         parseEcpayTime(values.Get("TradeDate")),
+		LastPolledAt:      &now,
+	}
+	changed, err := applyShipmentStatus(p.db, update)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		// Polls carry no per-event timestamp, so only record transitions.
+		_, err = recordLogisticsEvent(p.db, &LogisticsStatusEvent{
+			OrderID:           orderID,
+			AllPayLogisticsID: info.LogisticsID,
+			MerchantTradeNo:   values.Get("MerchantTradeNo"),
+			LogisticsSubType:  info.LogisticsSubType,
+			StatusCode:        code,
+			StatusMsg:         update.StatusMsg,
+			StatusAt:          update.StatusAt,
+			Source:            "poll",
+			Payload:           values.Encode(),
+		})
+	}
+	return changed, err
+}
+
+// refusedError reports that an operation was refused because of the state
+// of the order or shipment, as opposed to ECPay/WC failing. Handlers map it
+// to 409.
+type refusedError struct {
+	reason string
+}
+
+func (e *refusedError) Error() string {
+	return e.reason
+}
+
+// CancelShipmentResult reports a successful cancellation.
+type CancelShipmentResult struct {
+	OrderID     int    `json:"order_id"`
+	LogisticsID string `json:"logistics_id"`
+	VoidedAt    string `json:"voided_at"`
+}
+
+// cancelSupersededShipment voids a 7-11 C2C shipment that a reissue left
+// behind: it is cancelled at ECPay and its _ecpay_shipping_info entry is
+// marked voided. The active shipment, and any parcel already dropped off,
+// is refused.
+func cancelSupersededShipment(ctx context.Context, db *gorm.DB, woo *WooClient, ecpay *EcpayClient, orderID int, logisticsID string) (CancelShipmentResult, error) {
+	result := CancelShipmentResult{OrderID: orderID, LogisticsID: logisticsID}
+	if !ecpay.configured() {
+		return result, errors.New("ECPay credentials not configured")
+	}
+
+	order, err := woo.fetchSingleOrder(ctx, orderID)
+	if err != nil {
+		return result, fmt.Errorf("fetch order: %w", err)
+	}
+
+	mergedMap := ecpayShippingMap(&order)
+	raw, ok := mergedMap[logisticsID]
+	if !ok {
+		return result, &refusedError{fmt.Sprintf("訂單 %d 沒有物流單 %s", orderID, logisticsID)}
+	}
+	entry, ok := raw.(map[string]interface{})
+	if !ok {
+		return result, fmt.Errorf("unexpected _ecpay_shipping_info entry for %s", logisticsID)
+	}
+	if ecpayEntryVoided(entry) {
+		return result, &refusedError{"此物流單已作廢"}
+	}
+	if active := getEcpayShippingInfo(&order); active != nil && active.LogisticsID == logisticsID {
+		return result, &refusedError{"此物流單為目前使用中的物流單，不可作廢"}
+	}
+	subType, _ := entry["LogisticsSubType"].(string)
+	if subType != "UNIMARTC2C" {
+		return result, &refusedError{fmt.Sprintf("綠界僅支援取消 7-11 交貨便（目前：%s）", subType)}
+	}
+	paymentNo, _ := entry["PaymentNo"].(string)
+	validationNo, _ := entry["ValidationNo"].(string)
+
+	// Ask ECPay rather than trusting our copy: the parcel may have been
+	// dropped off since the last callback or poll.
+	values, err := ecpay.queryLogisticsTradeInfo(ctx, logisticsID)
+	if err != nil {
+		return result, fmt.Errorf("query status: %w", err)
+	}
+	code := values.Get("LogisticsStatus")
+	if !shipmentAwaitingDropOff(code) {
+		msg := ecpayLogisticsStatusMessages[code]
+		if msg == "" {
+			msg = code
+		}
+		return result, &refusedError{fmt.Sprintf("物流單 %s 目前狀態為「%s」，已寄件的包裹不可取消", logisticsID, msg)}
+	}
+
+	log.Printf("[cancel-shipment] order=%d LogisticsID=%s PaymentNo=%s", orderID, logisticsID, paymentNo)
+
+	// From here on nothing is cancelled with the caller.
+	writeCtx := context.WithoutCancel(ctx)
+	if err := ecpay.cancelC2COrder(writeCtx, logisticsID, paymentNo, validationNo); err != nil {
+		log.Printf("[cancel-shipment] order=%d LogisticsID=%s ECPay 取消失敗：%v", orderID, logisticsID, err)
+		return result, err
+	}
+	log.Printf("[cancel-shipment] order=%d LogisticsID=%s ECPay 已取消", orderID, logisticsID)
+
+	now := time.Now()
+	result.VoidedAt = now.In(taipeiLocation()).Format("2006-01-02T15:04:05-07:00")
+	entry["voided"] = true
+	entry["voided_at"] = result.VoidedAt
+	mergedMap[logisticsID] = entry
+	if err := woo.putOrderMeta(writeCtx, orderID, []map[string]interface{}{
+		{"key": "_ecpay_shipping_info", "value": mergedMap},
+	}); err != nil {
+		return result, fmt.Errorf("ECPay 已取消，但寫回 WooCommerce 失敗：%w", err)
+	}
+
+	if _, err := recordLogisticsEvent(db, &LogisticsStatusEvent{
+		OrderID:           orderID,
+		AllPayLogisticsID: logisticsID,
+		LogisticsSubType:  subType,
+		StatusCode:        "voided",
+		StatusMsg:         "已取消物流單",
+		StatusAt:          &now,
+		Source:            "cancel",
+	}); err != nil {
+		log.Printf("[cancel-shipment] order=%d 記錄物流事件失敗：%v", orderID, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,279 @@
+//go:build ignore
+
+// gen_upload_fixtures writes the upload fixtures read by
+// upload_formats_test.go. Run it from this directory:
+//
+//	go run gen_upload_fixtures.go
+//
+// upload_orders.xls is a BIFF8 workbook in a compound file, built by hand
+// since there is no .xls writer to use: an instructions sheet, a chart
+// sheet and the active 訂單 sheet. Its cells use every record type the
+// reader handles (LABELSST, LABEL, NUMBER, RK, MULRK, FORMULA+STRING) and
+// the shared string table runs on into a CONTINUE record mid-string.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var header = []string{"訂單編號", "訂購日期", "收件人", "取件地址", "商品名稱", "單價", "優惠價", "數量", "備註"}
+
+func main() {
+	write("upload_orders.xls", buildXLS())
+
+	// Excel's "CSV" in a zh-TW locale: Big5, CRLF.
+	big5, err := traditionalchinese.Big5.NewEncoder().String(
+		"訂單編號,訂購日期,收件人,取件地址,商品名稱,單價,優惠價,數量,備註\r\n" +
+			"A001,2026/10/01 10:00:00,王小明,台北市信義區,茶,100,90,2,\r\n")
+	check(err)
+	write("upload_orders_big5.csv", []byte(big5))
+
+	// Excel's "CSV UTF-8": BOM, dates without seconds, quoted fields.
+	write("upload_orders_bom.csv", []byte("\xEF\xBB\xBF"+
+		"訂單編號,訂購日期,收件人,取件地址,商品名稱,單價,優惠價,數量,備註\r\n"+
+		"A001,2026/10/1 10:00,王小明,\"台北市信義區, 松高路\",茶,\"1,200\",90,2,\"請傍晚送達\"\"謝謝\"\"\"\r\n"))
+
+	write("upload_orders.tsv", []byte(
+		"訂單編號\t訂購日期\t收件人\t取件地址\t商品名稱\t單價\t優惠價\t數量\t備註\n"+
+			"A001\t2026-10-01 10:00:00\t王小明\t台北市信義區, 松高路\t茶\t100\t90\t2\t\n"))
+
+	// Excel's "Unicode text": UTF-16LE with BOM, tab-delimited.
+	utf16le, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String(
+		"訂單編號\t訂購日期\t收件人\t取件地址\t商品名稱\t單價\t優惠價\t數量\t備註\r\n" +
+			"A001\t2026/10/01 10:00:00\t王小明\t台北市信義區\t茶\t100\t90\t2\t\r\n")
+	check(err)
+	write("upload_orders_utf16.txt", []byte(utf16le))
+}
+
+func write(name string, data []byte) {
+	check(os.WriteFile(name, data, 0o644))
+}
+
+func check(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func record(buf *bytes.Buffer, typ uint16, data []byte) {
+	binary.Write(buf, binary.LittleEndian, typ)
+	binary.Write(buf, binary.LittleEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+// le packs fixed-size values little-endian.
+func le(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// xlString is an XLUnicodeString: 16-bit length, flags, then 8-bit
+// characters if they all fit, else UTF-16.
+func xlString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	return append(le(uint16(len(units))), xlChars(units)...)
+}
+
+func xlChars(units []uint16) []byte {
+	for _, u := range units {
+		if u > 0xFF {
+			return append([]byte{1}, le(units)...)
+		}
+	}
+	b := []byte{0}
+	for _, u := range units {
+		b = append(b, byte(u))
+	}
+	return b
+}
+
+func bof(dt uint16) []byte {
+	return le(uint16(0x0600), dt, uint16(0x0DBB), uint16(0x07CC), uint32(0), uint32(0x06))
+}
+
+func rk(v int32, div100 bool) uint32 {
+	r := uint32(v)<<2 | 0x02
+	if div100 {
+		r |= 0x01
+	}
+	return r
+}
+
+// serial is an Excel serial date for a day of October 2026 plus a fraction.
+func serial(day int, hour float64) float64 {
+	return 46296 + float64(day-1) + hour/24 // 46296 is 2026-10-01
+}
+
+func buildXLS() []byte {
+	sst := []string{}
+	sstIndex := map[string]uint32{}
+	s := func(v string) uint32 {
+		if i, ok := sstIndex[v]; ok {
+			return i
+		}
+		sstIndex[v] = uint32(len(sst))
+		sst = append(sst, v)
+		return sstIndex[v]
+	}
+
+	// Instructions sheet, first in the tab order.
+	var intro bytes.Buffer
+	record(&intro, 0x0809, bof(0x0010))
+	record(&intro, 0x00FD, le(uint16(0), uint16(0), uint16(15), s("請見訂單工作表")))
+	record(&intro, 0x000A, nil)
+
+	var chart bytes.Buffer
+	record(&chart, 0x0809, bof(0x0020))
+	record(&chart, 0x000A, nil)
+
+	longNote := "這是一段很長的備註，用來測試共用字串表跨越 CONTINUE 記錄的情況。"
+	var sheet bytes.Buffer
+	record(&sheet, 0x0809, bof(0x0010))
+	for col, h := range header {
+		record(&sheet, 0x00FD, le(uint16(0), uint16(col), uint16(15), s(h)))
+	}
+	// Row 1: text order number, date and time as NUMBER, an inline LABEL,
+	// the prices and quantity as one MULRK, a formula with a string result.
+	record(&sheet, 0x00FD, le(uint16(1), uint16(0), uint16(15), s("A001")))
+	record(&sheet, 0x0203, le(uint16(1), uint16(1), uint16(16), serial(1, 10)))
+	record(&sheet, 0x0204, append(le(uint16(1), uint16(2), uint16(15)), xlString("王小明")...))
+	record(&sheet, 0x00FD, le(uint16(1), uint16(3), uint16(15), s("台北市信義區")))
+	record(&sheet, 0x00FD, le(uint16(1), uint16(4), uint16(15), s("茶")))
+	record(&sheet, 0x00BD, le(uint16(1), uint16(5),
+		uint16(15), rk(100, false), uint16(15), rk(90, false), uint16(15), rk(2, false), uint16(7)))
+	record(&sheet, 0x0006, le(uint16(1), uint16(8), uint16(15),
+		[]byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF}, uint16(0), uint32(0), uint16(0)))
+	record(&sheet, 0x0207, xlString("請傍晚送達"))
+	// Row 2: numeric order number, a date-only RK, RK and NUMBER prices
+	// with cents, and a note that is split across the SST's CONTINUE.
+	record(&sheet, 0x0203, le(uint16(2), uint16(0), uint16(15), float64(20261001123)))
+	record(&sheet, 0x027E, le(uint16(2), uint16(1), uint16(16), rk(int32(serial(2, 0)), false)))
+	record(&sheet, 0x00FD, le(uint16(2), uint16(2), uint16(15), s("陳小華")))
+	record(&sheet, 0x00FD, le(uint16(2), uint16(3), uint16(15), s("台中市西屯區")))
+	record(&sheet, 0x00FD, le(uint16(2), uint16(4), uint16(15), s("茶")))
+	record(&sheet, 0x027E, le(uint16(2), uint16(5), uint16(15), rk(1250, true)))
+	record(&sheet, 0x0203, le(uint16(2), uint16(6), uint16(15), 12.5))
+	record(&sheet, 0x027E, le(uint16(2), uint16(7), uint16(15), rk(3, false)))
+	record(&sheet, 0x00FD, le(uint16(2), uint16(8), uint16(15), s(longNote)))
+	record(&sheet, 0x000A, nil)
+
+	// The SST, cut in the middle of the last string's characters. The
+	// CONTINUE starts with the flags byte of the rest.
+	var sstData bytes.Buffer
+	sstData.Write(le(uint32(len(sst)+1), uint32(len(sst))))
+	for _, v := range sst[:len(sst)-1] {
+		sstData.Write(xlString(v))
+	}
+	lastUnits := utf16.Encode([]rune(sst[len(sst)-1]))
+	sstData.Write(le(uint16(len(lastUnits)), uint8(1)))
+	sstData.Write(le(lastUnits[:10]))
+	cont := append([]byte{1}, le(lastUnits[10:])...)
+
+	sheets := []struct {
+		name string
+		dt   byte
+		data []byte
+	}{{"說明", 0, intro.Bytes()}, {"圖表", 2, chart.Bytes()}, {"訂單", 0, sheet.Bytes()}}
+
+	globals := func(offsets []uint32) []byte {
+		var g bytes.Buffer
+		record(&g, 0x0809, bof(0x0005))
+		// WINDOW1: the third tab, 訂單, is active.
+		record(&g, 0x003D, le(uint16(0), uint16(0), uint16(0x4000), uint16(0x2000), uint16(0x38),
+			uint16(2), uint16(0), uint16(1), uint16(600)))
+		for i, sh := range sheets {
+			units := utf16.Encode([]rune(sh.name))
+			record(&g, 0x0085, append(le(offsets[i], uint8(0), sh.dt, uint8(len(units))), xlChars(units)...))
+		}
+		record(&g, 0x00FC, sstData.Bytes())
+		record(&g, 0x003C, cont)
+		record(&g, 0x000A, nil)
+		return g.Bytes()
+	}
+	offsets := make([]uint32, len(sheets))
+	pos := uint32(len(globals(offsets)))
+	for i, sh := range sheets {
+		offsets[i] = pos
+		pos += uint32(len(sh.data))
+	}
+	var workbook bytes.Buffer
+	workbook.Write(globals(offsets))
+	for _, sh := range sheets {
+		workbook.Write(sh.data)
+	}
+	return compoundFile("Workbook", workbook.Bytes())
+}
+
+const (
+	freeSect   = 0xFFFFFFFF
+	endOfChain = 0xFFFFFFFE
+	fatSect    = 0xFFFFFFFD
+	noStream   = 0xFFFFFFFF
+)
+
+// compoundFile wraps one stream in a version 3 compound file: a header,
+// one FAT sector, one directory sector, then the stream, padded to the
+// 4096-byte mini stream cutoff so it lives in regular sectors.
+func compoundFile(name string, stream []byte) []byte {
+	const sectorSize = 512
+	if len(stream) < 4096 {
+		stream = append(stream, make([]byte, 4096-len(stream))...)
+	}
+	streamSectors := (len(stream) + sectorSize - 1) / sectorSize
+	stream = append(stream, make([]byte, streamSectors*sectorSize-len(stream))...)
+
+	var out bytes.Buffer
+	out.Write([]byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	out.Write(make([]byte, 16)) // CLSID
+	out.Write(le(uint16(0x003E), uint16(0x0003), uint16(0xFFFE), uint16(9), uint16(6)))
+	out.Write(make([]byte, 6))
+	out.Write(le(uint32(0), uint32(1), uint32(1), uint32(0), uint32(4096),
+		uint32(endOfChain), uint32(0), uint32(endOfChain), uint32(0)))
+	difat := make([]uint32, 109)
+	for i := range difat {
+		difat[i] = freeSect
+	}
+	difat[0] = 0
+	out.Write(le(difat))
+
+	fat := make([]uint32, sectorSize/4)
+	for i := range fat {
+		fat[i] = freeSect
+	}
+	fat[0] = fatSect
+	fat[1] = endOfChain
+	for i := 0; i < streamSectors; i++ {
+		fat[2+i] = uint32(3 + i)
+	}
+	fat[1+streamSectors] = endOfChain
+	out.Write(le(fat))
+
+	entry := func(name string, typ uint8, child, start, size uint32) []byte {
+		units := utf16.Encode([]rune(name))
+		nameBytes := make([]byte, 64)
+		copy(nameBytes, le(units))
+		nameLen := uint16(0)
+		if name != "" {
+			nameLen = uint16(len(units)+1) * 2
+		}
+		return append(nameBytes, le(nameLen, typ, uint8(1), uint32(noStream), uint32(noStream), child,
+			make([]byte, 16), uint32(0), uint64(0), uint64(0), start, uint64(size))...)
+	}
+	out.Write(entry("Root Entry", 5, 1, endOfChain, 0))
+	out.Write(entry(name, 2, noStream, 2, uint32(len(stream))))
+	out.Write(entry("", 0, noStream, 0, 0))
+	out.Write(entry("", 0, noStream, 0, 0))
+
+	out.Write(stream)
+	return out.Bytes()
+}
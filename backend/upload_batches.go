@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// UploadRowChange logs what one upload batch did to one stored row, so the
+// batch can be rolled back.
+type UploadRowChange struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	BatchID         uint      `json:"batch_id" gorm:"index"`
+	UploadedOrderID uint      `json:"uploaded_order_id" gorm:"index"`
+	Action          string    `json:"action"`             // insert, update or delete
+	Before          string    `json:"-" gorm:"type:text"` // JSON of the row before an update or delete
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// UploadBatchRow is one row a batch inserted, updated or deleted.
+type UploadBatchRow struct {
+	Action  string         `json:"action"`
+	Current *UploadedOrder `json:"current"` // nil once the row is gone
+	Before  *UploadedOrder `json:"before,omitempty"`
+}
+
+// uploadedBy identifies who uploaded: the uploaded_by form field or query
+// parameter, or else the client IP.
+func uploadedBy(c *gin.Context) string {
+	if by := strings.TrimSpace(c.PostForm("uploaded_by")); by != "" {
+		return by
+	}
+	if by := strings.TrimSpace(c.Query("uploaded_by")); by != "" {
+		return by
+	}
+	return c.ClientIP()
+}
+
+// findDuplicateUploadBatch returns the latest batch, not rolled back, that
+// stored a file with the same hash, or 0.
+func findDuplicateUploadBatch(db *gorm.DB, fileHash string, isShipping bool) uint {
+	var batch UploadBatch
+	err := db.Where("file_hash = ? AND is_shipping = ? AND rolled_back_at IS NULL", fileHash, isShipping).
+		Order("uploaded_at desc").First(&batch).Error
+	if err != nil {
+		return 0
+	}
+	return batch.ID
+}
+
+// uploadBatchRows lists what batch id did, with each row as it is now.
+func uploadBatchRows(db *gorm.DB, id uint) ([]UploadBatchRow, error) {
+	var changes []UploadRowChange
+	if err := db.Where("batch_id = ?", id).Order("id").Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(changes))
+	for i, ch := range changes {
+		ids[i] = ch.UploadedOrderID
+	}
+	var current []UploadedOrder
+	if len(ids) > 0 {
+		if err := db.Where("id IN ?", ids).Find(&current).Error; err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[uint]*UploadedOrder, len(current))
+	for i := range current {
+		byID[current[i].ID] = &current[i]
+	}
+
+	rows := make([]UploadBatchRow, 0, len(changes))
+	for _, ch := range changes {
+		row := UploadBatchRow{Action: ch.Action, Current: byID[ch.UploadedOrderID]}
+		if ch.Before != "" {
+			var before UploadedOrder
+			if err := json.Unmarshal([]byte(ch.Before), &before); err == nil {
+				row.Before = &before
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// rollbackUploadBatch undoes batch id: rows it inserted are deleted, rows
+// it updated get their previous values back and rows it deleted are stored
+// again. It is refused if the batch was already rolled back or a later
+// upload has since changed one of its rows, or stored a deleted line again;
+// that upload has to be rolled back first. Rows cleared in the meantime are
+// left alone.
+func rollbackUploadBatch(db *gorm.DB, id uint) (*UploadBatch, error) {
+	var batch UploadBatch
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&batch, id).Error; err != nil {
+			return err
+		}
+		if batch.RolledBackAt != nil {
+			return &refusedError{fmt.Sprintf("批次 #%d 已於 %s 復原", id, batch.RolledBackAt.In(taipeiLocation()).Format("2006-01-02 15:04"))}
+		}
+
+		var changes []UploadRowChange
+		if err := tx.Where("batch_id = ?", id).Order("id desc").Find(&changes).Error; err != nil {
+			return err
+		}
+		refuse := func(later UploadedOrder) error {
+			by := "其他操作"
+			if later.BatchID != nil {
+				by = fmt.Sprintf("批次 #%d", *later.BatchID)
+			}
+			return &refusedError{fmt.Sprintf("訂單 %s 的 %s 已被%s更新，請先復原較新的批次", later.OrderNo, later.ProductName, by)}
+		}
+		for _, ch := range changes {
+			if ch.Action == "delete" {
+				var before UploadedOrder
+				if err := json.Unmarshal([]byte(ch.Before), &before); err != nil {
+					return fmt.Errorf("批次 #%d 的變更紀錄 #%d 無法解析：%w", id, ch.ID, err)
+				}
+				var later UploadedOrder
+				err := tx.Where("is_shipping = ? AND order_no = ? AND line_key = ?", before.IsShipping, before.OrderNo, before.LineKey).
+					First(&later).Error
+				if err == nil {
+					return refuse(later)
+				}
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+				if err := tx.Create(&before).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			var current UploadedOrder
+			err := tx.First(&current, ch.UploadedOrderID).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if current.BatchID == nil || *current.BatchID != id {
+				return refuse(current)
+			}
+
+			switch ch.Action {
+			case "insert":
+				if err := tx.Delete(&UploadedOrder{}, current.ID).Error; err != nil {
+					return err
+				}
+			case "update":
+				var before UploadedOrder
+				if err := json.Unmarshal([]byte(ch.Before), &before); err != nil {
+					return fmt.Errorf("批次 #%d 的變更紀錄 #%d 無法解析：%w", id, ch.ID, err)
+				}
+				if err := tx.Save(&before).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		now := time.Now()
+		batch.RolledBackAt = &now
+		return tx.Model(&batch).Update("rolled_back_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// registerUploadBatchRoutes adds the upload history endpoints.
+func registerUploadBatchRoutes(r *gin.Engine, db *gorm.DB) {
+	r.GET("/orders/upload-batches", func(c *gin.Context) {
+		query := db.Order("uploaded_at desc, id desc")
+		if raw := c.Query("is_shipping"); raw != "" {
+			query = query.Where("is_shipping = ?", raw == "true")
+		}
+		limit := 100
+		if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		var batches []UploadBatch
+		if err := query.Limit(limit).Find(&batches).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, batches)
+	})
+
+	r.GET("/orders/upload-batches/:id/rows", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+			return
+		}
+		var batch UploadBatch
+		if err := db.First(&batch, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "找不到上傳批次"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := uploadBatchRows(db, batch.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"batch": batch, "rows": rows})
+	})
+
+	r.DELETE("/orders/upload-batches/:id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+			return
+		}
+		batch, err := rollbackUploadBatch(db, uint(id))
+		var refused *refusedError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到上傳批次"})
+			return
+		case errors.As(err, &refused):
+			c.JSON(http.StatusConflict, gin.H{"error": refused.reason})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, batch)
+	})
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/richardlehane/mscfb"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// uploadExtensions are the file types the upload handlers accept.
+var uploadExtensions = []string{".xlsx", ".xls", ".csv"}
+
+func isUploadFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range uploadExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	oleMagic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+)
+
+// readUploadRows returns the name and cell text of the sheet to import. The
+// format is taken from the content rather than the extension, since
+// exports are often saved with the wrong one; anything that is neither an
+// .xlsx nor an .xls workbook is read as CSV.
+func readUploadRows(data []byte, filename string) (string, [][]string, error) {
+	switch {
+	case bytes.HasPrefix(data, zipMagic):
+		return readXLSXRows(data)
+	case bytes.HasPrefix(data, oleMagic):
+		return readXLSRows(data)
+	default:
+		rows, err := readCSVRows(data)
+		return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)), rows, err
+	}
+}
+
+// readXLSXRows reads the active sheet of an .xlsx workbook.
+func readXLSXRows(data []byte) (string, [][]string, error) {
+	xl, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("解析檔案失敗：%v", err)
+	}
+	defer xl.Close()
+
+	sheetName := xl.GetSheetName(xl.GetActiveSheetIndex())
+	if sheetName == "" {
+		return "", nil, fmt.Errorf("找不到有效的工作表")
+	}
+	rows, err := xl.GetRows(sheetName)
+	if err != nil {
+		return "", nil, fmt.Errorf("讀取工作表資料失敗")
+	}
+	return sheetName, rows, nil
+}
+
+// readCSVRows decodes a CSV export (UTF-8 with or without BOM, UTF-16 with
+// BOM, or else Big5) and splits it on the sniffed delimiter.
+func readCSVRows(data []byte) ([][]string, error) {
+	text, err := decodeCSVText(data)
+	if err != nil {
+		return nil, fmt.Errorf("無法辨識檔案編碼：%v", err)
+	}
+
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma = sniffCSVDelimiter(text)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("解析 CSV 失敗：%v", err)
+	}
+	return rows, nil
+}
+
+func decodeCSVText(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}), bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		// Excel's "Unicode text" export.
+		decoded, err := unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder().Bytes(data)
+		return string(decoded), err
+	case utf8.Valid(data):
+		return string(data), nil
+	default:
+		decoded, err := traditionalchinese.Big5.NewDecoder().Bytes(data)
+		return string(decoded), err
+	}
+}
+
+// sniffCSVDelimiter picks the candidate that splits the first lines into
+// the most fields, counting only separators outside quotes. A header row
+// is enough to decide, so only a few lines are looked at.
+func sniffCSVDelimiter(text string) rune {
+	candidates := []rune{',', '\t', ';', '|'}
+	counts := make(map[rune]int, len(candidates))
+	inQuotes := false
+	lines := 0
+	for _, ch := range text {
+		switch {
+		case ch == '"':
+			inQuotes = !inQuotes
+		case ch == '\n' && !inQuotes:
+			lines++
+		default:
+			if !inQuotes {
+				counts[ch]++
+			}
+		}
+		if lines >= 5 {
+			break
+		}
+	}
+
+	best := ','
+	for _, c := range candidates {
+		if counts[c] > counts[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// BIFF8 record types read by readXLSRows.
+const (
+	biffBOF        = 0x0809
+	biffEOF        = 0x000A
+	biffFilePass   = 0x002F
+	biffBoundSheet = 0x0085
+	biffWindow1    = 0x003D
+	biffSST        = 0x00FC
+	biffContinue   = 0x003C
+	biffLabelSST   = 0x00FD
+	biffLabel      = 0x0204
+	biffNumber     = 0x0203
+	biffRK         = 0x027E
+	biffMulRK      = 0x00BD
+	biffFormula    = 0x0006
+	biffString     = 0x0207
+	biffBoolErr    = 0x0205
+)
+
+type biffRecord struct {
+	typ  uint16
+	data []byte
+}
+
+// readXLSRows reads the active sheet of a legacy Excel 97-2003 (.xls)
+// workbook. Numbers, dates included, come out as plain decimals, which
+// parseDateTime reads as Excel serial dates.
+func readXLSRows(data []byte) (string, [][]string, error) {
+	doc, err := mscfb.New(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("解析檔案失敗：%v", err)
+	}
+	var stream []byte
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		switch entry.Name {
+		case "Workbook":
+			if stream, err = io.ReadAll(entry); err != nil {
+				return "", nil, fmt.Errorf("解析檔案失敗：%v", err)
+			}
+		case "Book":
+			return "", nil, fmt.Errorf("不支援 Excel 95 以前的 .xls 格式，請另存為 .xlsx")
+		}
+		if stream != nil {
+			break
+		}
+	}
+	if stream == nil {
+		return "", nil, fmt.Errorf("找不到有效的工作表")
+	}
+
+	type sheetInfo struct {
+		name      string
+		offset    int
+		worksheet bool
+	}
+	var sheets []sheetInfo
+	var sst []string
+	active := 0
+	for offset := 0; offset < len(stream); {
+		rec, next, ok := readBiffRecord(stream, offset)
+		if !ok {
+			break
+		}
+		switch rec.typ {
+		case biffFilePass:
+			return "", nil, fmt.Errorf("檔案有密碼保護，請先移除密碼")
+		case biffBoundSheet:
+			// Every sheet counts towards the active tab index, but only
+			// worksheets (type 0) can be read; not charts or macro sheets.
+			if len(rec.data) >= 8 {
+				name, _ := readBiffShortString(rec.data[6:])
+				sheets = append(sheets, sheetInfo{
+					name:      name,
+					offset:    int(binary.LittleEndian.Uint32(rec.data)),
+					worksheet: rec.data[5] == 0,
+				})
+			}
+		case biffWindow1:
+			if len(rec.data) >= 12 {
+				active = int(binary.LittleEndian.Uint16(rec.data[10:]))
+			}
+		case biffSST:
+			chunks := [][]byte{rec.data}
+			for {
+				cont, after, ok := readBiffRecord(stream, next)
+				if !ok || cont.typ != biffContinue {
+					break
+				}
+				chunks = append(chunks, cont.data)
+				next = after
+			}
+			if sst, err = readBiffSST(chunks); err != nil {
+				return "", nil, fmt.Errorf("解析檔案失敗：%v", err)
+			}
+		}
+		offset = next
+		if rec.typ == biffEOF {
+			break
+		}
+	}
+	if active >= len(sheets) || !sheets[active].worksheet {
+		active = -1
+		for i, sh := range sheets {
+			if sh.worksheet {
+				active = i
+				break
+			}
+		}
+	}
+	if active < 0 {
+		return "", nil, fmt.Errorf("找不到有效的工作表")
+	}
+
+	rows, err := readBiffSheet(stream, sheets[active].offset, sst)
+	if err != nil {
+		return "", nil, fmt.Errorf("讀取工作表資料失敗：%v", err)
+	}
+	return sheets[active].name, rows, nil
+}
+
+func readBiffRecord(stream []byte, offset int) (biffRecord, int, bool) {
+	if offset+4 > len(stream) {
+		return biffRecord{}, offset, false
+	}
+	typ := binary.LittleEndian.Uint16(stream[offset:])
+	size := int(binary.LittleEndian.Uint16(stream[offset+2:]))
+	end := offset + 4 + size
+	if end > len(stream) {
+		return biffRecord{}, offset, false
+	}
+	return biffRecord{typ: typ, data: stream[offset+4 : end]}, end, true
+}
+
+// readBiffSheet collects the cell values of the sheet substream at offset.
+func readBiffSheet(stream []byte, offset int, sst []string) ([][]string, error) {
+	var rows [][]string
+	set := func(row, col int, value string) {
+		for len(rows) <= row {
+			rows = append(rows, nil)
+		}
+		for len(rows[row]) <= col {
+			rows[row] = append(rows[row], "")
+		}
+		rows[row][col] = value
+	}
+	number := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	rec, next, ok := readBiffRecord(stream, offset)
+	if !ok || rec.typ != biffBOF {
+		return nil, errors.New("工作表位置錯誤")
+	}
+	// pendingString is the cell whose formula result follows as a STRING record.
+	pendingString := [2]int{-1, -1}
+	for offset = next; ; offset = next {
+		rec, next, ok = readBiffRecord(stream, offset)
+		if !ok || rec.typ == biffEOF {
+			break
+		}
+		d := rec.data
+		if rec.typ == biffString {
+			if pendingString[0] >= 0 {
+				if s, err := readBiffString(d); err == nil {
+					set(pendingString[0], pendingString[1], s)
+				}
+				pendingString = [2]int{-1, -1}
+			}
+			continue
+		}
+		if len(d) < 6 {
+			continue
+		}
+		// Every cell record starts with its row and column.
+		row := int(binary.LittleEndian.Uint16(d))
+		col := int(binary.LittleEndian.Uint16(d[2:]))
+		switch rec.typ {
+		case biffLabelSST:
+			if len(d) >= 10 {
+				if i := int(binary.LittleEndian.Uint32(d[6:])); i < len(sst) {
+					set(row, col, sst[i])
+				}
+			}
+		case biffLabel:
+			if s, err := readBiffString(d[6:]); err == nil {
+				set(row, col, s)
+			}
+		case biffNumber:
+			if len(d) >= 14 {
+				set(row, col, number(math.Float64frombits(binary.LittleEndian.Uint64(d[6:]))))
+			}
+		case biffRK:
+			if len(d) >= 10 {
+				set(row, col, number(biffRKValue(binary.LittleEndian.Uint32(d[6:]))))
+			}
+		case biffMulRK:
+			for p := 4; p+6 <= len(d)-2; p += 6 {
+				set(row, col, number(biffRKValue(binary.LittleEndian.Uint32(d[p+2:]))))
+				col++
+			}
+		case biffFormula:
+			if len(d) < 14 {
+				continue
+			}
+			result := d[6:14]
+			if result[6] != 0xFF || result[7] != 0xFF {
+				set(row, col, number(math.Float64frombits(binary.LittleEndian.Uint64(result))))
+				continue
+			}
+			switch result[0] {
+			case 0: // string, in the next STRING record
+				pendingString = [2]int{row, col}
+			case 1:
+				set(row, col, strings.ToUpper(strconv.FormatBool(result[2] != 0)))
+			}
+		case biffBoolErr:
+			if len(d) >= 8 && d[7] == 0 {
+				set(row, col, strings.ToUpper(strconv.FormatBool(d[6] != 0)))
+			}
+		}
+	}
+	return rows, nil
+}
+
+// biffRKValue decodes an RK number: a 30-bit integer or the top 30 bits of
+// a float64, optionally divided by 100.
+func biffRKValue(rk uint32) float64 {
+	var v float64
+	if rk&0x02 != 0 {
+		v = float64(int32(rk) >> 2)
+	} else {
+		v = math.Float64frombits(uint64(rk&0xFFFFFFFC) << 32)
+	}
+	if rk&0x01 != 0 {
+		v /= 100
+	}
+	return v
+}
+
+// readBiffShortString reads a ShortXLUnicodeString (8-bit length).
+func readBiffShortString(d []byte) (string, error) {
+	if len(d) < 2 {
+		return "", errors.New("字串長度錯誤")
+	}
+	r := &biffReader{chunks: [][]byte{d[2:]}}
+	return r.chars(int(d[0]), d[1]&0x01 != 0)
+}
+
+// readBiffString reads an XLUnicodeString (16-bit length).
+func readBiffString(d []byte) (string, error) {
+	r := &biffReader{chunks: [][]byte{d}}
+	cch, err := r.u16()
+	if err != nil {
+		return "", err
+	}
+	flags, err := r.byte()
+	if err != nil {
+		return "", err
+	}
+	return r.chars(int(cch), flags&0x01 != 0)
+}
+
+// readBiffSST reads the shared string table, whose strings may run on into
+// the CONTINUE records that follow it.
+func readBiffSST(chunks [][]byte) ([]string, error) {
+	r := &biffReader{chunks: chunks}
+	if err := r.skip(4); err != nil { // total references
+		return nil, err
+	}
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		cch, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		flags, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		var runs, extLen int
+		if flags&0x08 != 0 {
+			n, err := r.u16()
+			if err != nil {
+				return nil, err
+			}
+			runs = int(n)
+		}
+		if flags&0x04 != 0 {
+			n, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			extLen = int(n)
+		}
+		s, err := r.chars(int(cch), flags&0x01 != 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skip(runs*4 + extLen); err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// biffReader reads across a record and its CONTINUE records.
+type biffReader struct {
+	chunks [][]byte
+	ci     int
+	pos    int
+}
+
+var errBiffShort = errors.New("記錄長度不足")
+
+func (r *biffReader) byte() (byte, error) {
+	for r.ci < len(r.chunks) && r.pos >= len(r.chunks[r.ci]) {
+		r.ci++
+		r.pos = 0
+	}
+	if r.ci >= len(r.chunks) {
+		return 0, errBiffShort
+	}
+	b := r.chunks[r.ci][r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *biffReader) u16() (uint16, error) {
+	lo, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	hi, err := r.byte()
+	return uint16(lo) | uint16(hi)<<8, err
+}
+
+func (r *biffReader) u32() (uint32, error) {
+	lo, err := r.u16()
+	if err != nil {
+		return 0, err
+	}
+	hi, err := r.u16()
+	return uint32(lo) | uint32(hi)<<16, err
+}
+
+func (r *biffReader) skip(n int) error {
+	for ; n > 0; n-- {
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chars reads cch characters, 16-bit if high else 8-bit. Character data
+// split across a CONTINUE record restarts with a flags byte that says
+// whether the rest is 8- or 16-bit.
+func (r *biffReader) chars(cch int, high bool) (string, error) {
+	var units []uint16
+	for len(units) < cch {
+		if r.ci >= len(r.chunks) {
+			return "", errBiffShort
+		}
+		chunk := r.chunks[r.ci]
+		if r.pos >= len(chunk) {
+			r.ci++
+			r.pos = 0
+			flags, err := r.byte()
+			if err != nil {
+				return "", err
+			}
+			high = flags&0x01 != 0
+			continue
+		}
+		if high {
+			if r.pos+2 > len(chunk) {
+				return "", errBiffShort
+			}
+			units = append(units, binary.LittleEndian.Uint16(chunk[r.pos:]))
+			r.pos += 2
+		} else {
+			units = append(units, uint16(chunk[r.pos]))
+			r.pos++
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
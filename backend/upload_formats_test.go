@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The fixtures are written by testdata/gen_upload_fixtures.go.
+
+func TestReadUploadRowsXLS(t *testing.T) {
+	sheet, rows, err := readUploadRows(readFixture(t, "upload_orders.xls"), "upload_orders.xls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 訂單 is the active tab, after an instructions sheet and a chart.
+	if sheet != "訂單" {
+		t.Errorf("sheet = %q, want 訂單", sheet)
+	}
+	want := [][]string{
+		{"訂單編號", "訂購日期", "收件人", "取件地址", "商品名稱", "單價", "優惠價", "數量", "備註"},
+		{"A001", "46296.416666666664", "王小明", "台北市信義區", "茶", "100", "90", "2", "請傍晚送達"},
+		{"20261001123", "46297", "陳小華", "台中市西屯區", "茶", "12.5", "12.5", "3",
+			"這是一段很長的備註，用來測試共用字串表跨越 CONTINUE 記錄的情況。"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows =\n%q\nwant\n%q", rows, want)
+	}
+}
+
+func TestParseUploadSheetXLS(t *testing.T) {
+	parsed, err := parseUploadSheet(readFixture(t, "upload_orders.xls"), "upload_orders.xls", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.errors) != 0 || len(parsed.orders) != 2 {
+		t.Fatalf("orders = %+v, errors = %+v", parsed.orders, parsed.errors)
+	}
+	first, second := parsed.orders[0], parsed.orders[1]
+	if want := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC); !first.OrderedAt.Round(time.Second).Equal(want) {
+		t.Errorf("first ordered_at = %v, want %v", first.OrderedAt, want)
+	}
+	if want := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC); !second.OrderedAt.Equal(want) {
+		t.Errorf("second ordered_at = %v, want %v", second.OrderedAt, want)
+	}
+	if second.OrderNo != "20261001123" || second.UnitPrice != 12.5 || second.DiscountPrice != 12.5 || second.Qty != 3 {
+		t.Errorf("second = %+v", second)
+	}
+}
+
+func TestParseUploadSheetCSVFormats(t *testing.T) {
+	for _, tc := range []struct {
+		file      string
+		address   string
+		unitPrice float64
+		note      string
+	}{
+		{"upload_orders_big5.csv", "台北市信義區", 100, ""},
+		{"upload_orders_bom.csv", "台北市信義區, 松高路", 1200, `請傍晚送達"謝謝"`},
+		{"upload_orders.tsv", "台北市信義區, 松高路", 100, ""},
+		{"upload_orders_utf16.txt", "台北市信義區", 100, ""},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			parsed, err := parseUploadSheet(readFixture(t, tc.file), tc.file, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parsed.errors) != 0 || len(parsed.orders) != 1 {
+				t.Fatalf("orders = %+v, errors = %+v", parsed.orders, parsed.errors)
+			}
+			o := parsed.orders[0]
+			want := UploadedOrder{
+				OrderNo:       "A001",
+				OrderedAt:     time.Date(2026, 10, 1, 10, 0, 0, 0, o.OrderedAt.Location()),
+				ReceiverName:  "王小明",
+				Address:       tc.address,
+				ProductName:   "茶",
+				UnitPrice:     tc.unitPrice,
+				DiscountPrice: 90,
+				Qty:           2,
+				Note:          tc.note,
+				LineKey:       "茶#1",
+			}
+			if !reflect.DeepEqual(o, want) {
+				t.Errorf("order =\n%+v\nwant\n%+v", o, want)
+			}
+		})
+	}
+}
+
+func TestSniffCSVDelimiterIgnoresQuotedSeparators(t *testing.T) {
+	for text, want := range map[string]rune{
+		"a,b,c\n1,2,3\n":                   ',',
+		"a\tb\tc\n\"1,2,3,4\"\t2\t3\n":     '\t',
+		"a;b;c\n1;\"x;y;z;w\";3\n":         ';',
+		"\"a,b,c,d,e\"|b\n1|2\n3|4\n5|6\n": '|',
+	} {
+		if got := sniffCSVDelimiter(text); got != want {
+			t.Errorf("sniffCSVDelimiter(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+// uploadPreviewTTL is how long a dry-run preview can be confirmed.
+const uploadPreviewTTL = 30 * time.Minute
+
+// UploadRowError is one bad field of a data row.
+type UploadRowError struct {
+	Row    int    `json:"row"`              // sheet row, 1-based
+	Column string `json:"column"`           // field, e.g. "qty"
+	Header string `json:"header,omitempty"` // that column's header in the file
+	Value  string `json:"value"`            // raw cell value
+	Reason string `json:"reason"`
+	Error  string `json:"error"` // full message
+}
+
+// parsedUpload is a 賣貨便 export parsed but not yet stored.
+type parsedUpload struct {
+	sheet      string
+	headerRow  int
+	headers    map[string]string // field -> header text in the file
+	orders     []UploadedOrder   // line keys assigned
+	rowNumbers []int             // sheet row of orders[i]
+	errors     []UploadRowError
+	partial    map[string]bool // order numbers with a rejected row
+
+	headerCells []string   // the header row as in the file
+	rejectRows  [][]string // raw rows that had errors
+	rejectNotes []string   // reasons for rejectRows[i]
+}
+
+// parseUploadSheet reads an export (the active sheet of an .xlsx or .xls
+// workbook, or a CSV file), detects the header row and parses every data
+// row, collecting row errors instead of stopping at the first one. The
+// returned error is for the file as a whole.
+func parseUploadSheet(data []byte, filename string, isShipping bool) (*parsedUpload, error) {
+	sheetName, rows, err := readUploadRows(data, filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("沒有資料")
+	}
+
+	headerIndex, dataStartRow, err := detectHeaderRow(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &parsedUpload{
+		sheet:     sheetName,
+		headerRow: dataStartRow,
+		headers:   make(map[string]string, len(headerIndex)),
+		partial:   make(map[string]bool),
+
+		headerCells: rows[dataStartRow-1],
+	}
+	for field, idx := range headerIndex {
+		parsed.headers[field] = strings.TrimSpace(rows[dataStartRow-1][idx])
+	}
+
+	// Line keys are numbered over every data row, rejects included, so a
+	// line keeps its key when a row above it in the same order fails.
+	var lines []UploadedOrder
+	var lineRows []int
+	for i := dataStartRow; i < len(rows); i++ {
+		logRow("解析列", i+1, rows[i])
+		if !rowHasData(rows[i]) {
+			continue
+		}
+		order, errs := parseUploadedRow(rows[i], headerIndex, i+1)
+		lines = append(lines, order)
+		if len(errs) > 0 {
+			lineRows = append(lineRows, 0)
+			reasons := make([]string, len(errs))
+			for j := range errs {
+				errs[j].Header = parsed.headers[errs[j].Column]
+				reasons[j] = errs[j].Reason
+			}
+			parsed.errors = append(parsed.errors, errs...)
+			parsed.rejectRows = append(parsed.rejectRows, rows[i])
+			parsed.rejectNotes = append(parsed.rejectNotes, strings.Join(reasons, "；"))
+			parsed.partial[order.OrderNo] = true
+			continue
+		}
+		lineRows = append(lineRows, i+1)
+	}
+	assignLineKeys(lines)
+	for i, order := range lines {
+		if lineRows[i] == 0 {
+			continue
+		}
+		order.IsShipping = isShipping
+		parsed.orders = append(parsed.orders, order)
+		parsed.rowNumbers = append(parsed.rowNumbers, lineRows[i])
+	}
+	return parsed, nil
+}
+
+// UploadPreviewRow is one parsed row and what confirming would do to it.
+type UploadPreviewRow struct {
+	Row    int            `json:"row"`
+	Action string         `json:"action"` // insert, update or unchanged
+	Order  UploadedOrder  `json:"order"`
+	Before *UploadedOrder `json:"before,omitempty"`
+}
+
+// UploadPreview is the result of a dry-run upload. Confirming its token
+// stores exactly the rows parsed here.
+type UploadPreview struct {
+	Token      string             `json:"token"`
+	ExpiresAt  time.Time          `json:"expires_at"`
+	Filename   string             `json:"filename"`
+	IsShipping bool               `json:"is_shipping"`
+	Sheet      string             `json:"sheet"`
+	HeaderRow  int                `json:"header_row"`
+	Headers    map[string]string  `json:"headers"`
+	Rows       []UploadPreviewRow `json:"rows"`
+	Errors     []UploadRowError   `json:"errors"`
+	RejectsURL string             `json:"rejects_url,omitempty"`
+	Missing    []UploadedOrder    `json:"missing"` // stored lines the file no longer has
+	Summary    UploadResult       `json:"summary"`
+
+	orders  []UploadedOrder
+	partial map[string]bool
+	batch   UploadBatch // source details for the batch confirming creates
+}
+
+// buildUploadPreview diffs parsed rows against what is stored.
+func buildUploadPreview(db *gorm.DB, parsed *parsedUpload, batch UploadBatch) (*UploadPreview, error) {
+	plan, err := planUploadedOrders(db, parsed.orders, parsed.partial)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[[2]string]UploadedOrder, len(plan.updates))
+	for _, u := range plan.updates {
+		updates[[2]string{u.before.OrderNo, u.before.LineKey}] = u.before
+	}
+	unchanged := make(map[[2]string]bool, len(plan.unchanged))
+	for _, u := range plan.unchanged {
+		unchanged[[2]string{u.OrderNo, u.LineKey}] = true
+	}
+
+	preview := &UploadPreview{
+		Token:      newUploadPreviewToken(),
+		ExpiresAt:  time.Now().Add(uploadPreviewTTL),
+		Filename:   batch.Filename,
+		IsShipping: batch.IsShipping,
+		Sheet:      parsed.sheet,
+		HeaderRow:  parsed.headerRow,
+		Headers:    parsed.headers,
+		Rows:       make([]UploadPreviewRow, 0, len(parsed.orders)),
+		Errors:     parsed.errors,
+		Missing:    plan.missing,
+		Summary: UploadResult{
+			Rows:      len(parsed.orders),
+			Inserted:  len(plan.inserts),
+			Updated:   len(plan.updates),
+			Unchanged: len(plan.unchanged),
+			Missing:   len(plan.missing),
+
+			DuplicateOfBatch: findDuplicateUploadBatch(db, batch.FileHash, batch.IsShipping),
+		},
+		orders:  parsed.orders,
+		partial: parsed.partial,
+		batch:   batch,
+	}
+	if preview.Errors == nil {
+		preview.Errors = []UploadRowError{}
+	}
+	if preview.Missing == nil {
+		preview.Missing = []UploadedOrder{}
+	}
+	for i, o := range parsed.orders {
+		row := UploadPreviewRow{Row: parsed.rowNumbers[i], Action: "insert", Order: o}
+		key := [2]string{o.OrderNo, o.LineKey}
+		if before, ok := updates[key]; ok {
+			row.Action = "update"
+			row.Before = &before
+		} else if unchanged[key] {
+			row.Action = "unchanged"
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	return preview, nil
+}
+
+func newUploadPreviewToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// uploadPreviewStore keeps dry-run previews in memory until confirmed or
+// expired.
+type uploadPreviewStore struct {
+	mu       sync.Mutex
+	previews map[string]*UploadPreview
+	rejects  map[string]*uploadRejects
+}
+
+// uploadRejects is a rejected-rows workbook waiting to be downloaded.
+type uploadRejects struct {
+	expiresAt time.Time
+	filename  string
+	data      []byte
+}
+
+func newUploadPreviewStore() *uploadPreviewStore {
+	return &uploadPreviewStore{
+		previews: make(map[string]*UploadPreview),
+		rejects:  make(map[string]*uploadRejects),
+	}
+}
+
+// expire drops old entries; callers hold s.mu.
+func (s *uploadPreviewStore) expire() {
+	now := time.Now()
+	for token, old := range s.previews {
+		if now.After(old.ExpiresAt) {
+			delete(s.previews, token)
+		}
+	}
+	for token, old := range s.rejects {
+		if now.After(old.expiresAt) {
+			delete(s.rejects, token)
+		}
+	}
+}
+
+func (s *uploadPreviewStore) put(p *UploadPreview) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.previews[p.Token] = p
+}
+
+// putRejects builds an .xlsx of parsed's rejected rows (original header
+// plus an 錯誤原因 column) and returns its download URL, or "" if there
+// are none.
+func (s *uploadPreviewStore) putRejects(parsed *parsedUpload, filename string) (string, error) {
+	if len(parsed.rejectRows) == 0 {
+		return "", nil
+	}
+	xl := excelize.NewFile()
+	defer xl.Close()
+	sheet := xl.GetSheetName(0)
+	write := func(rowNum int, cells []string, note string) error {
+		values := make([]interface{}, 0, len(parsed.headerCells)+1)
+		for i := 0; i < len(parsed.headerCells); i++ {
+			v := ""
+			if i < len(cells) {
+				v = cells[i]
+			}
+			values = append(values, v)
+		}
+		values = append(values, note)
+		cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+		return xl.SetSheetRow(sheet, cell, &values)
+	}
+	if err := write(1, parsed.headerCells, "錯誤原因"); err != nil {
+		return "", err
+	}
+	for i, row := range parsed.rejectRows {
+		if err := write(i+2, row, parsed.rejectNotes[i]); err != nil {
+			return "", err
+		}
+	}
+	buf, err := xl.WriteToBuffer()
+	if err != nil {
+		return "", err
+	}
+
+	token := newUploadPreviewToken()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.rejects[token] = &uploadRejects{
+		expiresAt: time.Now().Add(uploadPreviewTTL),
+		filename:  strings.TrimSuffix(filename, filepath.Ext(filename)) + "_錯誤列.xlsx",
+		data:      buf.Bytes(),
+	}
+	return "/orders/upload/rejects/" + token, nil
+}
+
+func (s *uploadPreviewStore) getRejects(token string) *uploadRejects {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rejects[token]
+	if !ok || time.Now().After(r.expiresAt) {
+		return nil
+	}
+	return r
+}
+
+// take removes and returns an unexpired preview, so a token commits once.
+func (s *uploadPreviewStore) take(token string) *UploadPreview {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.previews[token]
+	if !ok {
+		return nil
+	}
+	delete(s.previews, token)
+	if time.Now().After(p.ExpiresAt) {
+		return nil
+	}
+	return p
+}
+
+// uploadOrdersHandler handles POST /orders/upload and
+// /orders/upload-shipping. With dry_run=true nothing is stored; the
+// response is an UploadPreview whose token /orders/upload/confirm accepts.
+// Exports may be .xlsx, .xls or CSV. Any bad row fails the upload unless
+// allow_partial=true, which stores the valid rows; either way the rejects
+// can be downloaded as an .xlsx. Lines of an uploaded order that the file
+// no longer has are kept unless remove_missing=true, which deletes them.
+// Stored uploads are recorded as an UploadBatch with the file's name, hash
+// and uploader (the uploaded_by form field, or the client IP).
+func uploadOrdersHandler(db *gorm.DB, previews *uploadPreviewStore, isShipping bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file 欄位缺失"})
+			return
+		}
+
+		if !isUploadFile(file.Filename) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "僅接受 .xlsx、.xls 或 .csv 檔案"})
+			return
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "無法讀取上傳檔案"})
+			return
+		}
+		data, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "無法讀取上傳檔案"})
+			return
+		}
+
+		parsed, err := parseUploadSheet(data, file.Filename, isShipping)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sum := sha256.Sum256(data)
+		batch := UploadBatch{
+			Filename:   file.Filename,
+			UploadedBy: uploadedBy(c),
+			IsShipping: isShipping,
+			SheetName:  parsed.sheet,
+			FileHash:   hex.EncodeToString(sum[:]),
+		}
+
+		rejectsURL, err := previews.putRejects(parsed, file.Filename)
+		if err != nil {
+			log.Printf("[upload] 產生錯誤列檔案失敗：%v", err)
+		}
+
+		if c.Query("dry_run") == "true" {
+			preview, err := buildUploadPreview(db, parsed, batch)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			preview.RejectsURL = rejectsURL
+			previews.put(preview)
+			c.JSON(http.StatusOK, preview)
+			return
+		}
+
+		if len(parsed.errors) > 0 && c.Query("allow_partial") != "true" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":       fmt.Sprintf("共 %d 個欄位錯誤，例如：%s", len(parsed.errors), parsed.errors[0].Error),
+				"errors":      parsed.errors,
+				"rejects_url": rejectsURL,
+			})
+			return
+		}
+		commitUpload(c, db, batch, parsed.orders, parsed.partial, c.Query("remove_missing") == "true", parsed.errors, len(parsed.rejectRows), rejectsURL)
+	}
+}
+
+// uploadConfirmHandler handles POST /orders/upload/confirm {"token": ...}.
+// uploaded_by, if given, replaces the uploader recorded with the preview;
+// remove_missing deletes the preview's missing lines.
+func uploadConfirmHandler(db *gorm.DB, previews *uploadPreviewStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token         string `json:"token"`
+			AllowPartial  bool   `json:"allow_partial"`
+			RemoveMissing bool   `json:"remove_missing"`
+			UploadedBy    string `json:"uploaded_by"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+			return
+		}
+
+		preview := previews.take(req.Token)
+		if preview == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "預覽不存在或已過期，請重新上傳"})
+			return
+		}
+		if len(preview.Errors) > 0 && !req.AllowPartial {
+			// Keep the preview so the caller can retry with allow_partial.
+			previews.put(preview)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":       "預覽中有無法解析的資料列，請修正後重新上傳，或只匯入正確的資料列",
+				"errors":      preview.Errors,
+				"rejects_url": preview.RejectsURL,
+			})
+			return
+		}
+		rejected := make(map[int]bool)
+		for _, e := range preview.Errors {
+			rejected[e.Row] = true
+		}
+		batch := preview.batch
+		if by := strings.TrimSpace(req.UploadedBy); by != "" {
+			batch.UploadedBy = by
+		}
+		commitUpload(c, db, batch, preview.orders, preview.partial, req.RemoveMissing, preview.Errors, len(rejected), preview.RejectsURL)
+	}
+}
+
+// uploadRejectsHandler serves GET /orders/upload/rejects/:token.
+func uploadRejectsHandler(previews *uploadPreviewStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rejects := previews.getRejects(c.Param("token"))
+		if rejects == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "錯誤列檔案不存在或已過期"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename*=UTF-8''%s`, url.PathEscape(rejects.filename)))
+		c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", rejects.data)
+	}
+}
+
+func commitUpload(c *gin.Context, db *gorm.DB, batch UploadBatch, orders []UploadedOrder, partial map[string]bool, removeMissing bool, rowErrors []UploadRowError, rejected int, rejectsURL string) {
+	duplicateOf := findDuplicateUploadBatch(db, batch.FileHash, batch.IsShipping)
+	batch.Rejected = rejected
+	result, err := saveUploadedOrders(db, &batch, orders, partial, removeMissing)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result.Rejected = rejected
+	result.Errors = rowErrors
+	result.RejectsURL = rejectsURL
+	result.DuplicateOfBatch = duplicateOf
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+const uploadCSVHeader = "訂單編號,訂購日期,收件人,取件地址,商品名稱,單價,優惠價,數量,備註\n"
+
+// uploadCSV is an export with the standard header and the given data rows.
+func uploadCSV(rows ...string) []byte {
+	return []byte(uploadCSVHeader + strings.Join(rows, "\n") + "\n")
+}
+
+func TestParseUploadSheetKeepsLineKeysPastRejectedRows(t *testing.T) {
+	parsed, err := parseUploadSheet(uploadCSV(
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,abc,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,1,",
+	), "orders.csv", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.errors) != 1 || parsed.errors[0].Row != 2 {
+		t.Fatalf("errors = %+v, want row 2 rejected", parsed.errors)
+	}
+	var keys []string
+	for _, o := range parsed.orders {
+		keys = append(keys, o.LineKey)
+	}
+	if got := strings.Join(keys, ","); got != "茶#2,餅乾#1" {
+		t.Errorf("line keys = %s, want 茶#2,餅乾#1", got)
+	}
+	if len(parsed.rowNumbers) != 2 || parsed.rowNumbers[0] != 3 || parsed.rowNumbers[1] != 4 {
+		t.Errorf("row numbers = %v, want [3 4]", parsed.rowNumbers)
+	}
+}
+
+// saveUploadCSV parses and stores an export the way an allow_partial
+// upload does, deleting missing lines if removeMissing is set.
+func saveUploadCSV(t *testing.T, db *gorm.DB, removeMissing bool, rows ...string) UploadResult {
+	t.Helper()
+	parsed, err := parseUploadSheet(uploadCSV(rows...), "orders.csv", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := saveUploadedOrders(db, &UploadBatch{Filename: "orders.csv"}, parsed.orders, parsed.partial, removeMissing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// storedLines lists the stored line keys as "order/key=qty".
+func storedLines(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+	var rows []UploadedOrder
+	if err := db.Order("order_no, line_key").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, len(rows))
+	for i, r := range rows {
+		lines[i] = fmt.Sprintf("%s/%s=%d", r.OrderNo, r.LineKey, r.Qty)
+	}
+	return strings.Join(lines, " ")
+}
+
+func TestSaveUploadedOrdersCountsAndRemovesMissingLines(t *testing.T) {
+	db := newTestDB(t, &UploadedOrder{}, &UploadBatch{}, &UploadRowChange{})
+	export := []string{
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,1,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,1,",
+		"B001,2026/10/02 09:00:00,陳小華,台中市,咖啡,200,180,1,",
+	}
+	check := func(name string, got UploadResult, inserted, updated, unchanged, removed, missing int) {
+		t.Helper()
+		if got.Inserted != inserted || got.Updated != updated || got.Unchanged != unchanged ||
+			got.Removed != removed || got.Missing != missing {
+			t.Errorf("%s: result = %+v, want %d inserted, %d updated, %d unchanged, %d removed, %d missing",
+				name, got, inserted, updated, unchanged, removed, missing)
+		}
+	}
+
+	check("first upload", saveUploadCSV(t, db, false, export...), 4, 0, 0, 0, 0)
+	check("same file again", saveUploadCSV(t, db, false, export...), 0, 0, 4, 0, 0)
+	const original = "A001/茶#1=2 A001/茶#2=1 A001/餅乾#1=1 B001/咖啡#1=1"
+	if got := storedLines(t, db); got != original {
+		t.Fatalf("stored %s, want %s", got, original)
+	}
+
+	// The corrected export of A001 changes a quantity and renames 餅乾;
+	// B001 is not in it and is left alone. 餅乾 is only reported as
+	// missing unless removal is asked for.
+	corrected := []string{
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,3,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,1,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾禮盒,50,50,1,",
+	}
+	kept := saveUploadCSV(t, db, false, corrected...)
+	check("corrected export", kept, 1, 1, 1, 0, 1)
+	if got, want := storedLines(t, db), "A001/茶#1=3 A001/茶#2=1 A001/餅乾#1=1 A001/餅乾禮盒#1=1 B001/咖啡#1=1"; got != want {
+		t.Errorf("stored %s, want %s", got, want)
+	}
+	if _, err := rollbackUploadBatch(db, kept.BatchID); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got := storedLines(t, db); got != original {
+		t.Fatalf("after rollback stored %s, want %s", got, original)
+	}
+
+	removed := saveUploadCSV(t, db, true, corrected...)
+	check("corrected export, remove_missing", removed, 1, 1, 1, 1, 0)
+	if got, want := storedLines(t, db), "A001/茶#1=3 A001/茶#2=1 A001/餅乾禮盒#1=1 B001/咖啡#1=1"; got != want {
+		t.Errorf("stored %s, want %s", got, want)
+	}
+	var batch UploadBatch
+	db.First(&batch, removed.BatchID)
+	if batch.Removed != 1 {
+		t.Errorf("batch.Removed = %d, want 1", batch.Removed)
+	}
+
+	if _, err := rollbackUploadBatch(db, removed.BatchID); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got := storedLines(t, db); got != original {
+		t.Errorf("after rollback stored %s, want %s", got, original)
+	}
+}
+
+func TestSaveUploadedOrdersKeepsLinesOfPartialOrders(t *testing.T) {
+	db := newTestDB(t, &UploadedOrder{}, &UploadBatch{}, &UploadRowChange{})
+	saveUploadCSV(t, db, false,
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,1,",
+		"B001,2026/10/02 09:00:00,陳小華,台中市,咖啡,200,180,1,",
+		"B001,2026/10/02 09:00:00,陳小華,台中市,蛋糕,300,300,1,",
+	)
+
+	// 餅乾's row is rejected, so A001 keeps it; B001 dropped 蛋糕.
+	result := saveUploadCSV(t, db, true,
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,abc,",
+		"B001,2026/10/02 09:00:00,陳小華,台中市,咖啡,200,180,1,",
+	)
+	if result.Removed != 1 {
+		t.Errorf("removed %d, want 1", result.Removed)
+	}
+	if got, want := storedLines(t, db), "A001/茶#1=2 A001/餅乾#1=1 B001/咖啡#1=1"; got != want {
+		t.Errorf("stored %s, want %s", got, want)
+	}
+
+	// Without an order number the rejected row could be any order's.
+	result = saveUploadCSV(t, db, true,
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		",2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,1,",
+	)
+	if result.Removed != 0 {
+		t.Errorf("removed %d with an unattributed reject, want 0", result.Removed)
+	}
+}
+
+func TestClearShippingUploadsThenRollback(t *testing.T) {
+	db := newTestDB(t, &UploadedOrder{}, &UploadBatch{}, &UploadRowChange{})
+	saveShipping := func(removeMissing bool, rows ...string) UploadResult {
+		t.Helper()
+		parsed, err := parseUploadSheet(uploadCSV(rows...), "shipping.csv", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := saveUploadedOrders(db, &UploadBatch{Filename: "shipping.csv", IsShipping: true}, parsed.orders, parsed.partial, removeMissing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	sell := saveUploadCSV(t, db, false, "B001,2026/10/02 09:00:00,陳小華,台中市,咖啡,200,180,1,")
+	saveShipping(false,
+		"A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,2,",
+		"A001,2026/10/01 10:00:00,王小明,台北市,餅乾,50,50,1,",
+	)
+	second := saveShipping(true, "A001,2026/10/01 10:00:00,王小明,台北市,茶,100,90,3,")
+	if second.Removed != 1 {
+		t.Fatalf("removed %d, want 1", second.Removed)
+	}
+
+	if err := clearShippingUploadedOrders(db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storedLines(t, db), "B001/咖啡#1=1"; got != want {
+		t.Fatalf("after clear stored %s, want %s", got, want)
+	}
+
+	// Rolling back the batch that removed 餅乾 must not store it again.
+	if _, err := rollbackUploadBatch(db, second.BatchID); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got, want := storedLines(t, db), "B001/咖啡#1=1"; got != want {
+		t.Errorf("after rollback stored %s, want %s", got, want)
+	}
+
+	// The sell order upload keeps its change log.
+	if _, err := rollbackUploadBatch(db, sell.BatchID); err != nil {
+		t.Fatalf("rollback sell batch: %v", err)
+	}
+	if got := storedLines(t, db); got != "" {
+		t.Errorf("after sell rollback stored %s, want nothing", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxWebhookBody caps how much of a webhook request body we read.
+const maxWebhookBody = 5 << 20
+
+// WooWebhookDelivery records every processed WooCommerce webhook delivery so
+// a replayed delivery ID is acknowledged without being applied twice.
+type WooWebhookDelivery struct {
+	DeliveryID string    `gorm:"primaryKey"`
+	Topic      string    `gorm:"index"`
+	ResourceID int       `gorm:"index"`
+	ReceivedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// verifyWooWebhookSignature checks X-WC-Webhook-Signature, which WooCommerce
+// sets to base64(HMAC-SHA256(body, secret)).
+func verifyWooWebhookSignature(body []byte, signature, secret string) bool {
+	if signature == "" || secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// wooWebhookHandler receives order.created / order.updated / order.restored /
+// order.deleted webhooks and applies them to the woo_orders cache.
+func wooWebhookHandler(db *gorm.DB, secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBody))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "讀取 webhook 內容失敗"})
+			return
+		}
+
+		signature := c.GetHeader("X-WC-Webhook-Signature")
+
+		// WooCommerce pings a freshly saved webhook with an unsigned
+		// "webhook_id=<n>" form body; it only needs a 2xx to activate.
+		if signature == "" && strings.HasPrefix(string(body), "webhook_id=") {
+			c.JSON(http.StatusOK, gin.H{"status": "pong"})
+			return
+		}
+
+		if secret == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WOO_WEBHOOK_SECRET not configured"})
+			return
+		}
+		if !verifyWooWebhookSignature(body, signature, secret) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+			return
+		}
+
+		deliveryID := c.GetHeader("X-WC-Webhook-Delivery-ID")
+		topic := c.GetHeader("X-WC-Webhook-Topic")
+		if deliveryID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-WC-Webhook-Delivery-ID"})
+			return
+		}
+
+		var order WooOrder
+		if err := json.Unmarshal(body, &order); err != nil || order.ID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook payload is not an order"})
+			return
+		}
+
+		duplicate := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&WooWebhookDelivery{
+				DeliveryID: deliveryID,
+				Topic:      topic,
+				ResourceID: order.ID,
+			})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				duplicate = true
+				return nil
+			}
+
+			switch topic {
+			case "order.created", "order.updated", "order.restored":
+				return upsertCachedOrders(tx, []WooOrder{order})
+			case "order.deleted":
+				return tx.Delete(&CachedWooOrder{}, order.ID).Error
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[webhook] delivery=%s topic=%s order=%d 失敗：%v", deliveryID, topic, order.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if duplicate {
+			log.Printf("[webhook] delivery=%s 重複送達，略過", deliveryID)
+			c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+			return
+		}
+
+		log.Printf("[webhook] delivery=%s topic=%s order=%d status=%s", deliveryID, topic, order.ID, order.Status)
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ecpayPluginCallbackURL is the RY-Tools plugin endpoint that normally
+// receives ECPay logistics status callbacks.
+func ecpayPluginCallbackURL(woo *WooClient) string {
+	return woo.BaseURL + "/wc-api/ry_ecpay_shipping_callback/"
+}
+
+// ecpayServerReplyURL is the ServerReplyURL sent to ECPay when creating a
+// shipment: our own /webhooks/ecpay/logistics when ECPAY_SERVER_REPLY_URL is
+// set (we forward to the plugin), otherwise the plugin directly.
+func ecpayServerReplyURL(woo *WooClient) string {
+	if u := os.Getenv("ECPAY_SERVER_REPLY_URL"); u != "" {
+		return u
+	}
+	return ecpayPluginCallbackURL(woo)
+}
+
+// ecpayLogisticsCallbackHandler receives ECPay logistics status
+// notifications, stores them as LogisticsStatusEvent rows and queues the
+// untouched payload on forwarder so the WordPress plugin keeps working. The
+// payload is queued before it is verified or stored: the plugin checks
+// CheckMacValue itself and must not miss a status because we failed to.
+func ecpayLogisticsCallbackHandler(db *gorm.DB, ecpay *EcpayClient, forwarder *CallbackForwarder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBody))
+		if err != nil {
+			c.String(http.StatusBadRequest, "0|read body failed")
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			c.String(http.StatusBadRequest, "0|malformed form")
+			return
+		}
+		if forwarder != nil {
+			if err := forwarder.Enqueue(body); err != nil {
+				log.Printf("[ecpay-callback] 加入轉送佇列失敗：%v", err)
+				c.String(http.StatusInternalServerError, "0|store failed")
+				return
+			}
+		}
+		if !ecpay.configured() || !ecpay.verifyCheckMacValue(form) {
+			log.Printf("[ecpay-callback] CheckMacValue 驗證失敗 LogisticsID=%s", form.Get("AllPayLogisticsID"))
+			c.String(http.StatusBadRequest, "0|CheckMacValue Error")
+			return
+		}
+
+		tradeNo := form.Get("MerchantTradeNo")
+		ev := LogisticsStatusEvent{
+			OrderID:           orderIDFromMerchantTradeNo(tradeNo),
+			AllPayLogisticsID: form.Get("AllPayLogisticsID"),
+			MerchantTradeNo:   tradeNo,
+			LogisticsSubType:  form.Get("LogisticsSubType"),
+			StatusCode:        form.Get("RtnCode"),
+			StatusMsg:         form.Get("RtnMsg"),
+			StatusAt:          parseEcpayTime(form.Get("UpdateStatusDate")),
+			Source:            "callback",
+			Payload:           string(body),
+		}
+		if _, err := recordLogisticsEvent(db, &ev); err != nil {
+			// ECPay retries until it gets 1|OK, so let it.
+			log.Printf("[ecpay-callback] 儲存物流狀態失敗：%v", err)
+			c.String(http.StatusInternalServerError, "0|store failed")
+			return
+		}
+		if _, err := applyShipmentStatus(db, ShipmentStatus{
+			AllPayLogisticsID: ev.AllPayLogisticsID,
+			OrderID:           ev.OrderID,
+			LogisticsSubType:  ev.LogisticsSubType,
+			StatusCode:        ev.StatusCode,
+			StatusMsg:         ev.StatusMsg,
+			StatusAt:          ev.StatusAt,
+		}); err != nil {
+			log.Printf("[ecpay-callback] 更新物流最新狀態失敗：%v", err)
+			c.String(http.StatusInternalServerError, "0|store failed")
+			return
+		}
+		log.Printf("[ecpay-callback] order=%d LogisticsID=%s RtnCode=%s RtnMsg=%s",
+			ev.OrderID, ev.AllPayLogisticsID, ev.StatusCode, ev.StatusMsg)
+		c.String(http.StatusOK, "1|OK")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const testWebhookSecret = "wc-webhook-test-secret"
+
+// newWebhookTestServer serves the WooCommerce webhook receiver over a real
+// HTTP server backed by a fresh database.
+func newWebhookTestServer(t *testing.T) (*httptest.Server, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t, &CachedWooOrder{}, &WooWebhookDelivery{})
+	r := gin.New()
+	r.POST("/webhooks/woocommerce", wooWebhookHandler(db, testWebhookSecret))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, db
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return data
+}
+
+func signWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends body the way WooCommerce does and returns the status
+// and the "status" field of the reply.
+func postWebhook(t *testing.T, srv *httptest.Server, topic, deliveryID, signature string, body []byte) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/webhooks/woocommerce", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-WC-Webhook-Topic", topic)
+	req.Header.Set("X-WC-Webhook-Delivery-ID", deliveryID)
+	req.Header.Set("X-WC-Webhook-Signature", signature)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Status string `json:"status"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply.Status
+}
+
+func cachedOrder(t *testing.T, db *gorm.DB, id int) *CachedWooOrder {
+	t.Helper()
+	var rows []CachedWooOrder
+	if err := db.Where("id = ?", id).Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return &rows[0]
+}
+
+func TestWooWebhookAcceptsSignedDelivery(t *testing.T) {
+	srv, db := newWebhookTestServer(t)
+	body := readFixture(t, "woo_webhook_order_created.json")
+
+	code, status := postWebhook(t, srv, "order.created", "d-1", signWebhook(body, testWebhookSecret), body)
+	if code != http.StatusOK || status != "ok" {
+		t.Fatalf("got %d %q, want 200 ok", code, status)
+	}
+	row := cachedOrder(t, db, 1201)
+	if row == nil {
+		t.Fatal("order 1201 was not cached")
+	}
+	if row.Status != "processing" {
+		t.Errorf("cached status = %q, want processing", row.Status)
+	}
+	var order WooOrder
+	if err := json.Unmarshal([]byte(row.Data), &order); err != nil || order.Billing.Phone != "0912345678" {
+		t.Errorf("cached data = %s (err %v)", row.Data, err)
+	}
+}
+
+func TestWooWebhookRejectsBadSignature(t *testing.T) {
+	srv, db := newWebhookTestServer(t)
+	body := readFixture(t, "woo_webhook_order_created.json")
+
+	for name, sig := range map[string]string{
+		"wrong secret": signWebhook(body, "not-the-secret"),
+		"tampered":     signWebhook(append([]byte(" "), body...), testWebhookSecret),
+		"missing":      "",
+	} {
+		if code, _ := postWebhook(t, srv, "order.created", "d-"+name, sig, body); code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want 401", name, code)
+		}
+	}
+	if row := cachedOrder(t, db, 1201); row != nil {
+		t.Error("unsigned delivery was applied")
+	}
+	var deliveries int64
+	db.Model(&WooWebhookDelivery{}).Count(&deliveries)
+	if deliveries != 0 {
+		t.Errorf("recorded %d deliveries for rejected requests", deliveries)
+	}
+}
+
+func TestWooWebhookIgnoresReplayedDelivery(t *testing.T) {
+	srv, db := newWebhookTestServer(t)
+	created := readFixture(t, "woo_webhook_order_created.json")
+	updated := readFixture(t, "woo_webhook_order_updated.json")
+
+	if code, status := postWebhook(t, srv, "order.created", "d-1", signWebhook(created, testWebhookSecret), created); code != http.StatusOK || status != "ok" {
+		t.Fatalf("first delivery: got %d %q", code, status)
+	}
+	// Same delivery ID again, even with another (validly signed) body.
+	code, status := postWebhook(t, srv, "order.updated", "d-1", signWebhook(updated, testWebhookSecret), updated)
+	if code != http.StatusOK || status != "duplicate" {
+		t.Fatalf("replay: got %d %q, want 200 duplicate", code, status)
+	}
+	if row := cachedOrder(t, db, 1201); row == nil || row.Status != "processing" {
+		t.Errorf("replayed delivery changed the cache: %+v", row)
+	}
+}
+
+func TestWooWebhookUpsertsAndDeletesCachedOrder(t *testing.T) {
+	srv, db := newWebhookTestServer(t)
+	created := readFixture(t, "woo_webhook_order_created.json")
+	updated := readFixture(t, "woo_webhook_order_updated.json")
+
+	postWebhook(t, srv, "order.created", "d-1", signWebhook(created, testWebhookSecret), created)
+	if code, _ := postWebhook(t, srv, "order.updated", "d-2", signWebhook(updated, testWebhookSecret), updated); code != http.StatusOK {
+		t.Fatalf("update: got %d", code)
+	}
+	if row := cachedOrder(t, db, 1201); row == nil || row.Status != "prepare-stock" {
+		t.Fatalf("after update: %+v, want status prepare-stock", row)
+	}
+
+	// An older copy arriving late must not roll the cache back.
+	if code, _ := postWebhook(t, srv, "order.updated", "d-3", signWebhook(created, testWebhookSecret), created); code != http.StatusOK {
+		t.Fatalf("late update: got %d", code)
+	}
+	if row := cachedOrder(t, db, 1201); row == nil || row.Status != "prepare-stock" {
+		t.Errorf("stale delivery overwrote the cache: %+v", row)
+	}
+
+	if code, _ := postWebhook(t, srv, "order.deleted", "d-4", signWebhook(updated, testWebhookSecret), updated); code != http.StatusOK {
+		t.Fatalf("delete: got %d", code)
+	}
+	if row := cachedOrder(t, db, 1201); row != nil {
+		t.Error("order.deleted left the order cached")
+	}
+}
+
+func TestWooWebhookAnswersActivationPing(t *testing.T) {
+	srv, _ := newWebhookTestServer(t)
+	resp, err := srv.Client().Post(srv.URL+"/webhooks/woocommerce", "application/x-www-form-urlencoded", bytes.NewReader([]byte("webhook_id=7")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("ping: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWooBaseURL is used when WOO_BASE_URL is not set, so existing
+// deployments keep talking to the production shop.
+const defaultWooBaseURL = "https://flowers.fenny-studio.com"
+
+// WooClient talks to the WooCommerce REST API (wc/v3) of a single shop.
+// It is built once in main and shared by every handler.
+type WooClient struct {
+	BaseURL   string
+	APIKey    string
+	APISecret string
+	HTTP      *http.Client
+
+	// MaxRetries is how many times a failed call is retried after the first
+	// attempt. Backoff starts at RetryBaseDelay and doubles up to RetryMaxDelay.
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// PageConcurrency bounds how many list pages are fetched at once.
+	PageConcurrency int
+
+	// OnOrderUpdated, if set, receives the order WC returns after each
+	// successful write so local copies can be refreshed.
+	OnOrderUpdated func(WooOrder)
+}
+
+// newWooClientFromEnv builds a WooClient from WOO_BASE_URL, WOO_API_KEY,
+// WOO_API_SECRET, WOO_TIMEOUT_SECONDS, WOO_MAX_RETRIES and WOO_PAGE_CONCURRENCY.
+func newWooClientFromEnv() *WooClient {
+	baseURL := os.Getenv("WOO_BASE_URL")
+	if baseURL == "" {
+		log.Printf("WOO_BASE_URL 未設定，使用預設 %s", defaultWooBaseURL)
+		baseURL = defaultWooBaseURL
+	}
+
+	timeout := 30 * time.Second
+	if raw := os.Getenv("WOO_TIMEOUT_SECONDS"); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+
+	client := newWooClient(baseURL, os.Getenv("WOO_API_KEY"), os.Getenv("WOO_API_SECRET"), &http.Client{Timeout: timeout})
+	if raw := os.Getenv("WOO_MAX_RETRIES"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			client.MaxRetries = n
+		}
+	}
+	if raw := os.Getenv("WOO_PAGE_CONCURRENCY"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			client.PageConcurrency = n
+		}
+	}
+	return client
+}
+
+// newWooClient builds a WooClient for the shop at baseURL. Tests can point
+// baseURL at an httptest server standing in for the WC REST API.
+func newWooClient(baseURL, apiKey, apiSecret string, httpClient *http.Client) *WooClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &WooClient{
+		BaseURL:         strings.TrimRight(baseURL, "/"),
+		APIKey:          apiKey,
+		APISecret:       apiSecret,
+		HTTP:            httpClient,
+		MaxRetries:      3,
+		RetryBaseDelay:  500 * time.Millisecond,
+		RetryMaxDelay:   10 * time.Second,
+		PageConcurrency: 4,
+	}
+}
+
+// endpoint returns the absolute wc/v3 URL for path with the given query.
+func (w *WooClient) endpoint(path string, query url.Values) string {
+	u := w.BaseURL + "/wp-json/wc/v3/" + strings.TrimLeft(path, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// wooStatusError is returned for a non-2xx WooCommerce response.
+type wooStatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *wooStatusError) Error() string {
+	return fmt.Sprintf("WooCommerce %s %s: %d - %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// retryable reports whether the request may be sent again. Requests that are
+// not idempotent (POST) are only retried when WC says it did not process them.
+func (e *wooStatusError) retryable(idempotent bool) bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// parseRetryAfter understands both forms of the Retry-After header
+// (delay-seconds and HTTP-date). It returns 0 when absent or unparseable.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// backoff returns how long to wait before retry number attempt (0-based):
+// exponential with jitter, overridden by a server-provided Retry-After.
+func (w *WooClient) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > w.RetryMaxDelay*3 {
+			return w.RetryMaxDelay * 3
+		}
+		return retryAfter
+	}
+	delay := w.RetryBaseDelay << attempt
+	if delay <= 0 || delay > w.RetryMaxDelay {
+		delay = w.RetryMaxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// do sends an authenticated request and returns the response for a 2xx
+// status. Non-2xx responses are drained and returned as a *wooStatusError.
+// 429/5xx responses and connection errors are retried with backoff until
+// MaxRetries is exhausted or ctx is cancelled.
+func (w *WooClient) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	idempotent := method != http.MethodPost
+	for attempt := 0; ; attempt++ {
+		resp, err := w.doOnce(ctx, method, path, query, body)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || attempt >= w.MaxRetries {
+			return nil, err
+		}
+
+		var retryAfter time.Duration
+		var statusErr *wooStatusError
+		if errors.As(err, &statusErr) {
+			if !statusErr.retryable(idempotent) {
+				return nil, err
+			}
+			retryAfter = statusErr.RetryAfter
+		} else if !idempotent {
+			// A transport error on POST may mean WC already handled it.
+			return nil, err
+		}
+
+		wait := w.backoff(attempt, retryAfter)
+		log.Printf("[woo] %s %s 失敗（第 %d 次）：%v，%s 後重試", method, path, attempt+1, err, wait)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doOnce performs a single attempt of do.
+func (w *WooClient) doOnce(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = strings.NewReader(string(body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, w.endpoint(path, query), reader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(w.APIKey, w.APISecret)
+
+	resp, err := w.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &wooStatusError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Body:       string(bodyBytes),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return resp, nil
+}
+
+// getJSON GETs path and decodes the JSON response into out.
+func (w *WooClient) getJSON(ctx context.Context, path string, query url.Values, out interface{}) (*http.Response, error) {
+	resp, err := w.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return resp, nil
+}
+
+func (w *WooClient) fetchProcessingOrders(ctx context.Context) ([]WooOrder, error) {
+	return w.fetchOrdersByStatus(ctx, "processing")
+}
+
+func (w *WooClient) fetchShippingOrders(ctx context.Context) ([]WooOrder, error) {
+	return w.fetchOrdersByStatus(ctx, "prepare-stock")
+}
+
+func (w *WooClient) fetchOrdersByStatus(ctx context.Context, status string) ([]WooOrder, error) {
+	query := url.Values{}
+	query.Set("status", status)
+	orders, err := w.fetchOrderPages(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("總共取得 %d 筆 %s 訂單", len(orders), status)
+	return orders, nil
+}
+
+// fetchOrderPages lists every order matching query. The first page tells us
+// X-WP-TotalPages; the remaining pages are fetched concurrently by at most
+// PageConcurrency workers and merged back in page order. If any page fails,
+// the errors of all failed pages are joined and returned.
+func (w *WooClient) fetchOrderPages(ctx context.Context, query url.Values) ([]WooOrder, error) {
+	const perPage = 100
+
+	pageQuery := func(page int) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("per_page", strconv.Itoa(perPage))
+		q.Set("page", strconv.Itoa(page))
+		return q
+	}
+
+	var first []WooOrder
+	resp, err := w.getJSON(ctx, "orders", pageQuery(1), &first)
+	if err != nil {
+		return nil, err
+	}
+
+	totalPages, convErr := strconv.Atoi(resp.Header.Get("X-WP-TotalPages"))
+	if convErr != nil {
+		// Header missing (proxy stripped it?): fall back to walking pages
+		// until one comes back short.
+		allOrders := first
+		for page := 2; len(allOrders) == (page-1)*perPage; page++ {
+			var orders []WooOrder
+			if _, err := w.getJSON(ctx, "orders", pageQuery(page), &orders); err != nil {
+				return nil, err
+			}
+			allOrders = append(allOrders, orders...)
+		}
+		return allOrders, nil
+	}
+	if totalPages <= 1 {
+		return first, nil
+	}
+
+	pages := make([][]WooOrder, totalPages+1)
+	pageErrs := make([]error, totalPages+1)
+	pages[1] = first
+
+	workers := w.PageConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > totalPages-1 {
+		workers = totalPages - 1
+	}
+
+	pageCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pageCh {
+				var orders []WooOrder
+				if _, err := w.getJSON(ctx, "orders", pageQuery(page), &orders); err != nil {
+					pageErrs[page] = fmt.Errorf("page %d: %w", page, err)
+					continue
+				}
+				pages[page] = orders
+				log.Printf("已取得第 %d/%d 頁（本頁 %d 筆）", page, totalPages, len(orders))
+			}
+		}()
+	}
+	for page := 2; page <= totalPages; page++ {
+		pageCh <- page
+	}
+	close(pageCh)
+	wg.Wait()
+
+	if err := errors.Join(pageErrs...); err != nil {
+		return nil, err
+	}
+
+	var allOrders []WooOrder
+	for _, orders := range pages {
+		allOrders = append(allOrders, orders...)
+	}
+	return allOrders, nil
+}
+
+func (w *WooClient) fetchSingleOrder(ctx context.Context, orderID int) (WooOrder, error) {
+	var order WooOrder
+	if _, err := w.getJSON(ctx, fmt.Sprintf("orders/%d", orderID), nil, &order); err != nil {
+		return WooOrder{}, err
+	}
+	return order, nil
+}
+
+func (w *WooClient) fetchMultipleOrders(ctx context.Context, orderIDs []int) ([]WooOrder, error) {
+	if len(orderIDs) == 0 {
+		return []WooOrder{}, nil
+	}
+
+	// WooCommerce API supports fetching multiple orders using include parameter
+	ids := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		ids[i] = strconv.Itoa(id)
+	}
+	query := url.Values{}
+	query.Set("include", strings.Join(ids, ","))
+	query.Set("per_page", strconv.Itoa(len(orderIDs)))
+
+	var orders []WooOrder
+	if _, err := w.getJSON(ctx, "orders", query, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// putOrderRaw sends a PUT to the WooCommerce order endpoint with the given
+// JSON body. Shared by putOrderField and putOrderMeta.
+func (w *WooClient) putOrderRaw(ctx context.Context, orderID int, body []byte) error {
+	resp, err := w.do(ctx, http.MethodPut, fmt.Sprintf("orders/%d", orderID), nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if w.OnOrderUpdated != nil {
+		var updated WooOrder
+		if err := json.NewDecoder(resp.Body).Decode(&updated); err == nil && updated.ID != 0 {
+			w.OnOrderUpdated(updated)
+		}
+	}
+	return nil
+}
+
+// putOrderField PUTs a single top-level order field (e.g. customer_note).
+func (w *WooClient) putOrderField(ctx context.Context, orderID int, field string, value interface{}) error {
+	body := map[string]interface{}{field: value}
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal PUT body: %w", err)
+	}
+	return w.putOrderRaw(ctx, orderID, jsonBody)
+}
+
+// putOrderMeta PUTs a meta_data slice to a WC order.
+func (w *WooClient) putOrderMeta(ctx context.Context, orderID int, metaData []map[string]interface{}) error {
+	body := map[string]interface{}{"meta_data": metaData}
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal PUT body: %w", err)
+	}
+	return w.putOrderRaw(ctx, orderID, jsonBody)
+}
+
+// wooBatchItem is one entry of a /orders/batch response: either the updated
+// order or an error for that ID.
+type wooBatchItem struct {
+	WooOrder
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// batchUpdateOrders sends updates (each must carry "id") to /orders/batch,
+// which accepts at most 100 entries per call.
+func (w *WooClient) batchUpdateOrders(ctx context.Context, updates []map[string]interface{}) ([]wooBatchItem, error) {
+	var items []wooBatchItem
+	for start := 0; start < len(updates); start += 100 {
+		end := start + 100
+		if end > len(updates) {
+			end = len(updates)
+		}
+
+		body, err := json.Marshal(map[string]interface{}{"update": updates[start:end]})
+		if err != nil {
+			return nil, fmt.Errorf("marshal batch body: %w", err)
+		}
+		resp, err := w.do(ctx, http.MethodPost, "orders/batch", nil, body)
+		if err != nil {
+			return items, err
+		}
+		var out struct {
+			Update []wooBatchItem `json:"update"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return items, fmt.Errorf("error decoding response: %w", err)
+		}
+
+		for _, item := range out.Update {
+			if item.Error == nil && item.ID != 0 && w.OnOrderUpdated != nil {
+				w.OnOrderUpdated(item.WooOrder)
+			}
+		}
+		items = append(items, out.Update...)
+	}
+	return items, nil
+}
+
+// WooOrderNote is an entry from /orders/{id}/notes.
+type WooOrderNote struct {
+	ID             int    `json:"id"`
+	Author         string `json:"author"`
+	DateCreatedGMT string `json:"date_created_gmt"`
+	Note           string `json:"note"`
+	CustomerNote   bool   `json:"customer_note"`
+	AddedByUser    bool   `json:"added_by_user"`
+}
+
+// listOrderNotes returns the private (internal) notes of an order.
+func (w *WooClient) listOrderNotes(ctx context.Context, orderID int) ([]WooOrderNote, error) {
+	query := url.Values{}
+	query.Set("type", "internal")
+	var notes []WooOrderNote
+	if _, err := w.getJSON(ctx, fmt.Sprintf("orders/%d/notes", orderID), query, &notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// createOrderNote adds a private note to an order.
+func (w *WooClient) createOrderNote(ctx context.Context, orderID int, note string) (WooOrderNote, error) {
+	body, err := json.Marshal(map[string]interface{}{"note": note, "customer_note": false})
+	if err != nil {
+		return WooOrderNote{}, fmt.Errorf("marshal note body: %w", err)
+	}
+	resp, err := w.do(ctx, http.MethodPost, fmt.Sprintf("orders/%d/notes", orderID), nil, body)
+	if err != nil {
+		return WooOrderNote{}, err
+	}
+	defer resp.Body.Close()
+	var created WooOrderNote
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return WooOrderNote{}, fmt.Errorf("error decoding response: %w", err)
+	}
+	return created, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestWooClient points a WooClient at srv with retry delays short enough
+// for tests.
+func newTestWooClient(srv *httptest.Server) *WooClient {
+	w := newWooClient(srv.URL, "ck_test", "cs_test", srv.Client())
+	w.RetryBaseDelay = time.Millisecond
+	w.RetryMaxDelay = 5 * time.Millisecond
+	return w
+}
+
+func TestWooClientRetriesTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ck_test" || pass != "cs_test" {
+			t.Errorf("missing basic auth: %q %q", user, pass)
+		}
+		if calls.Add(1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(rw).Encode(WooOrder{ID: 42})
+	}))
+	defer srv.Close()
+
+	order, err := newTestWooClient(srv).fetchSingleOrder(context.Background(), 42)
+	if err != nil {
+		t.Fatalf("fetchSingleOrder: %v", err)
+	}
+	if order.ID != 42 {
+		t.Errorf("order.ID = %d, want 42", order.ID)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+}
+
+func TestWooClientGivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	w := newTestWooClient(srv)
+	w.MaxRetries = 2
+	_, err := w.fetchSingleOrder(context.Background(), 1)
+	var statusErr *wooStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("err = %v, want a 502 wooStatusError", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+}
+
+func TestWooClientDoesNotRetryNonIdempotentServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if _, err := newTestWooClient(srv).createOrderNote(context.Background(), 1, "note"); err == nil {
+		t.Fatal("createOrderNote succeeded, want error")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls = %d, want 1 (POST must not be retried on 500)", got)
+	}
+}
+
+func TestWooClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	if _, err := newTestWooClient(srv).fetchSingleOrder(context.Background(), 1); err == nil {
+		t.Fatal("fetchSingleOrder succeeded, want error")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls = %d, want 1", got)
+	}
+}
+
+// servePagedOrders serves total orders, 100 per page. With withTotal it
+// sets X-WP-TotalPages; failPage, if non-zero, always answers 404.
+func servePagedOrders(t *testing.T, total int, withTotal bool, failPage int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wp-json/wc/v3/orders" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("status") != "processing" {
+			t.Errorf("status filter lost: %s", r.URL.RawQuery)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == failPage {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		pages := (total + 99) / 100
+		if withTotal {
+			rw.Header().Set("X-WP-TotalPages", strconv.Itoa(pages))
+		}
+		orders := []WooOrder{}
+		for id := (page-1)*100 + 1; id <= page*100 && id <= total; id++ {
+			orders = append(orders, WooOrder{ID: id})
+		}
+		json.NewEncoder(rw).Encode(orders)
+	}))
+}
+
+func checkOrderIDs(t *testing.T, orders []WooOrder, total int) {
+	t.Helper()
+	if len(orders) != total {
+		t.Fatalf("got %d orders, want %d", len(orders), total)
+	}
+	for i, o := range orders {
+		if o.ID != i+1 {
+			t.Fatalf("orders[%d].ID = %d, want %d (pages out of order)", i, o.ID, i+1)
+		}
+	}
+}
+
+func TestWooClientFetchesAllPagesInOrder(t *testing.T) {
+	srv := servePagedOrders(t, 750, true, 0)
+	defer srv.Close()
+
+	w := newTestWooClient(srv)
+	w.PageConcurrency = 3
+	orders, err := w.fetchProcessingOrders(context.Background())
+	if err != nil {
+		t.Fatalf("fetchProcessingOrders: %v", err)
+	}
+	checkOrderIDs(t, orders, 750)
+}
+
+func TestWooClientWalksPagesWithoutTotalHeader(t *testing.T) {
+	srv := servePagedOrders(t, 200, false, 0)
+	defer srv.Close()
+
+	orders, err := newTestWooClient(srv).fetchProcessingOrders(context.Background())
+	if err != nil {
+		t.Fatalf("fetchProcessingOrders: %v", err)
+	}
+	checkOrderIDs(t, orders, 200)
+}
+
+func TestWooClientReportsFailedPages(t *testing.T) {
+	srv := servePagedOrders(t, 500, true, 3)
+	defer srv.Close()
+
+	_, err := newTestWooClient(srv).fetchProcessingOrders(context.Background())
+	var statusErr *wooStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("err = %v, want page 3's 404", err)
+	}
+}
+
+func TestWooClientStopsRetryingWhenCancelled(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.Header().Set("Retry-After", "30")
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	w := newTestWooClient(srv)
+	w.RetryMaxDelay = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := w.fetchSingleOrder(ctx, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s; cancellation did not interrupt the Retry-After wait", elapsed)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls = %d, want 1", got)
+	}
+}
+
+func TestWooClientCancelsInFlightRequest(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := newTestWooClient(srv).fetchSingleOrder(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
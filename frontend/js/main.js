@@ -1,15 +1,20 @@
-function showAlert(message, type) {
+// timeout 為 0 時不自動關閉
+function showAlert(message, type, timeout = 3000) {
   const alertDiv = document.createElement("div");
   alertDiv.className = `alert alert-${type} alert-dismissible fade show position-fixed`;
   alertDiv.style.cssText = "top: 20px; right: 20px; z-index: 1050; min-width: 300px;";
   alertDiv.innerHTML = `${message}<button type="button" class="btn-close" data-bs-dismiss="alert"></button>`;
   document.body.appendChild(alertDiv);
-  setTimeout(() => { if (alertDiv.parentNode) { alertDiv.remove(); } }, 3000);
+  if (timeout > 0) {
+    setTimeout(() => { if (alertDiv.parentNode) { alertDiv.remove(); } }, timeout);
+  }
 }
 
 function showOrderDetails(orderId) {
-  // Fetch the order details directly from the API
-  fetch(`/api/orders/${orderId}`)
+  // 先拉取 wp-admin 新增的備註再讀取訂單；未啟用同步時後端不做任何事
+  fetch(`/api/orders/${orderId}/notes/sync`, { method: 'POST' })
+    .catch(() => {})
+    .then(() => fetch(`/api/orders/${orderId}`))
     .then(response => {
       if (!response.ok) {
         throw new Error(`API request failed with status ${response.status}`);
@@ -137,3 +142,185 @@ function formatDate(dateStr) {
         return dateStr;
     }
 }
+
+// 將文字轉為可安全放進 HTML（含屬性值）的字串
+function escapeHtml(value) {
+    return String(value ?? '').replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c]));
+}
+
+// 列印紀錄是在產生列印頁面或 PDF 時寫入，無法得知實際是否印出
+const LABEL_PRINT_NOTE = '開啟列印頁面或下載 PDF 時即記錄，不代表實際已印出';
+
+// 列印紀錄的純文字摘要「時間 / 人員」，人員名稱壓成單行以免混淆確認視窗內容
+function labelPrintSummary(labelPrint) {
+    const by = String(labelPrint.printed_by || '').replace(/\s+/g, ' ').trim().slice(0, 40);
+    return `${formatDate(labelPrint.printed_at)} / ${by}`;
+}
+
+// 托運單列印紀錄：顯示「已列印 時間 / 人員」
+function labelPrintHtml(labelPrint) {
+    if (!labelPrint) return '';
+    const count = labelPrint.print_count > 1 ? `（共 ${labelPrint.print_count} 次）` : '';
+    return `<br><small class="text-success" title="${escapeHtml(LABEL_PRINT_NOTE)}">已列印 ${escapeHtml(labelPrintSummary(labelPrint))}${count}</small>`;
+}
+
+// 列印人員名稱，第一次列印時詢問並記在瀏覽器中
+function labelPrintedBy() {
+    let name = localStorage.getItem('labelPrintedBy');
+    if (name === null) {
+        name = (prompt('請輸入列印人員名稱（留空則記錄 IP）') || '').trim();
+        localStorage.setItem('labelPrintedBy', name);
+    }
+    return name;
+}
+
+// 批次列印前檢查已列印過的訂單；回傳 null 代表取消
+function labelPrintQuery(orderIds, orders) {
+    const params = new URLSearchParams({ ids: orderIds.join(',') });
+    const printedBy = labelPrintedBy();
+    if (printedBy) params.set('printed_by', printedBy);
+
+    const printed = orders.filter(o => orderIds.includes(o.id) && o.label_print);
+    if (printed.length > 0) {
+        const list = printed.map(o => `#${o.id}（${labelPrintSummary(o.label_print)}）`).join('\n');
+        if (confirm(`以下 ${printed.length} 筆訂單的托運單已列印過（${LABEL_PRINT_NOTE}）：\n${list}\n\n按「確定」略過這些訂單，按「取消」全部重新列印。`)) {
+            params.set('skip_printed', 'true');
+            if (printed.length === orderIds.length) {
+                showAlert('所選訂單的托運單都已列印過', 'warning');
+                return null;
+            }
+        }
+    }
+    return params;
+}
+
+// 單筆列印托運單；已列印過時先確認
+function openShippingLabel(orderId, orders) {
+    const order = orders.find(o => o.id === orderId);
+    if (order && order.label_print &&
+        !confirm(`此托運單已於 ${labelPrintSummary(order.label_print)} 列印過（${LABEL_PRINT_NOTE}），確定要再印一次？`)) {
+        return;
+    }
+    const params = new URLSearchParams();
+    const printedBy = labelPrintedBy();
+    if (printedBy) params.set('printed_by', printedBy);
+    window.open(`/api/orders/${orderId}/print-label?${params}`, '_blank');
+}
+
+// 批次列印所選訂單的托運單（跨物流商一個分頁），已列印過的可選擇略過
+function openBatchLabels(orderIds, orders) {
+    if (orderIds.length === 0) {
+        alert('請先勾選要列印的訂單');
+        return;
+    }
+    const params = labelPrintQuery(orderIds, orders);
+    if (!params) return;
+    window.open(`/api/orders/batch-print-label?${params}`, '_blank');
+}
+
+// 將勾選的訂單變更為指定的 WooCommerce 狀態；onMoved 收到成功變更的訂單 ID，
+// 由各頁面從列表與勾選中移除並重繪
+async function changeOrdersStatus(selectedIds, targetStatus, label, onMoved) {
+    if (selectedIds.size === 0) {
+        showAlert('請先勾選至少一筆訂單', 'warning');
+        return;
+    }
+    const ids = Array.from(selectedIds).map(Number);
+    if (!confirm(`確定要將 ${ids.length} 筆訂單變更為「${label}」？`)) {
+        return;
+    }
+
+    const btn = document.getElementById('batch-status-btn');
+    const prevHtml = btn ? btn.innerHTML : '';
+    if (btn) {
+        btn.disabled = true;
+        btn.innerHTML = `<span class="spinner-border spinner-border-sm me-2"></span>變更中 (${ids.length})...`;
+    }
+    try {
+        const res = await fetch('/api/orders/status', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ order_ids: ids, status: targetStatus })
+        });
+        const data = await res.json();
+        if (!res.ok) {
+            throw new Error(data.error || `${res.status}`);
+        }
+        const results = Array.isArray(data.results) ? data.results : [];
+        const failed = results.filter(r => !r.success);
+        const moved = new Set(results.filter(r => r.success).map(r => r.order_id));
+        onMoved(moved);
+
+        if (failed.length === 0) {
+            showAlert(`已將 ${moved.size} 筆訂單變更為「${label}」`, 'success');
+        } else {
+            const detail = failed.map(r => `#${r.order_id}：${r.error || '未知錯誤'}`).join('<br>');
+            showAlert(`變更狀態：✓ ${moved.size} 成功 / ✗ ${failed.length} 失敗<br>${detail}`, 'warning');
+        }
+    } catch (err) {
+        console.error('changeOrdersStatus error:', err);
+        showAlert(`變更訂單狀態失敗：${err.message}`, 'danger');
+    } finally {
+        if (btn) {
+            btn.innerHTML = prevHtml;
+            btn.disabled = false;
+        }
+    }
+}
+
+// 上傳賣貨便報表；有錯誤列時列出錯誤，並可選擇只匯入正確的資料列。
+// 已上傳訂單中不在此報表的品項預設保留，確認後才移除
+async function uploadSellReport(endpoint, file) {
+    const formData = new FormData();
+    formData.append("file", file);
+    // 沿用列印標籤時輸入的人員名稱；沒有則由後端記錄 IP
+    const uploader = localStorage.getItem('labelPrintedBy');
+    if (uploader) formData.append("uploaded_by", uploader);
+
+    let response = await fetch(endpoint, { method: "POST", body: formData });
+    if (response.ok) {
+        const payload = await response.json().catch(() => ({}));
+        return confirmRemoveMissing(endpoint, file, formData, payload, "");
+    }
+
+    const data = await response.json().catch(() => ({}));
+    const errors = Array.isArray(data.errors) ? data.errors : [];
+    if (errors.length === 0) {
+        throw new Error(`檔案 "${file.name}" 上傳失敗：${data.error || response.statusText || "請檢查檔案格式"}`);
+    }
+
+    const lines = errors.slice(0, 10).map(e => `第 ${e.row} 列 ${e.header || e.column}「${e.value}」：${e.reason}`);
+    if (errors.length > 10) {
+        lines.push(`…另有 ${errors.length - 10} 個錯誤`);
+    }
+    if (!confirm(`檔案 "${file.name}" 有 ${errors.length} 個欄位錯誤：\n${lines.join("\n")}\n\n按「確定」只匯入正確的資料列（錯誤列會下載成 Excel），按「取消」中止上傳。`)) {
+        if (data.rejects_url) {
+            window.location.href = data.rejects_url;
+        }
+        throw new Error(`檔案 "${file.name}" 有 ${errors.length} 個欄位錯誤，已中止上傳`);
+    }
+
+    response = await fetch(`${endpoint}?allow_partial=true`, { method: "POST", body: formData });
+    const payload = await response.json().catch(() => ({}));
+    if (!response.ok) {
+        throw new Error(`檔案 "${file.name}" 上傳失敗：${payload.error || response.statusText}`);
+    }
+    if (payload.rejects_url) {
+        window.location.href = payload.rejects_url;
+    }
+    return confirmRemoveMissing(endpoint, file, formData, payload, "&allow_partial=true");
+}
+
+// 報表少了已上傳訂單的品項時詢問是否移除；確認後以 remove_missing 重新上傳
+async function confirmRemoveMissing(endpoint, file, formData, payload, query) {
+    const missing = payload.missing ?? 0;
+    if (missing === 0 || !confirm(`檔案 "${file.name}" 的訂單中有 ${missing} 筆已上傳的品項不在此報表中，是否移除？\n\n按「取消」保留這些品項。`)) {
+        return payload;
+    }
+    const response = await fetch(`${endpoint}?remove_missing=true${query}`, { method: "POST", body: formData });
+    const removed = await response.json().catch(() => ({}));
+    if (!response.ok) {
+        throw new Error(`檔案 "${file.name}" 已上傳，但移除品項失敗：${removed.error || response.statusText}`);
+    }
+    return { ...payload, removed: removed.removed ?? 0, missing: removed.missing ?? 0 };
+}
@@ -251,7 +251,7 @@ function renderOrders() {
 
     const hasEcpayShipping = order.meta_data?.some(m => m.key === "_ecpay_shipping_info");
     const printLabelHtml = hasEcpayShipping
-      ? `<button class="btn btn-sm btn-outline-secondary" onclick="printShippingLabel(${order.id})">列印</button>`
+      ? `<button class="btn btn-sm btn-outline-secondary" onclick="printShippingLabel(${order.id})">列印</button>${labelPrintHtml(order.label_print)}`
       : '';
 
     row.innerHTML = `
@@ -406,6 +406,11 @@ async function updateOrderMetadata(orderId) {
     if (!res.ok) {
       throw new Error(`API request failed with status ${res.status}`);
     }
+    const saved = await res.json();
+    if (saved.sync_conflict) {
+      showAlert(`訂單資料已儲存，但與 WooCommerce 後台衝突：${saved.sync_conflict}`, "warning");
+      return;
+    }
     showAlert("訂單資料已更新", "success");
   } catch (error) {
     console.error("更新失敗:", error);
@@ -596,50 +601,76 @@ async function exportPickingList() {
 }
 
 function printShippingLabel(orderId) {
-  window.open(`/api/orders/${orderId}/print-label`, '_blank');
+  openShippingLabel(orderId, allOrders);
+}
+
+// Opens one print tab covering every selected order across carriers; the
+// page lists any order whose label could not be fetched.
+function batchPrintLabels() {
+  openBatchLabels(Array.from(selectedOrderIds), allOrders);
 }
 
-async function batchPrintLabels() {
+// 7-11 交貨便標籤無法放進 PDF，提示並提供網頁列印連結（不自動關閉）
+function showWebOnlyLabels(orderIds, printedBy) {
+  const ids = orderIds.map(id => parseInt(id, 10)).filter(id => id > 0);
+  if (ids.length === 0) return;
+  const params = new URLSearchParams({ ids: ids.join(',') });
+  if (printedBy) params.set('printed_by', printedBy);
+  showAlert(`以下 7-11 交貨便訂單的托運單只能以網頁列印，未包含在 PDF 中：${ids.map(id => `#${id}`).join('、')}
+    <a class="alert-link d-block mt-1" href="/api/orders/batch-print-label?${params}" target="_blank" rel="noopener">開啟網頁列印</a>`, 'warning', 0);
+}
+
+// Downloads the selected orders' labels as one 100x150mm PDF, in the order
+// they were selected. 7-11 C2C labels can only be printed as a web page;
+// they are left out and offered as a web print link instead.
+async function downloadLabelsPDF() {
   if (selectedOrderIds.size === 0) {
     alert('請先勾選要列印的訂單');
     return;
   }
 
-  const orderIds = Array.from(selectedOrderIds);
+  const params = labelPrintQuery(Array.from(selectedOrderIds), allOrders);
+  if (!params) return;
+  params.set('format', 'pdf');
 
-  // Fetch orders to group by logistics type
+  const btn = document.getElementById('download-labels-pdf-btn');
+  const originalBtnHTML = btn ? btn.innerHTML : '';
+  if (btn) {
+    btn.disabled = true;
+    btn.innerHTML = '<span class="spinner-border spinner-border-sm me-2"></span>產生中...';
+  }
   try {
-    const response = await fetch('/api/orders/batch', {
-      method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify({ order_ids: orderIds.map(Number) })
-    });
-    const orders = await response.json();
-
-    // Group order IDs by logistics sub type
-    const groups = {};
-    for (const order of orders) {
-      const ecpayMeta = order.meta_data?.find(m => m.key === '_ecpay_shipping_info');
-      if (!ecpayMeta || typeof ecpayMeta.value !== 'object') continue;
-
-      const firstKey = Object.keys(ecpayMeta.value)[0];
-      const data = ecpayMeta.value[firstKey];
-      const subType = data?.LogisticsSubType || 'OTHER';
-
-      if (!groups[subType]) groups[subType] = [];
-      groups[subType].push(order.id);
-    }
-
-    // Open one print tab per logistics type
-    for (const [subType, ids] of Object.entries(groups)) {
-      const idsParam = ids.join(',');
-      window.open(`/api/orders/batch-print-label?ids=${idsParam}`, '_blank');
-    }
+    const res = await fetch(`/api/orders/batch-print-label?${params}`);
+    if (!res.ok) {
+      const data = await res.json().catch(() => ({}));
+      const report = data.report || [];
+      showWebOnlyLabels(report.filter(r => r.web_only).map(r => r.order_id), params.get('printed_by'));
+      const reasons = report.filter(r => !r.ok && !r.web_only).map(r => `#${r.order_id} ${r.skipped ? '已列印過' : r.error}`);
+      throw new Error([data.error || res.status, ...reasons].join('\n'));
+    }
+
+    const blob = await res.blob();
+    const link = document.createElement('a');
+    link.href = URL.createObjectURL(blob);
+    link.download = `托運單_${new Date().getTime()}.pdf`;
+    link.click();
+    URL.revokeObjectURL(link.href);
+
+    const webOnly = (res.headers.get('X-Web-Only-Orders') || '').split(',').filter(Boolean);
+    const skipped = (res.headers.get('X-Skipped-Orders') || '').split(',').filter(id => id && !webOnly.includes(id));
+    if (skipped.length > 0) {
+      showAlert(`以下訂單未包含在 PDF 中（已列印過或無法產生 PDF）：${skipped.join(',')}`, 'warning');
+    }
+    showWebOnlyLabels(webOnly, params.get('printed_by'));
+    loadOrders();
   } catch (err) {
-    console.error('批次列印分組失敗:', err);
-    // Fallback: open all at once
-    const idsParam = orderIds.join(',');
-    window.open(`/api/orders/batch-print-label?ids=${idsParam}`, '_blank');
+    console.error('下載托運單 PDF 失敗:', err);
+    showAlert(`下載托運單 PDF 失敗：${err.message}`, 'danger');
+  } finally {
+    if (btn) {
+      btn.disabled = false;
+      btn.innerHTML = originalBtnHTML;
+    }
   }
 }
 
@@ -875,3 +906,15 @@ async function exportOrderList() {
     }
   }
 }
+
+// ---------- 變更 WooCommerce 訂單狀態 ----------
+
+async function changeOrderStatusBatch(targetStatus, label) {
+  await changeOrdersStatus(selectedOrderIds, targetStatus, label, moved => {
+    // Orders that changed status no longer belong on this page.
+    allOrders = allOrders.filter(o => !moved.has(o.id));
+    allOrdersUnfiltered = allOrdersUnfiltered.filter(o => !moved.has(o.id));
+    moved.forEach(id => selectedOrderIds.delete(id));
+    renderOrders();
+  });
+}
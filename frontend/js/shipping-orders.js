@@ -236,6 +236,13 @@ function renderOrders() {
     const row = document.createElement("tr");
     const shippingMethod = order.shipping_lines && order.shipping_lines.length > 0 ? order.shipping_lines[0].method_title : 'N/A';
     const cvsStoreName = order.cvs_store_name || '';
+    const shipment = order.shipment_status;
+    let shipmentHtml = '';
+    if (shipment && shipment.stale) {
+      shipmentHtml = `<br><span class="badge bg-danger" title="${shipment.status_msg || ''}">未寄件 ${shipment.awaiting_days} 天</span>`;
+    } else if (shipment && shipment.status_msg) {
+      shipmentHtml = `<br><small class="text-muted">${shipment.status_msg}</small>`;
+    }
     const isSelected = selectedOrderIds.has(order.id);
 
     // Format date_created as YYYY-mm-dd HH:ii:ss
@@ -250,11 +257,14 @@ function renderOrders() {
     }).replace(/\//g, '-') : 'N/A';
 
     const hasEcpayShipping = order.meta_data?.some(m => m.key === "_ecpay_shipping_info");
-    const hasEcpayShippingMethod = order.shipping_lines?.some(s => typeof s.method_id === 'string' && s.method_id.startsWith('ry_ecpay_shipping_cvs_'));
-    const canReissue = hasEcpayShipping || hasEcpayShippingMethod;
-    const reissueBtnHtml = canReissue
-      ? `<button class="btn btn-sm btn-warning reissue-btn" data-order-id="${order.id}" onclick="reissueTracking(${order.id})">重新取號</button>`
-      : '';
+    const hasEcpayShippingMethod = order.shipping_lines?.some(s => typeof s.method_id === 'string' && (s.method_id.startsWith('ry_ecpay_shipping_cvs_') || s.method_id.startsWith('ry_ecpay_shipping_home_')));
+    let reissueBtnHtml = '';
+    if (hasEcpayShipping) {
+      reissueBtnHtml = `<button class="btn btn-sm btn-warning reissue-btn" data-order-id="${order.id}" onclick="reissueTracking(${order.id})">重新取號</button>
+        <button class="btn btn-sm btn-outline-secondary mt-1" onclick="printShippingLabel(${order.id})">列印</button>`;
+    } else if (hasEcpayShippingMethod) {
+      reissueBtnHtml = `<button class="btn btn-sm btn-success reissue-btn" data-order-id="${order.id}" onclick="createShipment(${order.id})">建立物流單</button>`;
+    }
 
     row.innerHTML = `
       <td><input type="checkbox" class="form-check-input order-checkbox" data-order-id="${order.id}" ${isSelected ? 'checked' : ''} onchange="toggleOrderSelection(${order.id})"></td>
@@ -264,7 +274,7 @@ function renderOrders() {
       <td>${order.payment_method_title || 'N/A'}</td>
       <td>${order.total}</td>
       <td>${shippingMethod}</td>
-      <td>${cvsStoreName}</td>
+      <td>${cvsStoreName}${shipmentHtml}${labelPrintHtml(order.label_print)}</td>
       <td>${order.customer_note || ''}</td>
       <td><input type="text" class="form-control form-control-sm remark-input" value="${order.order_metadata.remark || ''}" onchange="updateOrderMetadata(${order.id})"></td>
       <td class="tag-cell" id="tags-${order.id}"></td>
@@ -408,6 +418,11 @@ async function updateOrderMetadata(orderId) {
     if (!res.ok) {
       throw new Error(`API request failed with status ${res.status}`);
     }
+    const saved = await res.json();
+    if (saved.sync_conflict) {
+      showAlert(`訂單資料已儲存，但與 WooCommerce 後台衝突：${saved.sync_conflict}`, "warning");
+      return;
+    }
     showAlert("訂單資料已更新", "success");
   } catch (error) {
     console.error("更新失敗:", error);
@@ -868,7 +883,10 @@ function _updateTrackingInLocal(orderId, newTrackingNo) {
   });
 }
 
-async function _callReissueApi(orderIds) {
+// Starts a background reissue job and streams its per-order results over
+// Server-Sent Events. onResult is called as each order finishes; the promise
+// resolves with every result once the job is done.
+async function _callReissueApi(orderIds, onResult) {
   const res = await fetch('/api/orders/regenerate-tracking', {
     method: 'POST',
     headers: { 'Content-Type': 'application/json' },
@@ -878,7 +896,37 @@ async function _callReissueApi(orderIds) {
     const text = await res.text();
     throw new Error(`${res.status}: ${text}`);
   }
-  return await res.json();
+  const { job_id: jobId, total } = await res.json();
+
+  return new Promise((resolve, reject) => {
+    const results = [];
+    const source = new EventSource(`/api/reissue-jobs/${encodeURIComponent(jobId)}/events`);
+    source.addEventListener('result', e => {
+      const r = JSON.parse(e.data);
+      results.push(r);
+      if (onResult) onResult(r, results.length, total);
+    });
+    source.addEventListener('done', () => {
+      source.close();
+      resolve({ results });
+    });
+    source.onerror = () => {
+      // EventSource reconnects on its own (resuming via Last-Event-ID);
+      // give up only once the browser has closed the stream for good.
+      if (source.readyState === EventSource.CLOSED) {
+        reject(new Error('與伺服器的進度連線中斷'));
+      }
+    };
+  });
+}
+
+function _applyReissueResult(r) {
+  if (r.success) {
+    _updateTrackingInLocal(r.order_id, r.new_payment_no || '');
+    _flashRow(r.order_id, '#c8f7c5');
+  } else {
+    _flashRow(r.order_id, '#f7c5c5', r.error || '未知錯誤');
+  }
 }
 
 async function reissueTracking(orderId) {
@@ -891,19 +939,9 @@ async function reissueTracking(orderId) {
     btn.innerHTML = '<span class="spinner-border spinner-border-sm"></span> 重新取號中...';
   }
   try {
-    const data = await _callReissueApi([orderId]);
-    const results = Array.isArray(data.results) ? data.results : [];
-    let ok = 0, fail = 0;
-    results.forEach(r => {
-      if (r.success) {
-        ok++;
-        _updateTrackingInLocal(r.order_id, r.new_payment_no || '');
-        _flashRow(r.order_id, '#c8f7c5');
-      } else {
-        fail++;
-        _flashRow(r.order_id, '#f7c5c5', r.error || '未知錯誤');
-      }
-    });
+    const data = await _callReissueApi([orderId], _applyReissueResult);
+    const ok = data.results.filter(r => r.success).length;
+    const fail = data.results.length - ok;
     showAlert(`重新取號：✓ ${ok} 成功 / ✗ ${fail} 失敗`, fail === 0 ? 'success' : 'warning');
   } catch (err) {
     console.error('reissueTracking error:', err);
@@ -916,6 +954,15 @@ async function reissueTracking(orderId) {
   }
 }
 
+function printShippingLabel(orderId) {
+  openShippingLabel(orderId, allOrders);
+}
+
+// 批次列印托運單；已列印過的訂單會先提示，可選擇略過
+function batchPrintLabels() {
+  openBatchLabels(Array.from(selectedOrderIds), allOrders);
+}
+
 async function reissueTrackingBatch() {
   if (selectedOrderIds.size === 0) {
     showAlert('請先勾選至少一筆訂單', 'warning');
@@ -942,19 +989,16 @@ async function reissueTrackingBatch() {
     }
   });
   try {
-    const data = await _callReissueApi(ids);
-    const results = Array.isArray(data.results) ? data.results : [];
-    let ok = 0, fail = 0;
-    results.forEach(r => {
-      if (r.success) {
-        ok++;
-        _updateTrackingInLocal(r.order_id, r.new_payment_no || '');
-        _flashRow(r.order_id, '#c8f7c5');
-      } else {
-        fail++;
-        _flashRow(r.order_id, '#f7c5c5', r.error || '未知錯誤');
+    const data = await _callReissueApi(ids, (r, done, total) => {
+      _applyReissueResult(r);
+      const rowBtn = perRowBtns.find(b => b.el.dataset.orderId === String(r.order_id));
+      if (rowBtn) rowBtn.el.innerHTML = r.success ? '✓' : '✗';
+      if (btn) {
+        btn.innerHTML = `<span class="spinner-border spinner-border-sm me-2"></span>重新取號中 (${done}/${total})...`;
       }
     });
+    const ok = data.results.filter(r => r.success).length;
+    const fail = data.results.length - ok;
     showAlert(`批次重新取號：✓ ${ok} 成功 / ✗ ${fail} 失敗`, fail === 0 ? 'success' : 'warning');
   } catch (err) {
     console.error('reissueTrackingBatch error:', err);
@@ -971,3 +1015,55 @@ async function reissueTrackingBatch() {
     });
   }
 }
+
+async function createShipment(orderId) {
+  const btn = document.querySelector(`.reissue-btn[data-order-id="${orderId}"]`);
+  const prevHtml = btn ? btn.innerHTML : '';
+  const prevDisabled = btn ? btn.disabled : false;
+  if (btn) {
+    btn.disabled = true;
+    btn.innerHTML = '<span class="spinner-border spinner-border-sm"></span> 建立中...';
+  }
+  try {
+    const res = await fetch('/api/orders/create-shipment', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ order_ids: [orderId] })
+    });
+    if (!res.ok) {
+      const text = await res.text();
+      throw new Error(`${res.status}: ${text}`);
+    }
+    const data = await res.json();
+    const r = (Array.isArray(data.results) ? data.results : [])[0];
+    if (r && r.success) {
+      _updateTrackingInLocal(r.order_id, r.new_payment_no || '');
+      _flashRow(r.order_id, '#c8f7c5');
+      showAlert(`訂單 ${orderId} 已建立物流單：${r.new_payment_no || r.logistics_id}`, 'success');
+      loadOrders();
+    } else {
+      _flashRow(orderId, '#f7c5c5', (r && r.error) || '未知錯誤');
+      showAlert(`建立物流單失敗：${(r && r.error) || '未知錯誤'}`, 'danger');
+    }
+  } catch (err) {
+    console.error('createShipment error:', err);
+    showAlert(`建立物流單失敗：${err.message}`, 'danger');
+  } finally {
+    if (btn) {
+      btn.innerHTML = prevHtml || '建立物流單';
+      btn.disabled = prevDisabled;
+    }
+  }
+}
+
+// ---------- 變更 WooCommerce 訂單狀態 ----------
+
+async function changeOrderStatusBatch(targetStatus, label) {
+  await changeOrdersStatus(selectedOrderIds, targetStatus, label, moved => {
+    // Orders that changed status no longer belong on this page.
+    allOrders = allOrders.filter(o => !moved.has(o.id));
+    allOrdersUnfiltered = allOrdersUnfiltered.filter(o => !moved.has(o.id));
+    moved.forEach(id => selectedOrderIds.delete(id));
+    renderOrders();
+  });
+}
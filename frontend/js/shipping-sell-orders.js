@@ -65,13 +65,13 @@ async function handleUpload(event) {
 
   const files = fileInput.files;
   if (!files || files.length === 0) {
-    showAlert("請先選擇 .xlsx 檔案", "warning");
+    showAlert("請先選擇 .xlsx、.xls 或 .csv 檔案", "warning");
     return;
   }
 
   for (const file of files) {
-    if (!file.name.toLowerCase().endsWith(".xlsx")) {
-      showAlert(`檔案 "${file.name}" 不是 .xlsx 格式`, "warning");
+    if (!/\.(xlsx|xls|csv)$/i.test(file.name)) {
+      showAlert(`檔案 "${file.name}" 不是 .xlsx、.xls 或 .csv 格式`, "warning");
       return;
     }
   }
@@ -81,31 +81,26 @@ async function handleUpload(event) {
 
   try {
     let totalRows = 0;
+    const counts = { inserted: 0, updated: 0, unchanged: 0, removed: 0, missing: 0 };
+    let rejected = 0;
 
     for (let i = 0; i < files.length; i++) {
       const file = files[i];
-      const formData = new FormData();
-      formData.append("file", file);
-
       uploadButton.innerHTML = `<span class="spinner-border spinner-border-sm" role="status" aria-hidden="true"></span> 上傳中 (${i + 1}/${files.length})...`;
 
-      const response = await fetch("/orders/upload-shipping", {
-        method: "POST",
-        body: formData,
-      });
-
-      if (!response.ok) {
-        const errorText = await response.text().catch(() => response.statusText);
-        throw new Error(`檔案 "${file.name}" 上傳失敗：${errorText || "請檢查檔案格式"}`);
-      }
-
-      const payload = await response.json().catch(() => ({}));
+      const payload = await uploadSellReport("/orders/upload-shipping", file);
       const rowCount = payload.rows ?? payload.count ?? 0;
       totalRows += rowCount;
+      counts.inserted += payload.inserted ?? 0;
+      counts.updated += payload.updated ?? 0;
+      counts.unchanged += payload.unchanged ?? 0;
+      counts.removed += payload.removed ?? 0;
+      counts.missing += payload.missing ?? 0;
+      rejected += payload.rejected ?? 0;
     }
 
     updateUploadBadge(totalRows);
-    showAlert(`成功上傳 ${files.length} 個檔案，共 ${totalRows} 筆資料`, "success");
+    showAlert(`成功上傳 ${files.length} 個檔案，共 ${totalRows} 筆資料（新增 ${counts.inserted}、更新 ${counts.updated}、未變更 ${counts.unchanged}${counts.removed ? `、移除 ${counts.removed} 筆已不在報表中的品項` : ""}${counts.missing ? `、保留 ${counts.missing} 筆已不在報表中的品項` : ""}）${rejected ? `，略過 ${rejected} 筆錯誤列` : ""}`, rejected ? "warning" : "success");
     fileInput.value = "";
     fetchAggregatedOrders();
   } catch (error) {